@@ -0,0 +1,673 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/challenge-league/nakama-plugin-challenge-league/v2/repository"
+	"github.com/gofrs/uuid"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	ACCOUNT_LINK_PENDING_COLLECTION = "account_link_pending"
+	ACCOUNT_LINK_PENDING_KEY        = "pending"
+	ACCOUNT_LINK_COLLECTION         = "account_link"
+	ACCOUNT_LINK_AUDIT_COLLECTION   = "account_link_audit"
+	IDENTITY_LINK_COLLECTION        = "identity_link"
+
+	LINK_IDENTITY_EMAIL   = "email"
+	LINK_IDENTITY_DISCORD = "discord"
+	LINK_IDENTITY_STEAM   = "steam"
+
+	LINK_ACTION_LINK   = "link"
+	LINK_ACTION_UNLINK = "unlink"
+
+	LINK_AUDIT_REQUESTED = "requested"
+	LINK_AUDIT_LINKED    = "linked"
+	LINK_AUDIT_UNLINKED  = "unlinked"
+	LINK_AUDIT_CONFLICT  = "conflict"
+	LINK_AUDIT_REJECTED  = "rejected"
+
+	ACCOUNT_LINK_CODE_DIGITS   = 6
+	ACCOUNT_LINK_CODE_TTL      = 10 * time.Minute
+	ACCOUNT_LINK_MAX_ATTEMPTS  = 5
+	ACCOUNT_LINK_AUDIT_LIMIT   = 100
+	ACCOUNT_LINK_LIST_LIMIT    = 100
+	STEAM_TOKEN_AUDIT_REDACTED = "<steam token>"
+)
+
+// PendingAccountLink is the link or unlink waiting for the verification code sent to the identity, only the code hash is stored.
+// Steam links are never pending, the Steam session token proves the ownership when it is applied.
+type PendingAccountLink struct {
+	UserID     string
+	Action     string
+	Type       string
+	Identifier string
+	CodeHash   string
+	Attempts   int
+	ExpiresAt  time.Time
+	Version    string
+}
+
+// LinkedIdentity is an additional Discord account of a user, Nakama stores the email and Steam links itself.
+// It is stored in the ACCOUNT_LINK_COLLECTION of the user and in the IDENTITY_LINK_COLLECTION of the system user,
+// where the key "<type>.<identifier>" makes the identity unique across users.
+type LinkedIdentity struct {
+	UserID     string
+	Type       string
+	Identifier string
+	DateTime   time.Time
+}
+
+type AccountLinkAudit struct {
+	UserID      string
+	ActorUserID string
+	Action      string
+	Type        string
+	Identifier  string
+	Result      string
+	Reason      string
+	DateTime    time.Time
+}
+
+// AccountLinkStartRequest starts a link or unlink, Identifier is the email or Discord ID and SteamToken
+// the Steam session ticket of the client for a Steam link or unlink
+type AccountLinkStartRequest struct {
+	UserID     string
+	Action     string
+	Type       string
+	Identifier string
+	SteamToken string
+}
+
+type AccountLinkConfirmRequest struct {
+	UserID string
+	Code   string
+}
+
+type AccountLinksGetRequest struct {
+	UserID string
+}
+
+type AccountLinks struct {
+	UserID     string
+	DiscordID  string
+	Email      string
+	SteamID    string
+	Discord    []*LinkedIdentity
+	AuditTrail []*AccountLinkAudit
+}
+
+func isLinkIdentityType(identityType string) bool {
+	switch identityType {
+	case LINK_IDENTITY_EMAIL, LINK_IDENTITY_DISCORD, LINK_IDENTITY_STEAM:
+		return true
+	}
+	return false
+}
+
+func getIdentityLinkKey(identityType string, identifier string) string {
+	return identityType + "." + identifier
+}
+
+func getAuditIdentifier(identityType string, identifier string) string {
+	if identityType == LINK_IDENTITY_STEAM {
+		return STEAM_TOKEN_AUDIT_REDACTED
+	}
+	return identifier
+}
+
+func hashAccountLinkCode(userID string, code string) string {
+	hash := sha256.Sum256([]byte(userID + ":" + code))
+	return hex.EncodeToString(hash[:])
+}
+
+func generateAccountLinkCode() (string, error) {
+	max := new(big.Int).Exp(big.NewInt(10), big.NewInt(ACCOUNT_LINK_CODE_DIGITS), nil)
+	n, err := rand.Int(rand.Reader, max)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%0*d", ACCOUNT_LINK_CODE_DIGITS, n.Int64()), nil
+}
+
+func readPendingAccountLink(ctx context.Context, nk runtime.NakamaModule, userID string) (*PendingAccountLink, error) {
+	var pending *PendingAccountLink
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: ACCOUNT_LINK_PENDING_COLLECTION,
+		Key:        ACCOUNT_LINK_PENDING_KEY,
+		UserID:     userID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &pending); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	pending.Version = storageObjects[0].Version
+	return pending, nil
+}
+
+func writePendingAccountLink(ctx context.Context, nk runtime.NakamaModule, pending *PendingAccountLink) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      ACCOUNT_LINK_PENDING_COLLECTION,
+			Key:             ACCOUNT_LINK_PENDING_KEY,
+			Value:           string(Marshal(pending)),
+			UserID:          pending.UserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+			Version:         pending.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for pending account link of user %v", pending.UserID)
+	}
+	pending.Version = acks[0].Version
+	return nil
+}
+
+func deletePendingAccountLink(ctx context.Context, nk runtime.NakamaModule, userID string) error {
+	return nk.StorageDelete(ctx, []*runtime.StorageDelete{&runtime.StorageDelete{
+		Collection: ACCOUNT_LINK_PENDING_COLLECTION,
+		Key:        ACCOUNT_LINK_PENDING_KEY,
+		UserID:     userID,
+	}})
+}
+
+// readIdentityLink returns the user the identity is linked to, nil when it is not linked
+func readIdentityLink(ctx context.Context, nk runtime.NakamaModule, identityType string, identifier string) (*LinkedIdentity, error) {
+	var linkedIdentity *LinkedIdentity
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: IDENTITY_LINK_COLLECTION,
+		Key:        getIdentityLinkKey(identityType, identifier),
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &linkedIdentity); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return linkedIdentity, nil
+}
+
+// writeIdentityLink claims the identity for the user, the create-only write fails when another user claimed it first
+func writeIdentityLink(ctx context.Context, nk runtime.NakamaModule, linkedIdentity *LinkedIdentity) error {
+	value := string(Marshal(linkedIdentity))
+	key := getIdentityLinkKey(linkedIdentity.Type, linkedIdentity.Identifier)
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      IDENTITY_LINK_COLLECTION,
+			Key:             key,
+			Value:           value,
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+			Version:         "*",
+		},
+	}); err != nil {
+		return err
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      ACCOUNT_LINK_COLLECTION,
+			Key:             key,
+			Value:           value,
+			UserID:          linkedIdentity.UserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_OWNER_READ,
+		},
+	}); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func deleteIdentityLink(ctx context.Context, nk runtime.NakamaModule, linkedIdentity *LinkedIdentity) error {
+	key := getIdentityLinkKey(linkedIdentity.Type, linkedIdentity.Identifier)
+	return nk.StorageDelete(ctx, []*runtime.StorageDelete{
+		&runtime.StorageDelete{
+			Collection: IDENTITY_LINK_COLLECTION,
+			Key:        key,
+			UserID:     nakamaContext.NakamaSystemUserID,
+		},
+		&runtime.StorageDelete{
+			Collection: ACCOUNT_LINK_COLLECTION,
+			Key:        key,
+			UserID:     linkedIdentity.UserID,
+		},
+	})
+}
+
+func listLinkedIdentities(ctx context.Context, nk runtime.NakamaModule, userID string) ([]*LinkedIdentity, error) {
+	storageObjects, _, err := nk.StorageList(ctx, userID, ACCOUNT_LINK_COLLECTION, ACCOUNT_LINK_LIST_LIMIT, "")
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	linkedIdentities := []*LinkedIdentity{}
+	for _, object := range storageObjects {
+		var linkedIdentity *LinkedIdentity
+		if err := json.Unmarshal([]byte(object.Value), &linkedIdentity); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		linkedIdentities = append(linkedIdentities, linkedIdentity)
+	}
+	return linkedIdentities, nil
+}
+
+func writeAccountLinkAudit(ctx context.Context, nk runtime.NakamaModule, audit *AccountLinkAudit) {
+	audit.Identifier = getAuditIdentifier(audit.Type, audit.Identifier)
+	audit.DateTime = time.Now().UTC()
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      ACCOUNT_LINK_AUDIT_COLLECTION,
+			Key:             fmt.Sprintf("%v.%v", audit.DateTime.UnixNano(), uuid.Must(uuid.NewV4()).String()),
+			Value:           string(Marshal(audit)),
+			UserID:          audit.UserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_OWNER_READ,
+		},
+	}); err != nil {
+		log.Errorf("failed to write account link audit of user %v: %v", audit.UserID, err)
+	}
+}
+
+func listAccountLinkAudit(ctx context.Context, nk runtime.NakamaModule, userID string) ([]*AccountLinkAudit, error) {
+	storageObjects, _, err := nk.StorageList(ctx, userID, ACCOUNT_LINK_AUDIT_COLLECTION, ACCOUNT_LINK_AUDIT_LIMIT, "")
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	auditTrail := []*AccountLinkAudit{}
+	for _, object := range storageObjects {
+		var audit *AccountLinkAudit
+		if err := json.Unmarshal([]byte(object.Value), &audit); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		auditTrail = append(auditTrail, audit)
+	}
+	return auditTrail, nil
+}
+
+// resolveLinkedDiscordID returns the primary Discord ID of the user a secondary Discord account is linked to
+func resolveLinkedDiscordID(ctx context.Context, nk runtime.NakamaModule, discordID string) (string, error) {
+	linkedIdentity, err := readIdentityLink(ctx, nk, LINK_IDENTITY_DISCORD, discordID)
+	if err != nil {
+		return "", err
+	}
+	if linkedIdentity == nil {
+		return discordID, nil
+	}
+	account, err := nk.AccountGetId(ctx, linkedIdentity.UserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return account.CustomId, nil
+}
+
+// checkIdentityConflict returns an already exists error when the identity is linked to another user
+func checkIdentityConflict(ctx context.Context, db *sql.DB, nk runtime.NakamaModule, userID string, identityType string, identifier string) error {
+	conflictUserID := ""
+	switch identityType {
+	case LINK_IDENTITY_EMAIL:
+		account, err := repository.NewAccountRepository(db).GetByEmail(ctx, identifier)
+		if err != nil && err != repository.ErrAccountNotFound {
+			log.Error(err)
+			return err
+		}
+		if account != nil {
+			conflictUserID = account.User.Id
+		}
+	case LINK_IDENTITY_DISCORD:
+		account, err := repository.NewAccountRepository(db).GetByCustomID(ctx, identifier)
+		if err != nil && err != repository.ErrAccountNotFound {
+			log.Error(err)
+			return err
+		}
+		if account != nil {
+			conflictUserID = account.User.Id
+		}
+		linkedIdentity, err := readIdentityLink(ctx, nk, identityType, identifier)
+		if err != nil {
+			return err
+		}
+		if linkedIdentity != nil {
+			conflictUserID = linkedIdentity.UserID
+		}
+	}
+	if conflictUserID != "" && conflictUserID != userID {
+		return runtime.NewError(fmt.Sprintf("The %v is already linked to another account", identityType), 6)
+	}
+	return nil
+}
+
+// isIdentityInUse reports whether Nakama rejected a link because the identity belongs to another user
+func isIdentityInUse(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "already in use")
+}
+
+// applyAccountLink links or unlinks the identity of the confirmed pending link
+func applyAccountLink(ctx context.Context, nk runtime.NakamaModule, pending *PendingAccountLink) error {
+	switch pending.Action + "." + pending.Type {
+	case LINK_ACTION_LINK + "." + LINK_IDENTITY_EMAIL:
+		return nk.LinkEmail(ctx, pending.UserID, pending.Identifier, uuid.Must(uuid.NewV4()).String())
+	case LINK_ACTION_UNLINK + "." + LINK_IDENTITY_EMAIL:
+		return nk.UnlinkEmail(ctx, pending.UserID, pending.Identifier)
+	case LINK_ACTION_LINK + "." + LINK_IDENTITY_DISCORD:
+		return writeIdentityLink(ctx, nk, &LinkedIdentity{
+			UserID:     pending.UserID,
+			Type:       pending.Type,
+			Identifier: pending.Identifier,
+			DateTime:   time.Now().UTC(),
+		})
+	case LINK_ACTION_UNLINK + "." + LINK_IDENTITY_DISCORD:
+		linkedIdentity, err := readIdentityLink(ctx, nk, pending.Type, pending.Identifier)
+		if err != nil {
+			return err
+		}
+		if linkedIdentity == nil || linkedIdentity.UserID != pending.UserID {
+			return errNotFound("The Discord account %v is not linked", pending.Identifier)
+		}
+		return deleteIdentityLink(ctx, nk, linkedIdentity)
+	}
+	return errInvalidArgument("Unknown account link %v of %v", pending.Action, pending.Type)
+}
+
+// auditAccountLinkResult audits the result of an applied link or unlink, an identity linked to another user
+// is reported as an already exists error
+func auditAccountLinkResult(ctx context.Context, nk runtime.NakamaModule, audit *AccountLinkAudit, err error) error {
+	if err != nil {
+		audit.Result = LINK_AUDIT_REJECTED
+		audit.Reason = err.Error()
+		if isIdentityInUse(err) || isStorageVersionConflict(err) {
+			audit.Result = LINK_AUDIT_CONFLICT
+			err = runtime.NewError(fmt.Sprintf("The %v is already linked to another account", audit.Type), 6)
+		}
+		writeAccountLinkAudit(ctx, nk, audit)
+		log.Error(err)
+		return err
+	}
+
+	audit.Result = LINK_AUDIT_LINKED
+	if audit.Action == LINK_ACTION_UNLINK {
+		audit.Result = LINK_AUDIT_UNLINKED
+	}
+	writeAccountLinkAudit(ctx, nk, audit)
+	log.Infof("user_id: %v %v %v", audit.UserID, audit.Result, audit.Type)
+	return nil
+}
+
+// applySteamLink links or unlinks the Steam account of the session token right away, Nakama verifies the token
+// with Steam so no verification code is needed
+func applySteamLink(ctx context.Context, nk runtime.NakamaModule, audit *AccountLinkAudit, token string) (string, error) {
+	var err error
+	if audit.Action == LINK_ACTION_LINK {
+		err = nk.LinkSteam(ctx, audit.UserID, token)
+	} else {
+		err = nk.UnlinkSteam(ctx, audit.UserID, token)
+	}
+	if err := auditAccountLinkResult(ctx, nk, audit, err); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("The %v was %v", audit.Type, audit.Result), nil
+}
+
+// sendAccountLinkCode sends the code to the identity being linked or unlinked: by email to the email and by Discord DM
+// to the Discord account being linked, a Discord unlink is confirmed by the primary Discord account
+func sendAccountLinkCode(account *api.Account, request *AccountLinkStartRequest, code string) (string, error) {
+	if request.Type == LINK_IDENTITY_EMAIL {
+		if err := sendEmail(request.Identifier, "Account link verification code", fmt.Sprintf(
+			"Your code to %v the email %v to the Discord account %v is %v, it expires in %v.",
+			request.Action, request.Identifier, account.User.Username, code, ACCOUNT_LINK_CODE_TTL)); err != nil {
+			log.Error(err)
+			return "", err
+		}
+		return fmt.Sprintf("A verification code was sent by email to %v", request.Identifier), nil
+	}
+
+	recipientDiscordID := account.CustomId
+	if request.Action == LINK_ACTION_LINK {
+		recipientDiscordID = request.Identifier
+	}
+	if _, err := notifyDiscordDirectMessage(recipientDiscordID, fmt.Sprintf(
+		"Your code to %v the %v %v to the account of <@%v> is **%v**, it expires in %v",
+		request.Action, request.Type, request.Identifier, account.CustomId, code, ACCOUNT_LINK_CODE_TTL)); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return fmt.Sprintf("A verification code was sent by Discord DM to <@%v>", recipientDiscordID), nil
+}
+
+func AccountLinkStartRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *AccountLinkStartRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Account link is required")
+	}
+	if request.Action == "" {
+		request.Action = LINK_ACTION_LINK
+	}
+	if request.Action != LINK_ACTION_LINK && request.Action != LINK_ACTION_UNLINK {
+		return "", errInvalidArgument("Action %q must be %v or %v", request.Action, LINK_ACTION_LINK, LINK_ACTION_UNLINK)
+	}
+	if !isLinkIdentityType(request.Type) {
+		return "", errInvalidArgument("Type %q must be one of %v, %v or %v", request.Type, LINK_IDENTITY_EMAIL, LINK_IDENTITY_DISCORD, LINK_IDENTITY_STEAM)
+	}
+	if request.Type == LINK_IDENTITY_STEAM {
+		if err := validateRequired("SteamToken", request.SteamToken); err != nil {
+			return "", err
+		}
+	} else if err := validateRequired("Identifier", request.Identifier); err != nil {
+		return "", err
+	}
+	if request.Type == LINK_IDENTITY_EMAIL && !isEmailValid(request.Identifier) {
+		return "", errInvalidArgument("%v is not a valid email", request.Identifier)
+	}
+
+	userID, err := getActingUserID(ctx, nk, "AccountLinkStart", "", request.UserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	account, err := nk.AccountGetId(ctx, userID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if request.Type == LINK_IDENTITY_DISCORD && request.Identifier == account.CustomId {
+		return "", errInvalidArgument("The primary Discord account can not be linked or unlinked")
+	}
+	if request.Type == LINK_IDENTITY_EMAIL && request.Action == LINK_ACTION_UNLINK && request.Identifier != account.Email {
+		return "", errNotFound("The email %v is not linked", request.Identifier)
+	}
+
+	audit := &AccountLinkAudit{
+		UserID:      userID,
+		ActorUserID: getCallerUserID(ctx),
+		Action:      request.Action,
+		Type:        request.Type,
+		Identifier:  request.Identifier,
+	}
+	if request.Type == LINK_IDENTITY_STEAM {
+		return applySteamLink(ctx, nk, audit, request.SteamToken)
+	}
+	if request.Action == LINK_ACTION_LINK {
+		if err := checkIdentityConflict(ctx, db, nk, userID, request.Type, request.Identifier); err != nil {
+			audit.Result = LINK_AUDIT_CONFLICT
+			audit.Reason = err.Error()
+			writeAccountLinkAudit(ctx, nk, audit)
+			return "", err
+		}
+	}
+
+	code, err := generateAccountLinkCode()
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	pending, err := readPendingAccountLink(ctx, nk, userID)
+	if err != nil {
+		return "", err
+	}
+	version := ""
+	if pending != nil {
+		version = pending.Version
+	}
+	pending = &PendingAccountLink{
+		UserID:     userID,
+		Action:     request.Action,
+		Type:       request.Type,
+		Identifier: request.Identifier,
+		CodeHash:   hashAccountLinkCode(userID, code),
+		ExpiresAt:  time.Now().UTC().Add(ACCOUNT_LINK_CODE_TTL),
+		Version:    version,
+	}
+	if err := writePendingAccountLink(ctx, nk, pending); err != nil {
+		return "", err
+	}
+
+	msg, err := sendAccountLinkCode(account, request, code)
+	if err != nil {
+		if err := deletePendingAccountLink(ctx, nk, userID); err != nil {
+			log.Error(err)
+		}
+		return "", err
+	}
+
+	audit.Result = LINK_AUDIT_REQUESTED
+	writeAccountLinkAudit(ctx, nk, audit)
+	return msg, nil
+}
+
+func AccountLinkConfirmRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *AccountLinkConfirmRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Code is required")
+	}
+	if err := validateRequired("Code", request.Code); err != nil {
+		return "", err
+	}
+
+	userID, err := getActingUserID(ctx, nk, "AccountLinkConfirm", "", request.UserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	pending, err := readPendingAccountLink(ctx, nk, userID)
+	if err != nil {
+		return "", err
+	}
+	if pending == nil || time.Now().UTC().After(pending.ExpiresAt) {
+		return "", errNotFound("No pending account link found, request a new code")
+	}
+
+	audit := &AccountLinkAudit{
+		UserID:      userID,
+		ActorUserID: getCallerUserID(ctx),
+		Action:      pending.Action,
+		Type:        pending.Type,
+		Identifier:  pending.Identifier,
+	}
+	if hashAccountLinkCode(userID, request.Code) != pending.CodeHash {
+		pending.Attempts++
+		if pending.Attempts >= ACCOUNT_LINK_MAX_ATTEMPTS {
+			if err := deletePendingAccountLink(ctx, nk, userID); err != nil {
+				log.Error(err)
+			}
+			audit.Result = LINK_AUDIT_REJECTED
+			audit.Reason = "too many invalid codes"
+			writeAccountLinkAudit(ctx, nk, audit)
+			return "", errPermissionDenied("Too many invalid codes, request a new code")
+		}
+		if err := writePendingAccountLink(ctx, nk, pending); err != nil {
+			return "", err
+		}
+		return "", errPermissionDenied("Invalid code, %v attempts left", ACCOUNT_LINK_MAX_ATTEMPTS-pending.Attempts)
+	}
+	if err := deletePendingAccountLink(ctx, nk, userID); err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	if err := auditAccountLinkResult(ctx, nk, audit, applyAccountLink(ctx, nk, pending)); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("The %v was %v", pending.Type, audit.Result), nil
+}
+
+func AccountLinksGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *AccountLinksGetRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		request = &AccountLinksGetRequest{}
+	}
+
+	userID, err := getActingUserID(ctx, nk, "AccountLinksGet", "", request.UserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	account, err := nk.AccountGetId(ctx, userID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	linkedIdentities, err := listLinkedIdentities(ctx, nk, userID)
+	if err != nil {
+		return "", err
+	}
+	auditTrail, err := listAccountLinkAudit(ctx, nk, userID)
+	if err != nil {
+		return "", err
+	}
+	return MarshalIndent(&AccountLinks{
+		UserID:     userID,
+		DiscordID:  account.CustomId,
+		Email:      account.Email,
+		SteamID:    account.User.SteamId,
+		Discord:    linkedIdentities,
+		AuditTrail: auditTrail,
+	}), nil
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/gofrs/uuid"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	LEADERBOARD_SORT_ORDER_ASC  = "asc"
+	LEADERBOARD_SORT_ORDER_DESC = "desc"
+
+	LEADERBOARD_OPERATOR_BEST = "best"
+	LEADERBOARD_OPERATOR_SET  = "set"
+	LEADERBOARD_OPERATOR_INCR = "incr"
+	LEADERBOARD_OPERATOR_DECR = "decr"
+
+	TOURNAMENT_CATEGORY_MAX = 127
+)
+
+type TournamentDeleteRequest struct {
+	ID string
+}
+
+type LeaderboardCreateRequest struct {
+	ID            string
+	Authoritative bool
+	SortOrder     string
+	Operator      string
+	ResetSchedule string
+	Metadata      map[string]interface{}
+}
+
+type LeaderboardDeleteRequest struct {
+	ID string
+}
+
+type LeaderboardRecordWriteRequest struct {
+	ID       string
+	OwnerID  string
+	Username string
+	Score    int64
+	Subscore int64
+	Metadata map[string]interface{}
+}
+
+type LeaderboardRecordDeleteRequest struct {
+	ID      string
+	OwnerID string
+}
+
+type LeaderboardRecordListRequest struct {
+	ID       string
+	OwnerIDs []string
+	Limit    int
+	Cursor   string
+	Expiry   int64
+}
+
+type AccountUpdateIDRequest struct {
+	ID          string
+	Username    string
+	Metadata    map[string]interface{}
+	DisplayName string
+	Timezone    string
+	Location    string
+	LangTag     string
+	AvatarUrl   string
+}
+
+func errInvalidArgument(format string, args ...interface{}) error {
+	return runtime.NewError(fmt.Sprintf(format, args...), 3)
+}
+
+func errNotFound(format string, args ...interface{}) error {
+	return runtime.NewError(fmt.Sprintf(format, args...), 5)
+}
+
+func errPermissionDenied(format string, args ...interface{}) error {
+	return runtime.NewError(fmt.Sprintf(format, args...), 7)
+}
+
+// decodeRequest unmarshals the RPC payload into the typed request, a malformed payload is an invalid argument
+func decodeRequest(payload string, request interface{}) error {
+	if err := json.Unmarshal([]byte(payload), request); err != nil {
+		log.Error(err)
+		return errInvalidArgument("Invalid request payload: %v", err.Error())
+	}
+	return nil
+}
+
+// getCallerUserID returns the user of the session which called the RPC, empty for server to server calls
+func getCallerUserID(ctx context.Context) string {
+	userID, _ := ctx.Value(runtime.RUNTIME_CTX_USER_ID).(string)
+	return userID
+}
+
+// checkCallerOwns denies a session user to act on behalf of another user, the system and admins are not restricted
+func checkCallerOwns(ctx context.Context, userID string) error {
+	if hasRole(getCallerRole(ctx), ROLE_ADMIN) {
+		return nil
+	}
+	if callerID := getCallerUserID(ctx); callerID != userID {
+		return errPermissionDenied("User %v is not allowed to act on behalf of user %v", callerID, userID)
+	}
+	return nil
+}
+
+func validateRequired(name string, value string) error {
+	if value == "" {
+		return errInvalidArgument("%v is required", name)
+	}
+	return nil
+}
+
+func validateUserID(name string, value string) error {
+	if err := validateRequired(name, value); err != nil {
+		return err
+	}
+	if _, err := uuid.FromString(value); err != nil {
+		return errInvalidArgument("%v %q is not a valid user ID", name, value)
+	}
+	return nil
+}
+
+func validateSortOrder(sortOrder string) error {
+	switch sortOrder {
+	case LEADERBOARD_SORT_ORDER_ASC, LEADERBOARD_SORT_ORDER_DESC:
+		return nil
+	}
+	return errInvalidArgument("SortOrder %q must be %v or %v", sortOrder, LEADERBOARD_SORT_ORDER_ASC, LEADERBOARD_SORT_ORDER_DESC)
+}
+
+func validateOperator(operator string) error {
+	switch operator {
+	case LEADERBOARD_OPERATOR_BEST, LEADERBOARD_OPERATOR_SET, LEADERBOARD_OPERATOR_INCR, LEADERBOARD_OPERATOR_DECR:
+		return nil
+	}
+	return errInvalidArgument("Operator %q must be one of %v, %v, %v or %v", operator,
+		LEADERBOARD_OPERATOR_BEST, LEADERBOARD_OPERATOR_SET, LEADERBOARD_OPERATOR_INCR, LEADERBOARD_OPERATOR_DECR)
+}
+
+func validateTournamentCreateRequest(request *nakamaCommands.TournamentCreateRequest) error {
+	if request == nil {
+		return errInvalidArgument("Tournament is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return err
+	}
+	if err := validateSortOrder(request.SortOrder); err != nil {
+		return err
+	}
+	if err := validateOperator(request.Operator); err != nil {
+		return err
+	}
+	if request.Category < 0 || request.Category > TOURNAMENT_CATEGORY_MAX {
+		return errInvalidArgument("Category %v must be between 0 and %v", request.Category, TOURNAMENT_CATEGORY_MAX)
+	}
+	if request.StartTime < 0 || request.EndTime < 0 {
+		return errInvalidArgument("StartTime and EndTime must not be negative")
+	}
+	if request.EndTime != 0 && request.EndTime < request.StartTime {
+		return errInvalidArgument("EndTime %v must not be before StartTime %v", request.EndTime, request.StartTime)
+	}
+	if request.Duration <= 0 {
+		return errInvalidArgument("Duration must be positive")
+	}
+	if request.MaxSize < 0 || request.MaxNumScore < 0 {
+		return errInvalidArgument("MaxSize and MaxNumScore must not be negative")
+	}
+	return nil
+}
+
+func validateLeaderboardCreateRequest(request *LeaderboardCreateRequest) error {
+	if request == nil {
+		return errInvalidArgument("Leaderboard is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return err
+	}
+	if err := validateSortOrder(request.SortOrder); err != nil {
+		return err
+	}
+	return validateOperator(request.Operator)
+}
+
+func validateLeaderboardRecordWriteRequest(request *LeaderboardRecordWriteRequest) error {
+	if request == nil {
+		return errInvalidArgument("Leaderboard record is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return err
+	}
+	if err := validateUserID("OwnerID", request.OwnerID); err != nil {
+		return err
+	}
+	if request.Score < 0 || request.Subscore < 0 {
+		return errInvalidArgument("Score and Subscore must not be negative")
+	}
+	return nil
+}
+
+func validateAccountUpdateIDRequest(request *AccountUpdateIDRequest) error {
+	if request == nil {
+		return errInvalidArgument("Account is required")
+	}
+	return validateUserID("ID", request.ID)
+}
+
+// checkUserExists returns a not found error when the user does not exist
+func checkUserExists(ctx context.Context, nk runtime.NakamaModule, userID string) error {
+	users, err := nk.UsersGetId(ctx, []string{userID})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(users) == 0 {
+		return errNotFound("User %v not found", userID)
+	}
+	return nil
+}
+
+// checkTournamentExists returns a not found error when the tournament does not exist
+func checkTournamentExists(ctx context.Context, nk runtime.NakamaModule, tournamentID string) error {
+	tournaments, err := nk.TournamentsGetId(ctx, []string{tournamentID})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(tournaments) == 0 {
+		return errNotFound("Tournament %v not found", tournamentID)
+	}
+	return nil
+}
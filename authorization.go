@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	ROLE_COLLECTION = "role"
+
+	// NAKAMA_ADMINISTRATOR_CUSTOM_ID is the custom ID the Discord bot authenticates with, it grants no role by itself,
+	// the bot acts as the system through server to server calls or a ROLE_SYSTEM entry in the ROLE_COLLECTION
+	NAKAMA_ADMINISTRATOR_CUSTOM_ID = "administrator"
+
+	ROLE_SYSTEM    = "system"
+	ROLE_ADMIN     = "admin"
+	ROLE_MODERATOR = "moderator"
+	ROLE_PLAYER    = "player"
+)
+
+// ROLE_LEVELS orders the roles, a role is granted everything the roles with a lower level are granted
+var ROLE_LEVELS = map[string]int{
+	ROLE_PLAYER:    0,
+	ROLE_MODERATOR: 1,
+	ROLE_ADMIN:     2,
+	ROLE_SYSTEM:    3,
+}
+
+// RPC_ROLES is the minimum role required to call each RPC, unclassified RPCs are system-only
+var RPC_ROLES = map[string]string{
+	"StorageWrite":           ROLE_SYSTEM,
+	"TournamentCreate":       ROLE_SYSTEM,
+	"TournamentDelete":       ROLE_SYSTEM,
+	"LeaderboardCreate":      ROLE_SYSTEM,
+	"LeaderboardDelete":      ROLE_SYSTEM,
+	"LeaderboardRecordWrite": ROLE_SYSTEM,
+	"AccountUpdateID":        ROLE_SYSTEM,
+	"MatchCreate":            ROLE_SYSTEM,
+	"LastUserDataCreate":     ROLE_SYSTEM,
+	"TicketStateCreate":      ROLE_SYSTEM,
+
+	"PayoutReconcile":     ROLE_ADMIN,
+	"SeasonCreate":        ROLE_ADMIN,
+	"SeasonEnd":           ROLE_ADMIN,
+	"BracketCreate":       ROLE_ADMIN,
+	"BracketStart":        ROLE_ADMIN,
+	"RoleSet":             ROLE_ADMIN,
+	"ConfigGet":           ROLE_ADMIN,
+	"MatchProfileCreate":  ROLE_ADMIN,
+	"MatchProfileUpdate":  ROLE_ADMIN,
+	"MatchProfileDisable": ROLE_ADMIN,
+
+	"MatchDisputeResolve": ROLE_MODERATOR,
+
+	"MatchReady":                              ROLE_PLAYER,
+	"MatchCancel":                             ROLE_PLAYER,
+	"MatchResult":                             ROLE_PLAYER,
+	"MatchStateGet":                           ROLE_PLAYER,
+	"MatchStateListGet":                       ROLE_PLAYER,
+	"MatchLifecycleGet":                       ROLE_PLAYER,
+	"MatchRandomGet":                          ROLE_PLAYER,
+	"MatchProfileGet":                         ROLE_PLAYER,
+	"MatchProfileList":                        ROLE_PLAYER,
+	"SeasonList":                              ROLE_PLAYER,
+	"SeasonPlacementsGet":                     ROLE_PLAYER,
+	"BracketRegister":                         ROLE_PLAYER,
+	"BracketGet":                              ROLE_PLAYER,
+	"AccountByUsernameGet":                    ROLE_PLAYER,
+	"AccountByCustomIDGet":                    ROLE_PLAYER,
+	"AccountLinkStart":                        ROLE_PLAYER,
+	"AccountLinkConfirm":                      ROLE_PLAYER,
+	"AccountLinksGet":                         ROLE_PLAYER,
+	"PoolJoin":                                ROLE_PLAYER,
+	"PoolPick":                                ROLE_PLAYER,
+	"SubmitCreate":                            ROLE_PLAYER,
+	"OpenMatchFrontendTicketCreate":           ROLE_PLAYER,
+	"OpenMatchFrontendTicketGet":              ROLE_PLAYER,
+	"OpenMatchFrontendTicketDelete":           ROLE_PLAYER,
+	"OpenMatchFrontendTicketWatchAssignments": ROLE_PLAYER,
+}
+
+type callerRoleKey struct{}
+
+type rpcFunction func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error)
+
+// UserRole is stored in the ROLE_COLLECTION of the system user with the user ID as the key.
+// Roles are not read from the account metadata because it is copied from the Discord message vars on login.
+type UserRole struct {
+	UserID    string
+	Role      string
+	GrantedBy string
+}
+
+type RoleSetRequest struct {
+	UserID string
+	Role   string
+}
+
+func isRole(role string) bool {
+	_, ok := ROLE_LEVELS[role]
+	return ok
+}
+
+func hasRole(role string, required string) bool {
+	return ROLE_LEVELS[role] >= ROLE_LEVELS[required]
+}
+
+func readUserRole(ctx context.Context, nk runtime.NakamaModule, userID string) (*UserRole, error) {
+	var userRole *UserRole
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: ROLE_COLLECTION,
+		Key:        userID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &userRole); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return userRole, nil
+}
+
+func writeUserRole(ctx context.Context, nk runtime.NakamaModule, userRole *UserRole) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      ROLE_COLLECTION,
+			Key:             userRole.UserID,
+			Value:           string(Marshal(userRole)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for role of user %v", userRole.UserID)
+	}
+	return nil
+}
+
+// resolveCallerRole derives the role of the RPC caller: server to server calls and the system user are the system,
+// session users get their stored role or ROLE_PLAYER
+func resolveCallerRole(ctx context.Context, nk runtime.NakamaModule) (string, error) {
+	userID := getCallerUserID(ctx)
+	if userID == "" || userID == nakamaContext.NakamaSystemUserID {
+		return ROLE_SYSTEM, nil
+	}
+	sessionContext, err := unpackContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	return getUserRole(ctx, nk, sessionContext.UserID)
+}
+
+// getUserRole returns the stored role of the user, ROLE_PLAYER when none is stored
+func getUserRole(ctx context.Context, nk runtime.NakamaModule, userID string) (string, error) {
+	userRole, err := readUserRole(ctx, nk, userID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if userRole != nil && isRole(userRole.Role) {
+		return userRole.Role, nil
+	}
+	return ROLE_PLAYER, nil
+}
+
+// getCallerRole returns the role resolved by authorizeRPC, ROLE_SYSTEM for calls which did not go through it
+func getCallerRole(ctx context.Context) string {
+	if role, ok := ctx.Value(callerRoleKey{}).(string); ok {
+		return role
+	}
+	if getCallerUserID(ctx) == "" {
+		return ROLE_SYSTEM
+	}
+	return ROLE_PLAYER
+}
+
+// authorizeRPC wraps the RPC registered with the id so that callers without the role required by RPC_ROLES are rejected
+func authorizeRPC(id string, fn rpcFunction) rpcFunction {
+	required, ok := RPC_ROLES[id]
+	if !ok {
+		log.Warnf("RPC %v is not classified, it is restricted to the system", id)
+		required = ROLE_SYSTEM
+	}
+	return func(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+		role, err := resolveCallerRole(ctx, nk)
+		if err != nil {
+			log.Error(err)
+			return "", err
+		}
+		if !hasRole(role, required) {
+			log.Warnf("user_id: %v with role %v denied to call %v", getCallerUserID(ctx), role, id)
+			return "", errPermissionDenied("The %v role is required to call %v", required, id)
+		}
+		return fn(context.WithValue(ctx, callerRoleKey{}, role), logger, db, nk, payload)
+	}
+}
+
+func RoleSetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *RoleSetRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Role is required")
+	}
+	if err := validateUserID("UserID", request.UserID); err != nil {
+		return "", err
+	}
+	if !isRole(request.Role) || request.Role == ROLE_SYSTEM {
+		return "", errInvalidArgument("Role %q must be one of %v, %v or %v", request.Role, ROLE_ADMIN, ROLE_MODERATOR, ROLE_PLAYER)
+	}
+	if err := checkUserExists(ctx, nk, request.UserID); err != nil {
+		return "", err
+	}
+
+	userRole := &UserRole{
+		UserID:    request.UserID,
+		Role:      request.Role,
+		GrantedBy: getCallerUserID(ctx),
+	}
+	if err := writeUserRole(ctx, nk, userRole); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	log.Infof("user_id: %v was granted the %v role by %v", userRole.UserID, userRole.Role, userRole.GrantedBy)
+	return MarshalIndent(userRole), nil
+}
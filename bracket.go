@@ -0,0 +1,1006 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/gofrs/uuid"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	BRACKET_COLLECTION       = "bracket"
+	BRACKET_MATCH_COLLECTION = "bracket_match"
+	BRACKET_WRITE_RETRIES    = 5
+
+	BRACKET_FORMAT_SINGLE_ELIMINATION = "single-elimination"
+	BRACKET_FORMAT_DOUBLE_ELIMINATION = "double-elimination"
+	BRACKET_FORMAT_SWISS              = "swiss"
+	BRACKET_FORMAT_ROUND_ROBIN        = "round-robin"
+
+	BRACKET_STATUS_REGISTRATION = "registration"
+	BRACKET_STATUS_IN_PROGRESS  = "in-progress"
+	BRACKET_STATUS_COMPLETED    = "completed"
+
+	BRACKET_MATCH_STATUS_PENDING     = "pending"
+	BRACKET_MATCH_STATUS_IN_PROGRESS = "in-progress"
+	BRACKET_MATCH_STATUS_COMPLETED   = "completed"
+
+	BRACKET_POINTS_WIN  = 1.0
+	BRACKET_POINTS_DRAW = 0.5
+)
+
+// errBracketUnchanged can be returned by a BracketMutation to skip the write without failing the update
+var errBracketUnchanged = errors.New("bracket unchanged")
+
+type BracketParticipant struct {
+	UserID     string
+	TeamUser   *nakamaCommands.TeamUser
+	Seed       int
+	Position   int
+	Wins       int
+	Losses     int
+	Draws      int
+	Byes       int
+	Points     float64
+	Opponents  []string
+	Eliminated bool
+}
+
+type BracketMatch struct {
+	MatchID      string
+	Round        int
+	Slot         int
+	UserIDs      []string
+	WinnerUserID string
+	Draw         bool
+	Forfeit      bool
+	Status       string
+}
+
+type Bracket struct {
+	ID                 string
+	Name               string
+	Format             string
+	MatchProfile       string
+	MatchType          string
+	Rounds             int
+	MatchDurationHours int
+	MaxParticipants    int
+	DiscordChannelID   string
+	Status             string
+	CurrentRound       int
+	Participants       []*BracketParticipant
+	Matches            []*BracketMatch
+	ChampionUserID     string
+	DateTimeCreate     time.Time
+	Version            string
+}
+
+// BracketMatchRef maps a match ID to the bracket it was spawned for
+type BracketMatchRef struct {
+	MatchID   string
+	BracketID string
+}
+
+type BracketMutation func(bracket *Bracket) error
+
+type BracketCreateRequest struct {
+	ID                 string
+	Name               string
+	Format             string
+	MatchProfile       string
+	MatchType          string
+	Rounds             int
+	MatchDurationHours int
+	MaxParticipants    int
+	DiscordChannelID   string
+}
+
+// BracketRegisterRequest registers the session user, only the system may register another user by UserID.
+// TeamUser is optional and only its Discord routing is kept when the system registers a user.
+type BracketRegisterRequest struct {
+	BracketID string
+	UserID    string
+	TeamUser  *nakamaCommands.TeamUser
+}
+
+type BracketRequest struct {
+	BracketID string
+}
+
+var bracketFormats = []string{
+	BRACKET_FORMAT_SINGLE_ELIMINATION,
+	BRACKET_FORMAT_DOUBLE_ELIMINATION,
+	BRACKET_FORMAT_SWISS,
+	BRACKET_FORMAT_ROUND_ROBIN,
+}
+
+func init() {
+	registerMatchTransitionHook(MATCH_PHASE_CANCELED, func(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, transition *MatchTransition) error {
+		return forfeitBracketMatch(ctx, nk, matchState)
+	})
+}
+
+func readBracket(ctx context.Context, nk runtime.NakamaModule, bracketID string) (*Bracket, error) {
+	var bracket *Bracket
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: BRACKET_COLLECTION,
+		Key:        bracketID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &bracket); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	bracket.Version = storageObjects[0].Version
+	return bracket, nil
+}
+
+func writeBracket(ctx context.Context, nk runtime.NakamaModule, bracket *Bracket) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      BRACKET_COLLECTION,
+			Key:             bracket.ID,
+			Value:           string(Marshal(bracket)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         bracket.Version,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for bracket %v", bracket.ID)
+	}
+	bracket.Version = acks[0].Version
+	return nil
+}
+
+// updateBracket reads the bracket, applies the mutation and writes it back, retrying on concurrent writes
+func updateBracket(ctx context.Context, nk runtime.NakamaModule, bracketID string, mutate BracketMutation) (*Bracket, error) {
+	var err error
+	for i := 0; i < BRACKET_WRITE_RETRIES; i++ {
+		var bracket *Bracket
+		bracket, err = readBracket(ctx, nk, bracketID)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if bracket == nil {
+			return nil, runtime.NewError(fmt.Sprintf("No bracket found with ID: %v", bracketID), 5)
+		}
+		if err = mutate(bracket); err != nil {
+			if err == errBracketUnchanged {
+				return bracket, nil
+			}
+			return nil, err
+		}
+		if err = writeBracket(ctx, nk, bracket); err == nil {
+			return bracket, nil
+		}
+		if !isStorageVersionConflict(err) {
+			log.Error(err)
+			return nil, err
+		}
+		log.Infof("Bracket %v version conflict, retry %v", bracketID, i+1)
+	}
+	log.Errorf("Bracket %v update failed after %v retries: %v", bracketID, BRACKET_WRITE_RETRIES, err)
+	return nil, err
+}
+
+func readBracketMatchRef(ctx context.Context, nk runtime.NakamaModule, matchID string) (*BracketMatchRef, error) {
+	var ref *BracketMatchRef
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: BRACKET_MATCH_COLLECTION,
+		Key:        matchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &ref); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return ref, nil
+}
+
+func writeBracketMatchRef(ctx context.Context, nk runtime.NakamaModule, ref *BracketMatchRef) error {
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      BRACKET_MATCH_COLLECTION,
+			Key:             ref.MatchID,
+			Value:           string(Marshal(ref)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+		},
+	}); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func getBracketParticipant(bracket *Bracket, userID string) *BracketParticipant {
+	for _, participant := range bracket.Participants {
+		if participant.UserID == userID {
+			return participant
+		}
+	}
+	return nil
+}
+
+func getBracketMatch(bracket *Bracket, matchID string) *BracketMatch {
+	for _, match := range bracket.Matches {
+		if match.MatchID == matchID {
+			return match
+		}
+	}
+	return nil
+}
+
+func getBracketMaxLosses(bracket *Bracket) int {
+	switch bracket.Format {
+	case BRACKET_FORMAT_SINGLE_ELIMINATION:
+		return 1
+	case BRACKET_FORMAT_DOUBLE_ELIMINATION:
+		return 2
+	}
+	return 0
+}
+
+func isBracketElimination(bracket *Bracket) bool {
+	return getBracketMaxLosses(bracket) > 0
+}
+
+func getAliveBracketParticipants(bracket *Bracket) []*BracketParticipant {
+	var participants []*BracketParticipant
+	for _, participant := range bracket.Participants {
+		if !participant.Eliminated {
+			participants = append(participants, participant)
+		}
+	}
+	return participants
+}
+
+// getBracketStandings orders the participants by points, wins and seed
+func getBracketStandings(bracket *Bracket) []*BracketParticipant {
+	standings := make([]*BracketParticipant, len(bracket.Participants))
+	copy(standings, bracket.Participants)
+	sort.SliceStable(standings, func(i, j int) bool {
+		if standings[i].Eliminated != standings[j].Eliminated {
+			return !standings[i].Eliminated
+		}
+		if standings[i].Points != standings[j].Points {
+			return standings[i].Points > standings[j].Points
+		}
+		if standings[i].Wins != standings[j].Wins {
+			return standings[i].Wins > standings[j].Wins
+		}
+		return standings[i].Seed < standings[j].Seed
+	})
+	return standings
+}
+
+// getBracketSeedingOrder returns the seeds of the first round positions so the top seeds meet as late as possible
+func getBracketSeedingOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		var next []int
+		for _, seed := range order {
+			next = append(next, seed, 2*len(order)+1-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// applyBracketMatchResult updates the participants of a completed bracket match, an empty winner without draw is a double forfeit
+func applyBracketMatchResult(bracket *Bracket, match *BracketMatch) {
+	match.Status = BRACKET_MATCH_STATUS_COMPLETED
+	maxLosses := getBracketMaxLosses(bracket)
+	for _, userID := range match.UserIDs {
+		participant := getBracketParticipant(bracket, userID)
+		if participant == nil {
+			continue
+		}
+		participant.Position = match.Slot
+		for _, opponentID := range match.UserIDs {
+			if opponentID != userID {
+				participant.Opponents = append(participant.Opponents, opponentID)
+			}
+		}
+		switch {
+		case len(match.UserIDs) == 1:
+			participant.Byes++
+			participant.Points += BRACKET_POINTS_WIN
+		case match.Draw:
+			participant.Draws++
+			participant.Points += BRACKET_POINTS_DRAW
+		case match.WinnerUserID == userID:
+			participant.Wins++
+			participant.Points += BRACKET_POINTS_WIN
+		default:
+			participant.Losses++
+		}
+		if maxLosses > 0 && participant.Losses >= maxLosses {
+			participant.Eliminated = true
+		}
+	}
+}
+
+func newBracketMatch(bracket *Bracket, slot int, userIDs []string) *BracketMatch {
+	match := &BracketMatch{
+		Round:   bracket.CurrentRound,
+		Slot:    slot,
+		UserIDs: userIDs,
+		Status:  BRACKET_MATCH_STATUS_PENDING,
+	}
+	if len(userIDs) == 1 {
+		match.WinnerUserID = userIDs[0]
+		applyBracketMatchResult(bracket, match)
+		return match
+	}
+	match.MatchID = uuid.Must(uuid.NewV4()).String()
+	return match
+}
+
+func pairBracketParticipants(participants []*BracketParticipant) [][]string {
+	var pairs [][]string
+	for i := 0; i < len(participants); i += 2 {
+		if i+1 < len(participants) {
+			pairs = append(pairs, []string{participants[i].UserID, participants[i+1].UserID})
+		} else {
+			pairs = append(pairs, []string{participants[i].UserID})
+		}
+	}
+	return pairs
+}
+
+func getEliminationPairs(bracket *Bracket) [][]string {
+	if bracket.CurrentRound == 1 {
+		size := 1
+		for size < len(bracket.Participants) {
+			size *= 2
+		}
+		seeds := make(map[int]string)
+		for _, participant := range bracket.Participants {
+			seeds[participant.Seed] = participant.UserID
+		}
+		order := getBracketSeedingOrder(size)
+		var pairs [][]string
+		for i := 0; i < len(order); i += 2 {
+			var pair []string
+			for _, seed := range order[i : i+2] {
+				if userID, ok := seeds[seed]; ok {
+					pair = append(pair, userID)
+				}
+			}
+			pairs = append(pairs, pair)
+		}
+		return pairs
+	}
+
+	alive := getAliveBracketParticipants(bracket)
+	sort.SliceStable(alive, func(i, j int) bool {
+		if alive[i].Position != alive[j].Position {
+			return alive[i].Position < alive[j].Position
+		}
+		return alive[i].Seed < alive[j].Seed
+	})
+	groups := make(map[int][]*BracketParticipant)
+	for _, participant := range alive {
+		groups[participant.Losses] = append(groups[participant.Losses], participant)
+	}
+	// The last participants of each loss group meet in the final
+	final := true
+	for _, group := range groups {
+		if len(group) > 1 {
+			final = false
+		}
+	}
+	if final {
+		sort.SliceStable(alive, func(i, j int) bool {
+			return alive[i].Losses < alive[j].Losses
+		})
+		return pairBracketParticipants(alive)
+	}
+
+	var pairs [][]string
+	for losses := 0; losses < getBracketMaxLosses(bracket); losses++ {
+		if len(groups[losses]) > 1 {
+			pairs = append(pairs, pairBracketParticipants(groups[losses])...)
+		}
+	}
+	return pairs
+}
+
+func getSwissPairs(bracket *Bracket) [][]string {
+	standings := getBracketStandings(bracket)
+	var pairs [][]string
+	if len(standings)%2 == 1 {
+		bye := len(standings) - 1
+		for i := len(standings) - 1; i >= 0; i-- {
+			if standings[i].Byes == 0 {
+				bye = i
+				break
+			}
+		}
+		pairs = append(pairs, []string{standings[bye].UserID})
+		standings = append(standings[:bye], standings[bye+1:]...)
+	}
+
+	paired := make(map[string]bool)
+	for i, participant := range standings {
+		if paired[participant.UserID] {
+			continue
+		}
+		opponent := -1
+		for j := i + 1; j < len(standings); j++ {
+			if paired[standings[j].UserID] {
+				continue
+			}
+			if opponent == -1 {
+				opponent = j
+			}
+			if !nakamaCommands.IsStringInSlice(standings[j].UserID, participant.Opponents) {
+				opponent = j
+				break
+			}
+		}
+		if opponent == -1 {
+			continue
+		}
+		paired[participant.UserID] = true
+		paired[standings[opponent].UserID] = true
+		pairs = append(pairs, []string{participant.UserID, standings[opponent].UserID})
+	}
+	return pairs
+}
+
+// getRoundRobinPairs uses the circle method, the first seed stays in place while the others rotate every round
+func getRoundRobinPairs(bracket *Bracket) [][]string {
+	userIDs := make([]string, len(bracket.Participants))
+	for _, participant := range bracket.Participants {
+		userIDs[participant.Seed-1] = participant.UserID
+	}
+	if len(userIDs)%2 == 1 {
+		userIDs = append(userIDs, "")
+	}
+	n := len(userIDs)
+	rotated := []string{userIDs[0]}
+	for i := 1; i < n; i++ {
+		rotated = append(rotated, userIDs[1+(i-1+bracket.CurrentRound-1)%(n-1)])
+	}
+
+	var pairs [][]string
+	for i := 0; i < n/2; i++ {
+		var pair []string
+		for _, userID := range []string{rotated[i], rotated[n-1-i]} {
+			if userID != "" {
+				pair = append(pair, userID)
+			}
+		}
+		pairs = append(pairs, pair)
+	}
+	return pairs
+}
+
+func isBracketFinished(bracket *Bracket) bool {
+	if isBracketElimination(bracket) {
+		return len(getAliveBracketParticipants(bracket)) <= 1
+	}
+	return bracket.CurrentRound >= bracket.Rounds
+}
+
+func isBracketRoundCompleted(bracket *Bracket) bool {
+	for _, match := range bracket.Matches {
+		if match.Round == bracket.CurrentRound && match.Status != BRACKET_MATCH_STATUS_COMPLETED {
+			return false
+		}
+	}
+	return true
+}
+
+// advanceBracketRound creates the matches of the next round, or completes the bracket when the last round is over.
+// Rounds made only of byes are completed immediately.
+func advanceBracketRound(bracket *Bracket) {
+	for bracket.Status == BRACKET_STATUS_IN_PROGRESS && isBracketRoundCompleted(bracket) {
+		if bracket.CurrentRound > 0 && isBracketFinished(bracket) {
+			bracket.Status = BRACKET_STATUS_COMPLETED
+			bracket.ChampionUserID = getBracketStandings(bracket)[0].UserID
+			return
+		}
+		bracket.CurrentRound++
+
+		var pairs [][]string
+		switch bracket.Format {
+		case BRACKET_FORMAT_SWISS:
+			pairs = getSwissPairs(bracket)
+		case BRACKET_FORMAT_ROUND_ROBIN:
+			pairs = getRoundRobinPairs(bracket)
+		default:
+			pairs = getEliminationPairs(bracket)
+		}
+		for slot, pair := range pairs {
+			if len(pair) == 0 {
+				continue
+			}
+			bracket.Matches = append(bracket.Matches, newBracketMatch(bracket, slot, pair))
+		}
+	}
+}
+
+func buildBracketMatchState(bracket *Bracket, match *BracketMatch) *nakamaCommands.MatchState {
+	var captains []string
+	var teams []*nakamaCommands.Team
+	for i, userID := range match.UserIDs {
+		teamUser := *getBracketParticipant(bracket, userID).TeamUser
+		teamUser.Captain = true
+		teamUser.TicketID = ""
+		teamUser.Reward = 0
+		captains = append(captains, teamUser.User.Nakama.CustomID)
+		teams = append(teams, &nakamaCommands.Team{
+			Name:      "",
+			TeamUsers: []*nakamaCommands.TeamUser{&teamUser},
+			ID:        i,
+		})
+	}
+
+	currentTime := matchClock.Now()
+	return &nakamaCommands.MatchState{
+		Debug:             true,
+		Active:            true,
+		Started:           false,
+		MatchID:           match.MatchID,
+		MatchProfile:      bracket.MatchProfile,
+		MatchType:         bracket.MatchType,
+		CaptainTurnUserID: captains[0],
+		CaptainUserIDs:    captains,
+		Status:            nakamaCommands.MATCH_STATUS_CREATED,
+		ReadyUserIDs:      []string{},
+		Results:           []*nakamaCommands.MatchResult{},
+		Teams:             teams,
+		PoolUserIDs:       []string{},
+		PoolUserCustomIDs: []string{},
+		StorageUserID:     nakamaContext.NakamaSystemUserID,
+		StorageCollection: nakamaCommands.MATCH_COLLECTION,
+		Version:           "*",
+		CancelUserIDs:     []string{},
+		DateTimeStart:     currentTime,
+		DateTimeEnd:       currentTime,
+		Duration:          time.Duration(bracket.MatchDurationHours) * time.Hour,
+	}
+}
+
+// spawnBracketMatches starts the pending matches of the bracket through the match module,
+// a match state which already exists was spawned by a concurrent call and is skipped
+func spawnBracketMatches(ctx context.Context, nk runtime.NakamaModule, bracket *Bracket) error {
+	var spawnedMatchIDs []string
+	for _, match := range bracket.Matches {
+		if match.Status != BRACKET_MATCH_STATUS_PENDING {
+			continue
+		}
+		if err := writeBracketMatchRef(ctx, nk, &BracketMatchRef{MatchID: match.MatchID, BracketID: bracket.ID}); err != nil {
+			log.Error(err)
+			return err
+		}
+		if _, err := startMatchState(ctx, nk, buildBracketMatchState(bracket, match), nil); err != nil && !isStorageVersionConflict(err) {
+			log.Error(err)
+			return err
+		}
+		spawnedMatchIDs = append(spawnedMatchIDs, match.MatchID)
+	}
+	if len(spawnedMatchIDs) == 0 {
+		return nil
+	}
+
+	if _, err := updateBracket(ctx, nk, bracket.ID, func(bracket *Bracket) error {
+		for _, matchID := range spawnedMatchIDs {
+			if match := getBracketMatch(bracket, matchID); match != nil && match.Status == BRACKET_MATCH_STATUS_PENDING {
+				match.Status = BRACKET_MATCH_STATUS_IN_PROGRESS
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// completeBracketMatch records the outcome of a bracket match, advances the bracket and spawns the next round.
+// It does nothing for matches which do not belong to a bracket or were already completed.
+func completeBracketMatch(ctx context.Context, nk runtime.NakamaModule, matchID string, winnerUserID string, draw bool, forfeit bool) error {
+	ref, err := readBracketMatchRef(ctx, nk, matchID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if ref == nil {
+		return nil
+	}
+
+	roundBefore := 0
+	bracket, err := updateBracket(ctx, nk, ref.BracketID, func(bracket *Bracket) error {
+		match := getBracketMatch(bracket, matchID)
+		if match == nil || match.Status == BRACKET_MATCH_STATUS_COMPLETED {
+			return errBracketUnchanged
+		}
+		roundBefore = bracket.CurrentRound
+
+		if draw && isBracketElimination(bracket) {
+			// Elimination matches can not end in a draw, the pair plays a rematch
+			match.Status = BRACKET_MATCH_STATUS_COMPLETED
+			match.Draw = true
+			rematch := newBracketMatch(bracket, match.Slot, match.UserIDs)
+			rematch.Round = match.Round
+			bracket.Matches = append(bracket.Matches, rematch)
+			return nil
+		}
+		match.WinnerUserID = winnerUserID
+		match.Draw = draw
+		match.Forfeit = forfeit
+		applyBracketMatchResult(bracket, match)
+		advanceBracketRound(bracket)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if err := spawnBracketMatches(ctx, nk, bracket); err != nil {
+		log.Error(err)
+		return err
+	}
+	if bracket.CurrentRound != roundBefore || bracket.Status == BRACKET_STATUS_COMPLETED {
+		publishBracket(bracket)
+	}
+	return nil
+}
+
+// advanceBracket records the outcome of a finished match in its bracket, a nil winner team is a draw
+func advanceBracket(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, winnerTeam *nakamaCommands.Team) error {
+	if winnerTeam == nil || len(winnerTeam.TeamUsers) == 0 {
+		return completeBracketMatch(ctx, nk, s.MatchID, "", true, false)
+	}
+	return completeBracketMatch(ctx, nk, s.MatchID, winnerTeam.TeamUsers[0].User.Nakama.ID, false, false)
+}
+
+// forfeitBracketMatch settles a canceled bracket match, the only ready participant wins by forfeit.
+// Otherwise the higher seed advances in elimination brackets and both participants lose in the other formats.
+func forfeitBracketMatch(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) error {
+	ref, err := readBracketMatchRef(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if ref == nil {
+		return nil
+	}
+	bracket, err := readBracket(ctx, nk, ref.BracketID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if bracket == nil {
+		return nil
+	}
+
+	var readyUserIDs []string
+	var participants []*BracketParticipant
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		if nakamaCommands.IsStringInSlice(teamUser.User.Nakama.ID, s.ReadyUserIDs) {
+			readyUserIDs = append(readyUserIDs, teamUser.User.Nakama.ID)
+		}
+		if participant := getBracketParticipant(bracket, teamUser.User.Nakama.ID); participant != nil {
+			participants = append(participants, participant)
+		}
+	}
+
+	winnerUserID := ""
+	switch {
+	case len(readyUserIDs) == 1:
+		winnerUserID = readyUserIDs[0]
+	case isBracketElimination(bracket) && len(participants) > 0:
+		sort.Slice(participants, func(i, j int) bool {
+			return participants[i].Seed < participants[j].Seed
+		})
+		winnerUserID = participants[0].UserID
+	}
+	return completeBracketMatch(ctx, nk, s.MatchID, winnerUserID, false, true)
+}
+
+func getBracketParticipantName(bracket *Bracket, userID string) string {
+	if participant := getBracketParticipant(bracket, userID); participant != nil {
+		return fmt.Sprintf("<@%v>", participant.TeamUser.User.Nakama.CustomID)
+	}
+	return userID
+}
+
+func printBracket(bracket *Bracket) string {
+	msg := fmt.Sprintf("> **%v** (%v, %v)\n", bracket.Name, bracket.Format, bracket.MatchProfile)
+	if bracket.Status == BRACKET_STATUS_COMPLETED {
+		msg += fmt.Sprintf("The champion is %v\n", getBracketParticipantName(bracket, bracket.ChampionUserID))
+	}
+	for round := 1; round <= bracket.CurrentRound; round++ {
+		msg += fmt.Sprintf("**Round %v**\n", round)
+		for _, match := range bracket.Matches {
+			if match.Round != round {
+				continue
+			}
+			var names []string
+			for _, userID := range match.UserIDs {
+				names = append(names, getBracketParticipantName(bracket, userID))
+			}
+			switch {
+			case len(names) == 1:
+				msg += fmt.Sprintf("%v: bye\n", names[0])
+			case match.Status != BRACKET_MATCH_STATUS_COMPLETED:
+				msg += fmt.Sprintf("%v vs %v\n", names[0], names[1])
+			case match.Draw:
+				msg += fmt.Sprintf("%v vs %v: draw\n", names[0], names[1])
+			case match.WinnerUserID == "":
+				msg += fmt.Sprintf("%v vs %v: no contest\n", names[0], names[1])
+			default:
+				msg += fmt.Sprintf("%v vs %v: **%v** won\n", names[0], names[1], getBracketParticipantName(bracket, match.WinnerUserID))
+			}
+		}
+	}
+	if !isBracketElimination(bracket) {
+		msg += "**Standings**\n"
+		for i, participant := range getBracketStandings(bracket) {
+			msg += fmt.Sprintf("%v. %v %v\n", i+1, getBracketParticipantName(bracket, participant.UserID), participant.Points)
+		}
+	}
+	return msg
+}
+
+func publishBracket(bracket *Bracket) {
+	if _, err := notifyDiscordChannel(bracket.DiscordChannelID, printBracket(bracket)); err != nil {
+		log.Error(err)
+	}
+}
+
+func isBracketFormat(format string) bool {
+	for _, f := range bracketFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func BracketCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *BracketCreateRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Match profile is required")
+	}
+	if !isBracketFormat(request.Format) {
+		return "", runtime.NewError(fmt.Sprintf("Unknown bracket format %v, expected one of %v", request.Format, bracketFormats), 3)
+	}
+	if request.MatchProfile == "" {
+		return "", runtime.NewError("Match profile is required", 3)
+	}
+
+	bracket := &Bracket{
+		ID:                 request.ID,
+		Name:               request.Name,
+		Format:             request.Format,
+		MatchProfile:       request.MatchProfile,
+		MatchType:          request.MatchType,
+		Rounds:             request.Rounds,
+		MatchDurationHours: request.MatchDurationHours,
+		MaxParticipants:    request.MaxParticipants,
+		DiscordChannelID:   request.DiscordChannelID,
+		Status:             BRACKET_STATUS_REGISTRATION,
+		Participants:       []*BracketParticipant{},
+		Matches:            []*BracketMatch{},
+		DateTimeCreate:     matchClock.Now().UTC(),
+		Version:            "*",
+	}
+	if bracket.ID == "" {
+		bracket.ID = uuid.Must(uuid.NewV4()).String()
+	}
+	if bracket.Name == "" {
+		bracket.Name = bracket.ID
+	}
+	if bracket.MatchDurationHours <= 0 {
+		bracket.MatchDurationHours = 1
+	}
+	if bracket.DiscordChannelID == "" {
+		bracket.DiscordChannelID = getConfig().DiscordAnnouncementsBracketsChannelID
+	}
+	if err := writeBracket(ctx, nk, bracket); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return MarshalIndent(bracket), nil
+}
+
+// getBracketTeamUser builds the team user of a bracket participant from the account of the user,
+// the Discord routing of the requested team user is only trusted when the system registers the user
+func getBracketTeamUser(ctx context.Context, nk runtime.NakamaModule, userID string, requested *nakamaCommands.TeamUser) (*nakamaCommands.TeamUser, error) {
+	teamUser, err := getAccountTeamUser(ctx, nk, userID)
+	if err != nil {
+		return nil, err
+	}
+	if getCallerRole(ctx) == ROLE_SYSTEM && requested != nil && requested.User != nil && requested.User.Discord != nil {
+		teamUser.User.Discord = requested.User.Discord
+	}
+	return teamUser, nil
+}
+
+func BracketRegisterRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *BracketRegisterRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("BracketID is required")
+	}
+	if err := validateRequired("BracketID", request.BracketID); err != nil {
+		return "", err
+	}
+	requestedUserID := request.UserID
+	if requestedUserID == "" && request.TeamUser != nil && request.TeamUser.User != nil && request.TeamUser.User.Nakama != nil {
+		requestedUserID = request.TeamUser.User.Nakama.ID
+	}
+	userID, err := getActingUserID(ctx, nk, "BracketRegister", "", requestedUserID)
+	if err != nil {
+		return "", err
+	}
+	teamUser, err := getBracketTeamUser(ctx, nk, userID, request.TeamUser)
+	if err != nil {
+		return "", err
+	}
+
+	msg := ""
+	if _, err := updateBracket(ctx, nk, request.BracketID, func(bracket *Bracket) error {
+		if bracket.Status != BRACKET_STATUS_REGISTRATION {
+			return runtime.NewError(fmt.Sprintf("Registration for **%v** is closed", bracket.Name), 9)
+		}
+		if getBracketParticipant(bracket, userID) != nil {
+			msg = fmt.Sprintf("User <@%v> is already registered for **%v**", teamUser.User.Nakama.CustomID, bracket.Name)
+			return errBracketUnchanged
+		}
+		if bracket.MaxParticipants > 0 && len(bracket.Participants) >= bracket.MaxParticipants {
+			return runtime.NewError(fmt.Sprintf("**%v** is full", bracket.Name), 8)
+		}
+		bracket.Participants = append(bracket.Participants, &BracketParticipant{
+			UserID:    userID,
+			TeamUser:  teamUser,
+			Opponents: []string{},
+		})
+		msg = fmt.Sprintf("User <@%v> registered for **%v**", teamUser.User.Nakama.CustomID, bracket.Name)
+		return nil
+	}); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return msg, nil
+}
+
+// seedBracketParticipants seeds the participants by their rating in the match profile of the bracket
+func seedBracketParticipants(ctx context.Context, nk runtime.NakamaModule, bracket *Bracket) error {
+	var userIDs []string
+	for _, participant := range bracket.Participants {
+		userIDs = append(userIDs, participant.UserID)
+	}
+	ratings, err := readPlayerRatings(ctx, nk, userIDs, bracket.MatchProfile)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	sort.SliceStable(bracket.Participants, func(i, j int) bool {
+		return ratings[bracket.Participants[i].UserID].Rating > ratings[bracket.Participants[j].UserID].Rating
+	})
+	for i, participant := range bracket.Participants {
+		participant.Seed = i + 1
+		participant.Position = i
+	}
+	return nil
+}
+
+func BracketStartRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *BracketRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("BracketID is required")
+	}
+	if err := validateRequired("BracketID", request.BracketID); err != nil {
+		return "", err
+	}
+
+	bracket, err := updateBracket(ctx, nk, request.BracketID, func(bracket *Bracket) error {
+		if bracket.Status != BRACKET_STATUS_REGISTRATION {
+			return runtime.NewError(fmt.Sprintf("**%v** was already started", bracket.Name), 9)
+		}
+		if len(bracket.Participants) < 2 {
+			return runtime.NewError(fmt.Sprintf("**%v** needs at least 2 participants", bracket.Name), 9)
+		}
+		if err := seedBracketParticipants(ctx, nk, bracket); err != nil {
+			return err
+		}
+		switch bracket.Format {
+		case BRACKET_FORMAT_SWISS:
+			if bracket.Rounds <= 0 {
+				bracket.Rounds = int(math.Ceil(math.Log2(float64(len(bracket.Participants)))))
+			}
+		case BRACKET_FORMAT_ROUND_ROBIN:
+			bracket.Rounds = len(bracket.Participants) - 1
+			if len(bracket.Participants)%2 == 1 {
+				bracket.Rounds++
+			}
+		}
+		bracket.Status = BRACKET_STATUS_IN_PROGRESS
+		advanceBracketRound(bracket)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	if err := spawnBracketMatches(ctx, nk, bracket); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	publishBracket(bracket)
+	return MarshalIndent(bracket), nil
+}
+
+func BracketGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *BracketRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("BracketID is required")
+	}
+	if err := validateRequired("BracketID", request.BracketID); err != nil {
+		return "", err
+	}
+	bracket, err := readBracket(ctx, nk, request.BracketID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if bracket == nil {
+		return "", runtime.NewError(fmt.Sprintf("No bracket found with ID: %v", request.BracketID), 5)
+	}
+	return MarshalIndent(bracket), nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"time"
+)
+
+// Clock tells the match subsystem the current time
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// matchClock is the clock of the match subsystem, the match simulation replaces it with a FakeClock
+var matchClock Clock = systemClock{}
+
+func setMatchClock(clock Clock) {
+	matchClock = clock
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+const (
+	OPEN_MATCH_FRONTEND_ENDPOINT_DEFAULT = "open-match-frontend.open-match.svc.cluster.local:50504"
+
+	CONFIG_REDACTED = "[redacted]"
+)
+
+// Config is the effective configuration of the module, loaded once in InitModule
+type Config struct {
+	DiscordToken                            string
+	DiscordGuildID                          string
+	DiscordAnnouncementsChallengeChannelID  string
+	DiscordAnnouncementsMatchMakerChannelID string
+	DiscordAnnouncementsResultsChannelID    string
+	DiscordAnnouncementsSeasonsChannelID    string
+	DiscordAnnouncementsBracketsChannelID   string
+	DiscordModeratorChannelID               string
+
+	OpenMatchFrontendEndpoint string
+
+	IdentityVerifier        string
+	FirebaseCredentialsFile string
+	OIDCIssuer              string
+	OIDCAudience            string
+	OIDCJWKSURL             string
+
+	SMTPAddress  string
+	SMTPUsername string
+	SMTPPassword string
+	SMTPFrom     string
+
+	ResultConsensusRatio       float64
+	ResultConsensusPolicy      string
+	RatingSystem               string
+	MatchReadyTimeoutSeconds   int
+	MatchNoShowCooldownSeconds int
+	MatchPickTimeoutSeconds    int
+	MatchAutoPickStrategy      string
+	MatchProfileSettings       map[string]json.RawMessage
+
+	TicketQuotaMaxTickets int
+	TicketQuotaPolicy     string
+}
+
+var (
+	config     = getDefaultConfig()
+	configLock sync.RWMutex
+)
+
+func getDefaultConfig() *Config {
+	return &Config{
+		OpenMatchFrontendEndpoint:  OPEN_MATCH_FRONTEND_ENDPOINT_DEFAULT,
+		IdentityVerifier:           IDENTITY_VERIFIER_FIREBASE,
+		ResultConsensusRatio:       1,
+		ResultConsensusPolicy:      CONSENSUS_POLICY_RATIO,
+		RatingSystem:               RATING_SYSTEM_GLICKO2,
+		MatchReadyTimeoutSeconds:   300,
+		MatchNoShowCooldownSeconds: 900,
+		MatchPickTimeoutSeconds:    120,
+		MatchAutoPickStrategy:      AUTO_PICK_STRATEGY_EARLIEST,
+		MatchProfileSettings:       map[string]json.RawMessage{},
+		TicketQuotaMaxTickets:      1,
+		TicketQuotaPolicy:          TICKET_QUOTA_POLICY_REJECT,
+	}
+}
+
+func getConfig() *Config {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	return config
+}
+
+func setConfig(c *Config) {
+	configLock.Lock()
+	defer configLock.Unlock()
+	config = c
+}
+
+// getRuntimeEnv returns the runtime env of the Nakama config, available in the InitModule context
+func getRuntimeEnv(ctx context.Context) map[string]string {
+	if env, ok := ctx.Value(runtime.RUNTIME_CTX_ENV).(map[string]string); ok {
+		return env
+	}
+	return map[string]string{}
+}
+
+// configSource reads the runtime env and falls back to the process environment, collecting the invalid values
+type configSource struct {
+	env    map[string]string
+	errors []string
+}
+
+func (s *configSource) lookup(name string) (string, bool) {
+	if value, ok := s.env[name]; ok && value != "" {
+		return value, true
+	}
+	if value := os.Getenv(name); value != "" {
+		return value, true
+	}
+	return "", false
+}
+
+func (s *configSource) invalid(format string, args ...interface{}) {
+	s.errors = append(s.errors, fmt.Sprintf(format, args...))
+}
+
+func (s *configSource) getString(name string, value *string) {
+	if v, ok := s.lookup(name); ok {
+		*value = v
+	}
+}
+
+func (s *configSource) getInt(name string, value *int) {
+	v, ok := s.lookup(name)
+	if !ok {
+		return
+	}
+	result, err := strconv.Atoi(v)
+	if err != nil {
+		s.invalid("%v %q is not an integer", name, v)
+		return
+	}
+	*value = result
+}
+
+func (s *configSource) getFloat(name string, value *float64) {
+	v, ok := s.lookup(name)
+	if !ok {
+		return
+	}
+	result, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		s.invalid("%v %q is not a number", name, v)
+		return
+	}
+	*value = result
+}
+
+func (s *configSource) getJSON(name string, value interface{}) {
+	v, ok := s.lookup(name)
+	if !ok {
+		return
+	}
+	if err := json.Unmarshal([]byte(v), value); err != nil {
+		s.invalid("%v is not valid JSON: %v", name, err)
+	}
+}
+
+func (s *configSource) checkOneOf(name string, value string, allowed ...string) {
+	for _, v := range allowed {
+		if v == value {
+			return
+		}
+	}
+	s.invalid("%v %q must be one of %v", name, value, strings.Join(allowed, ", "))
+}
+
+func (s *configSource) checkMin(name string, value int, min int) {
+	if value < min {
+		s.invalid("%v %v must be at least %v", name, value, min)
+	}
+}
+
+// checkMatchProfileSettings validates the settings the same way as the defaults they override
+func (s *configSource) checkMatchProfileSettings(name string, settings *MatchProfileSettings) {
+	s.checkMin(name+" ReadyTimeoutSeconds", settings.ReadyTimeoutSeconds, 0)
+	s.checkMin(name+" NoShowCooldownSeconds", settings.NoShowCooldownSeconds, 0)
+	s.checkMin(name+" PickTimeoutSeconds", settings.PickTimeoutSeconds, 0)
+	s.checkOneOf(name+" AutoPickStrategy", settings.AutoPickStrategy, AUTO_PICK_STRATEGY_EARLIEST, AUTO_PICK_STRATEGY_RANDOM, AUTO_PICK_STRATEGY_RATING)
+	var policies []string
+	for policy := range consensusPolicies {
+		policies = append(policies, policy)
+	}
+	sort.Strings(policies)
+	s.checkOneOf(name+" ConsensusPolicy", settings.ConsensusPolicy, policies...)
+	s.checkOneOf(name+" RatingSystem", settings.RatingSystem, RATING_SYSTEM_GLICKO2, RATING_SYSTEM_ELO)
+}
+
+// loadConfig reads the configuration from the runtime env over the defaults and returns every invalid value in one error
+func loadConfig(env map[string]string) (*Config, error) {
+	c := getDefaultConfig()
+	s := &configSource{env: env}
+
+	s.getString("DISCORD_TOKEN", &c.DiscordToken)
+	s.getString("DISCORD_GUILD_ID", &c.DiscordGuildID)
+	s.getString("DISCORD_ANNOUNCEMENTS_CHALLENGE_CHANNEL_ID", &c.DiscordAnnouncementsChallengeChannelID)
+	s.getString("DISCORD_ANNOUNCEMENTS_MATCH_MAKER_CHANNEL_ID", &c.DiscordAnnouncementsMatchMakerChannelID)
+	s.getString("DISCORD_ANNOUNCEMENTS_RESULTS_CHANNEL_ID", &c.DiscordAnnouncementsResultsChannelID)
+	s.getString("DISCORD_ANNOUNCEMENTS_SEASONS_CHANNEL_ID", &c.DiscordAnnouncementsSeasonsChannelID)
+	s.getString("DISCORD_ANNOUNCEMENTS_BRACKETS_CHANNEL_ID", &c.DiscordAnnouncementsBracketsChannelID)
+	s.getString("DISCORD_MODERATOR_CHANNEL_ID", &c.DiscordModeratorChannelID)
+	s.getString("OPEN_MATCH_FRONTEND_ENDPOINT", &c.OpenMatchFrontendEndpoint)
+	s.getString("IDENTITY_VERIFIER", &c.IdentityVerifier)
+	s.getString("FIREBASE_CREDENTIALS_FILE", &c.FirebaseCredentialsFile)
+	s.getString("OIDC_ISSUER", &c.OIDCIssuer)
+	s.getString("OIDC_AUDIENCE", &c.OIDCAudience)
+	s.getString("OIDC_JWKS_URL", &c.OIDCJWKSURL)
+	s.getString("SMTP_ADDRESS", &c.SMTPAddress)
+	s.getString("SMTP_USERNAME", &c.SMTPUsername)
+	s.getString("SMTP_PASSWORD", &c.SMTPPassword)
+	s.getString("SMTP_FROM", &c.SMTPFrom)
+	s.getFloat("RESULT_CONSENSUS_RATIO", &c.ResultConsensusRatio)
+	s.getString("RESULT_CONSENSUS_POLICY", &c.ResultConsensusPolicy)
+	s.getString("RATING_SYSTEM", &c.RatingSystem)
+	s.getInt("MATCH_READY_TIMEOUT_SECONDS", &c.MatchReadyTimeoutSeconds)
+	s.getInt("MATCH_NO_SHOW_COOLDOWN_SECONDS", &c.MatchNoShowCooldownSeconds)
+	s.getInt("MATCH_PICK_TIMEOUT_SECONDS", &c.MatchPickTimeoutSeconds)
+	s.getString("MATCH_AUTO_PICK_STRATEGY", &c.MatchAutoPickStrategy)
+	s.getJSON("MATCH_PROFILE_SETTINGS", &c.MatchProfileSettings)
+	s.getInt("TICKET_QUOTA_MAX_TICKETS", &c.TicketQuotaMaxTickets)
+	s.getString("TICKET_QUOTA_POLICY", &c.TicketQuotaPolicy)
+
+	if c.DiscordToken == "" {
+		s.invalid("DISCORD_TOKEN is required")
+	}
+	s.checkOneOf("IDENTITY_VERIFIER", c.IdentityVerifier, IDENTITY_VERIFIER_DISCORD, IDENTITY_VERIFIER_FIREBASE, IDENTITY_VERIFIER_OIDC)
+	if c.IdentityVerifier == IDENTITY_VERIFIER_FIREBASE && c.FirebaseCredentialsFile == "" {
+		s.invalid("FIREBASE_CREDENTIALS_FILE is required by the firebase identity verifier")
+	}
+	if c.IdentityVerifier == IDENTITY_VERIFIER_OIDC && (c.OIDCIssuer == "" || c.OIDCAudience == "" || c.OIDCJWKSURL == "") {
+		s.invalid("OIDC_ISSUER, OIDC_AUDIENCE and OIDC_JWKS_URL are required by the oidc identity verifier")
+	}
+	if c.SMTPAddress != "" {
+		if _, _, err := net.SplitHostPort(c.SMTPAddress); err != nil {
+			s.invalid("SMTP_ADDRESS %q must be host:port", c.SMTPAddress)
+		}
+		if !isEmailValid(c.SMTPFrom) {
+			s.invalid("SMTP_FROM %q must be an email when SMTP_ADDRESS is set", c.SMTPFrom)
+		}
+	}
+	if c.ResultConsensusRatio <= 0 || c.ResultConsensusRatio > 1 {
+		s.invalid("RESULT_CONSENSUS_RATIO %v must be greater than 0 and at most 1", c.ResultConsensusRatio)
+	}
+	s.checkMatchProfileSettings("default match profile", c.getDefaultMatchProfileSettings())
+	for profile := range c.MatchProfileSettings {
+		settings, err := c.getMatchProfileSettings(profile)
+		if err != nil {
+			s.invalid("MATCH_PROFILE_SETTINGS for profile %v is invalid: %v", profile, err)
+			continue
+		}
+		s.checkMatchProfileSettings("MATCH_PROFILE_SETTINGS "+profile, settings)
+	}
+	s.checkMin("TICKET_QUOTA_MAX_TICKETS", c.TicketQuotaMaxTickets, 1)
+	s.checkOneOf("TICKET_QUOTA_POLICY", c.TicketQuotaPolicy, TICKET_QUOTA_POLICY_REJECT, TICKET_QUOTA_POLICY_REPLACE)
+
+	if len(s.errors) > 0 {
+		return nil, fmt.Errorf("Invalid configuration: %v", strings.Join(s.errors, "; "))
+	}
+	return c, nil
+}
+
+// Redacted returns a copy of the configuration with the secrets replaced
+func (c *Config) Redacted() *Config {
+	redacted := *c
+	if redacted.DiscordToken != "" {
+		redacted.DiscordToken = CONFIG_REDACTED
+	}
+	if redacted.SMTPPassword != "" {
+		redacted.SMTPPassword = CONFIG_REDACTED
+	}
+	return &redacted
+}
+
+func ConfigGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	return MarshalIndent(getConfig().Redacted()), nil
+}
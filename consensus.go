@@ -0,0 +1,262 @@
+package main
+
+import (
+	"sort"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	CONSENSUS_POLICY_RATIO                 = "ratio"
+	CONSENSUS_POLICY_CAPTAINS_ONLY         = "captains-only"
+	CONSENSUS_POLICY_UNANIMOUS             = "unanimous"
+	CONSENSUS_POLICY_MAJORITY_OF_EACH_TEAM = "majority-of-each-team"
+	CONSENSUS_POLICY_PROOF_REQUIRED        = "proof-required"
+
+	CONSENSUS_OUTCOME_PENDING = "pending"
+	CONSENSUS_OUTCOME_WINNER  = "winner"
+	CONSENSUS_OUTCOME_DRAW    = "draw"
+	CONSENSUS_OUTCOME_DISPUTE = "dispute"
+
+	CONSENSUS_CLAIM_DRAW = -1
+	CONSENSUS_CLAIM_NONE = -2
+)
+
+type ConsensusResult struct {
+	Outcome    string
+	WinnerTeam *nakamaCommands.Team
+}
+
+// ConsensusPolicy decides from the reported results whether the outcome of a match is settled
+type ConsensusPolicy interface {
+	Name() string
+	Evaluate(s *nakamaCommands.MatchState) *ConsensusResult
+}
+
+var consensusPolicies = map[string]ConsensusPolicy{
+	CONSENSUS_POLICY_RATIO:                 &ratioConsensusPolicy{},
+	CONSENSUS_POLICY_CAPTAINS_ONLY:         &captainsOnlyConsensusPolicy{},
+	CONSENSUS_POLICY_UNANIMOUS:             &unanimousConsensusPolicy{},
+	CONSENSUS_POLICY_MAJORITY_OF_EACH_TEAM: &majorityOfEachTeamConsensusPolicy{},
+	CONSENSUS_POLICY_PROOF_REQUIRED:        &proofRequiredConsensusPolicy{},
+}
+
+func getConsensusPolicy(name string) ConsensusPolicy {
+	if policy, ok := consensusPolicies[name]; ok {
+		return policy
+	}
+	log.Errorf("Unknown consensus policy %v, using %v", name, CONSENSUS_POLICY_RATIO)
+	return consensusPolicies[CONSENSUS_POLICY_RATIO]
+}
+
+func evaluateResultConsensus(s *nakamaCommands.MatchState, settings *MatchProfileSettings) *ConsensusResult {
+	policy := getConsensusPolicy(settings.ConsensusPolicy)
+	result := policy.Evaluate(s)
+	if result.Outcome != CONSENSUS_OUTCOME_PENDING {
+		log.Infof("match_id: %v consensus policy %v outcome %v", s.MatchID, policy.Name(), result.Outcome)
+	}
+	return result
+}
+
+func pendingConsensus() *ConsensusResult {
+	return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_PENDING}
+}
+
+// getResultClaim returns the team number the result claims as the winner, CONSENSUS_CLAIM_DRAW for a draw
+// or CONSENSUS_CLAIM_NONE when a loss report does not identify the winner of a match with more than two teams
+func getResultClaim(result *nakamaCommands.MatchResult, teamCount int) int {
+	if result.Draw {
+		return CONSENSUS_CLAIM_DRAW
+	}
+	if result.TeamNumber < 0 || result.TeamNumber >= teamCount {
+		return CONSENSUS_CLAIM_NONE
+	}
+	if result.Win {
+		return result.TeamNumber
+	}
+	if teamCount == 2 {
+		return 1 - result.TeamNumber
+	}
+	return CONSENSUS_CLAIM_NONE
+}
+
+// getClaimsConsensus settles the outcome when all claims agree and raises a dispute when they conflict
+func getClaimsConsensus(s *nakamaCommands.MatchState, claims []int) *ConsensusResult {
+	agreedClaim := CONSENSUS_CLAIM_NONE
+	for _, claim := range claims {
+		if claim == CONSENSUS_CLAIM_NONE {
+			continue
+		}
+		if agreedClaim != CONSENSUS_CLAIM_NONE && agreedClaim != claim {
+			return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_DISPUTE}
+		}
+		agreedClaim = claim
+	}
+	switch agreedClaim {
+	case CONSENSUS_CLAIM_NONE:
+		return pendingConsensus()
+	case CONSENSUS_CLAIM_DRAW:
+		return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_DRAW}
+	}
+	return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_WINNER, WinnerTeam: s.Teams[agreedClaim]}
+}
+
+func getUserResult(s *nakamaCommands.MatchState, userID string) *nakamaCommands.MatchResult {
+	for _, result := range s.Results {
+		if result.UserID == userID {
+			return result
+		}
+	}
+	return nil
+}
+
+// ratioConsensusPolicy settles the match once RESULT_CONSENSUS_RATIO of the users reported and one team leads the votes
+type ratioConsensusPolicy struct{}
+
+func (p *ratioConsensusPolicy) Name() string {
+	return CONSENSUS_POLICY_RATIO
+}
+
+func (p *ratioConsensusPolicy) Evaluate(s *nakamaCommands.MatchState) *ConsensusResult {
+	resultConsensusRatio := getConfig().ResultConsensusRatio
+	usersCount := len(nakamaCommands.GetTeamUsersFromMatch(s))
+	if usersCount == 0 || len(s.Results) == 0 || float64(len(s.Results))/float64(usersCount) < resultConsensusRatio {
+		return pendingConsensus()
+	}
+
+	teamResults := make(map[int]int)
+	for i := 0; i < len(s.Teams); i++ {
+		teamResults[i] = 0
+	}
+	drawCount := 0
+	for _, v := range s.Results {
+		if v.Draw {
+			drawCount++
+			continue
+		}
+		if _, ok := teamResults[v.TeamNumber]; !ok {
+			continue
+		}
+		if v.Win {
+			teamResults[v.TeamNumber] = teamResults[v.TeamNumber] + 1
+		} else {
+			teamResults[v.TeamNumber] = teamResults[v.TeamNumber] - 1
+		}
+	}
+
+	if float64(drawCount)/float64(len(s.Results)) >= resultConsensusRatio {
+		return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_DRAW}
+	}
+
+	var ss []*nakamaCommands.TeamResult
+	for k, v := range teamResults {
+		ss = append(ss, &nakamaCommands.TeamResult{k, v})
+	}
+
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].Votes > ss[j].Votes
+	})
+
+	if len(ss) == 1 || ss[0].Votes > ss[1].Votes {
+		return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_WINNER, WinnerTeam: s.Teams[ss[0].TeamNumber]}
+	}
+	if ss[0].Votes > 0 {
+		return &ConsensusResult{Outcome: CONSENSUS_OUTCOME_DISPUTE}
+	}
+	return pendingConsensus()
+}
+
+// captainsOnlyConsensusPolicy settles the match once every captain reported the same outcome
+type captainsOnlyConsensusPolicy struct{}
+
+func (p *captainsOnlyConsensusPolicy) Name() string {
+	return CONSENSUS_POLICY_CAPTAINS_ONLY
+}
+
+func (p *captainsOnlyConsensusPolicy) Evaluate(s *nakamaCommands.MatchState) *ConsensusResult {
+	var claims []int
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		if !teamUser.Captain {
+			continue
+		}
+		result := getUserResult(s, teamUser.User.Nakama.ID)
+		if result == nil {
+			return pendingConsensus()
+		}
+		claims = append(claims, getResultClaim(result, len(s.Teams)))
+	}
+	return getClaimsConsensus(s, claims)
+}
+
+// unanimousConsensusPolicy settles the match once every user reported the same outcome
+type unanimousConsensusPolicy struct{}
+
+func (p *unanimousConsensusPolicy) Name() string {
+	return CONSENSUS_POLICY_UNANIMOUS
+}
+
+func (p *unanimousConsensusPolicy) Evaluate(s *nakamaCommands.MatchState) *ConsensusResult {
+	var claims []int
+	for _, result := range s.Results {
+		claims = append(claims, getResultClaim(result, len(s.Teams)))
+	}
+	consensus := getClaimsConsensus(s, claims)
+	if consensus.Outcome != CONSENSUS_OUTCOME_DISPUTE && len(s.Results) < len(nakamaCommands.GetTeamUsersFromMatch(s)) {
+		return pendingConsensus()
+	}
+	return consensus
+}
+
+// majorityOfEachTeamConsensusPolicy settles the match once the majority of every team reported the same outcome
+type majorityOfEachTeamConsensusPolicy struct{}
+
+func (p *majorityOfEachTeamConsensusPolicy) Name() string {
+	return CONSENSUS_POLICY_MAJORITY_OF_EACH_TEAM
+}
+
+func (p *majorityOfEachTeamConsensusPolicy) Evaluate(s *nakamaCommands.MatchState) *ConsensusResult {
+	var teamClaims []int
+	for _, team := range s.Teams {
+		claimVotes := make(map[int]int)
+		for _, teamUser := range team.TeamUsers {
+			if result := getUserResult(s, teamUser.User.Nakama.ID); result != nil {
+				claimVotes[getResultClaim(result, len(s.Teams))]++
+			}
+		}
+		teamClaim := CONSENSUS_CLAIM_NONE
+		for claim, votes := range claimVotes {
+			if claim != CONSENSUS_CLAIM_NONE && votes*2 > len(team.TeamUsers) {
+				teamClaim = claim
+			}
+		}
+		if teamClaim == CONSENSUS_CLAIM_NONE {
+			return pendingConsensus()
+		}
+		teamClaims = append(teamClaims, teamClaim)
+	}
+	return getClaimsConsensus(s, teamClaims)
+}
+
+// proofRequiredConsensusPolicy only counts results with a proof link and raises a dispute when any report contradicts them
+type proofRequiredConsensusPolicy struct{}
+
+func (p *proofRequiredConsensusPolicy) Name() string {
+	return CONSENSUS_POLICY_PROOF_REQUIRED
+}
+
+func (p *proofRequiredConsensusPolicy) Evaluate(s *nakamaCommands.MatchState) *ConsensusResult {
+	var proofClaims []int
+	var claims []int
+	for _, result := range s.Results {
+		claim := getResultClaim(result, len(s.Teams))
+		claims = append(claims, claim)
+		if result.ProofLink != "" {
+			proofClaims = append(proofClaims, claim)
+		}
+	}
+	if getClaimsConsensus(s, proofClaims).Outcome == CONSENSUS_OUTCOME_PENDING {
+		return pendingConsensus()
+	}
+	return getClaimsConsensus(s, claims)
+}
@@ -2,7 +2,6 @@ package main
 
 import (
 	"fmt"
-	"os"
 	"strings"
 	"sync"
 	"time"
@@ -17,8 +16,20 @@ const (
 	DISCORD_BLOCK_CODE_TYPE = "yaml"
 )
 
+// DiscordNotifier is the part of the Discord API the module uses, it is implemented by *discordgo.Session
+type DiscordNotifier interface {
+	Channel(channelID string) (*discordgo.Channel, error)
+	ChannelDelete(channelID string) (*discordgo.Channel, error)
+	ChannelInviteCreate(channelID string, i discordgo.Invite) (*discordgo.Invite, error)
+	ChannelMessageSend(channelID string, content string) (*discordgo.Message, error)
+	ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error)
+	ChannelMessageDelete(channelID string, messageID string) error
+	GuildChannelCreateComplex(guildID string, data discordgo.GuildChannelCreateData) (*discordgo.Channel, error)
+	UserChannelCreate(recipientID string) (*discordgo.Channel, error)
+}
+
 type discordSession struct {
-	session *discordgo.Session
+	session DiscordNotifier
 }
 
 var (
@@ -28,7 +39,7 @@ var (
 
 func NewDiscordSessionSingleton() *discordSession {
 	discordOnce.Do(func() {
-		s, err := discordgo.New("Bot " + os.Getenv("DISCORD_TOKEN"))
+		s, err := discordgo.New("Bot " + getConfig().DiscordToken)
 		if err != nil {
 			log.Fatalf("Failed to connect to Discord, got %v", err)
 		}
@@ -39,12 +50,18 @@ func NewDiscordSessionSingleton() *discordSession {
 	return discordSessionBuilder
 }
 
-func (b *discordSession) SetSession(s *discordgo.Session) *discordSession {
+// setDiscordNotifier replaces the Discord session, the session of DISCORD_TOKEN is not created afterwards
+func setDiscordNotifier(notifier DiscordNotifier) {
+	discordOnce.Do(func() {})
+	discordSessionBuilder = &discordSession{session: notifier}
+}
+
+func (b *discordSession) SetSession(s DiscordNotifier) *discordSession {
 	b.session = s
 	return b
 }
 
-func (b *discordSession) GetSession() *discordgo.Session {
+func (b *discordSession) GetSession() DiscordNotifier {
 	return b.session
 }
 
@@ -197,7 +214,7 @@ func createDiscordInviteToChannel(channelID string) (invite *discordgo.Invite, e
 }
 
 func createDiscordChannel(users []*nakamaCommands.User, discordChannelCreateRequest *nakamaCommands.DiscordChannelCreateRequest) (channel *discordgo.Channel, err error) {
-	guildID := os.Getenv("DISCORD_GUILD_ID") // Data League default guildID
+	guildID := getConfig().DiscordGuildID // Data League default guildID
 	if len(users) > 0 {
 		if users[0].Discord.GuildID != "" {
 			guildID = users[0].Discord.GuildID
@@ -304,6 +321,16 @@ func notifyDiscordUser(user *nakamaCommands.User, message string) (*discordgo.Me
 	return notifyDiscordChannel(user.Discord.ChannelID, message)
 }
 
+// notifyDiscordDirectMessage sends the message to the Discord user in a direct message channel
+func notifyDiscordDirectMessage(discordUserID string, message string) (*discordgo.Message, error) {
+	channel, err := NewDiscordSessionSingleton().GetSession().UserChannelCreate(discordUserID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return notifyDiscordChannel(channel.ID, message)
+}
+
 func notifyDiscordUsers(users []*nakamaCommands.User, message string) error {
 	for _, user := range users {
 		if user.Discord != nil {
@@ -350,7 +377,7 @@ func notifyDiscordNewMatch(s *nakamaCommands.MatchState) error {
 		return fmt.Errorf("Failed to notify users for match %v, got %w", s.MatchID, err)
 	}
 
-	if _, err := notifyDiscordChannel(os.Getenv("DISCORD_ANNOUNCEMENTS_CHALLENGE_CHANNEL_ID"), message); err != nil {
+	if _, err := notifyDiscordChannel(getConfig().DiscordAnnouncementsChallengeChannelID, message); err != nil {
 		log.Errorf("Error %+v", err)
 		return fmt.Errorf("Failed to notify users for match %v, got %w", s.MatchID, err)
 	}
@@ -369,7 +396,3 @@ func notifyDiscordNewMatchEmbed(s *nakamaCommands.MatchState) error {
 	}
 	return nil
 }
-
-func init() {
-	NewDiscordSessionSingleton()
-}
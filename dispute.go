@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	MATCH_DISPUTE_COLLECTION = "match_dispute"
+
+	DISPUTE_STATUS_OPEN     = "open"
+	DISPUTE_STATUS_RESOLVED = "resolved"
+
+	DISPUTE_RESOLUTION_WINNER = "winner"
+	DISPUTE_RESOLUTION_DRAW   = "draw"
+	DISPUTE_RESOLUTION_VOID   = "void"
+)
+
+type MatchDisputeResolution struct {
+	Outcome           string
+	TeamNumber        int
+	ModeratorUserID   string
+	ModeratorCustomID string
+	Reason            string
+	DateTime          time.Time
+}
+
+type MatchDispute struct {
+	MatchID      string
+	Status       string
+	Results      []*nakamaCommands.MatchResult
+	DateTimeOpen time.Time
+	Resolution   *MatchDisputeResolution
+	Version      string
+}
+
+type MatchDisputeResolveRequest struct {
+	MatchID string
+	// UserID is the moderator resolving the dispute, only the system may name another user than the session user
+	UserID     string
+	Outcome    string
+	TeamNumber int
+	Reason     string
+}
+
+func readMatchDispute(ctx context.Context, nk runtime.NakamaModule, matchID string) (*MatchDispute, error) {
+	var dispute *MatchDispute
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: MATCH_DISPUTE_COLLECTION,
+		Key:        matchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &dispute); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	dispute.Version = storageObjects[0].Version
+	return dispute, nil
+}
+
+func writeMatchDispute(ctx context.Context, nk runtime.NakamaModule, dispute *MatchDispute) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      MATCH_DISPUTE_COLLECTION,
+			Key:             dispute.MatchID,
+			Value:           string(Marshal(dispute)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         dispute.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for dispute of match %v", dispute.MatchID)
+	}
+	dispute.Version = acks[0].Version
+	return nil
+}
+
+func printMatchDispute(s *nakamaCommands.MatchState, dispute *MatchDispute) string {
+	msg := fmt.Sprintf("> The results of the Match **%v** (%v) are **disputed**, a moderator decision is required\n", s.MatchID, s.MatchProfile)
+	for _, result := range dispute.Results {
+		outcome := "Draw"
+		if !result.Draw {
+			outcome = fmt.Sprintf("Team %v Lose", result.TeamNumber)
+			if result.Win {
+				outcome = fmt.Sprintf("Team %v Win", result.TeamNumber)
+			}
+		}
+		proofLink := "no proof link"
+		if result.ProofLink != "" {
+			proofLink = result.ProofLink
+		}
+		msg += fmt.Sprintf("<@%v> reported **%v**: %v\n", result.DiscordID, outcome, proofLink)
+	}
+	return msg
+}
+
+// openMatchDispute records the conflicting results and asks the moderators for a decision
+func openMatchDispute(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) error {
+	dispute, err := readMatchDispute(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if dispute != nil {
+		log.Infof("Dispute for match %v already exists", s.MatchID)
+		return nil
+	}
+
+	dispute = &MatchDispute{
+		MatchID:      s.MatchID,
+		Status:       DISPUTE_STATUS_OPEN,
+		Results:      s.Results,
+		DateTimeOpen: matchClock.Now().UTC(),
+		Version:      "*",
+	}
+	if err := writeMatchDispute(ctx, nk, dispute); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	msg := printMatchDispute(s, dispute)
+	if _, err := notifyDiscordChannel(getConfig().DiscordModeratorChannelID, msg); err != nil {
+		log.Error(err)
+	}
+	if err := notifyDiscordUsers(
+		nakamaCommands.GetUsersFromMatch(s),
+		fmt.Sprintf("> The reported results of the Match **%v** conflict, the match was sent to the moderators", s.MatchID)); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+// applyMatchDisputeResolution runs the reward distribution for a resolved dispute and stops the match
+func applyMatchDisputeResolution(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, dispute *MatchDispute) error {
+	resolution := dispute.Resolution
+	if err := transitionMatch(ctx, nk, s, MATCH_PHASE_RESOLVED, fmt.Sprintf("dispute resolved as %v: %v", resolution.Outcome, resolution.Reason), resolution.ModeratorUserID); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	msg := fmt.Sprintf("> The dispute of the Match **%%v** was resolved by <@%v>.\n", resolution.ModeratorCustomID)
+	switch resolution.Outcome {
+	case DISPUTE_RESOLUTION_WINNER:
+		if err := distributeRewardsWithMessage(ctx, nk, s.Teams[resolution.TeamNumber], s, msg); err != nil {
+			log.Error(err)
+		}
+	case DISPUTE_RESOLUTION_DRAW:
+		if err := distributeRewardsWithMessage(ctx, nk, nil, s, msg); err != nil {
+			log.Error(err)
+		}
+	case DISPUTE_RESOLUTION_VOID:
+		s.Status = nakamaCommands.MATCH_STATUS_CANCELED
+		if err := refundMatchEscrow(ctx, nk, s, "dispute voided"); err != nil {
+			log.Error(err)
+		}
+		if err := forfeitBracketMatch(ctx, nk, s); err != nil {
+			log.Error(err)
+		}
+		if err := notifyDiscordUsers(
+			nakamaCommands.GetUsersFromMatch(s),
+			fmt.Sprintf(msg+"The match was **voided**, no rewards were distributed", s.MatchID)); err != nil {
+			log.Error(err)
+		}
+	}
+	return stopMatch(ctx, nk, s)
+}
+
+func MatchDisputeResolveRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *MatchDisputeResolveRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("MatchID is required")
+	}
+	if err := validateRequired("MatchID", request.MatchID); err != nil {
+		return "", err
+	}
+	// the dispute is resolved by the session moderator, the system resolves it on behalf of the moderator named in the request
+	moderatorUserID, err := getActingUserID(ctx, nk, "MatchDisputeResolve", request.MatchID, request.UserID)
+	if err != nil {
+		return "", err
+	}
+	role, err := getUserRole(ctx, nk, moderatorUserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if !hasRole(role, ROLE_MODERATOR) {
+		log.Warnf("user_id: %v with role %v denied to resolve the dispute of match %v", moderatorUserID, role, request.MatchID)
+		return "", errPermissionDenied("User %v is not a moderator", moderatorUserID)
+	}
+
+	account, err := nk.AccountGetId(ctx, moderatorUserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+
+	dispute, err := readMatchDispute(ctx, nk, request.MatchID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if dispute == nil {
+		return "", runtime.NewError(fmt.Sprintf("No dispute found for match **%v**", request.MatchID), 5)
+	}
+	if dispute.Status != DISPUTE_STATUS_OPEN {
+		return fmt.Sprintf("The dispute of match **%v** is already resolved", request.MatchID), nil
+	}
+
+	matchState, err := readMatchState(ctx, nk, getDummyMatchState(request.MatchID, nakamaCommands.MATCH_COLLECTION))
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(matchState) {
+		if teamUser.User.Nakama.ID == moderatorUserID {
+			log.Warnf("user_id: %v denied to resolve the dispute of match %v as a participant", moderatorUserID, request.MatchID)
+			return "", errPermissionDenied("User %v played in match %v and can not resolve its dispute", moderatorUserID, request.MatchID)
+		}
+	}
+
+	switch request.Outcome {
+	case DISPUTE_RESOLUTION_WINNER:
+		if request.TeamNumber < 0 || request.TeamNumber >= len(matchState.Teams) {
+			return "", runtime.NewError(fmt.Sprintf("Team %v not found in match **%v**", request.TeamNumber, request.MatchID), 3)
+		}
+	case DISPUTE_RESOLUTION_DRAW, DISPUTE_RESOLUTION_VOID:
+	default:
+		return "", runtime.NewError(fmt.Sprintf("Unknown dispute outcome %v, expected one of %v, %v, %v", request.Outcome, DISPUTE_RESOLUTION_WINNER, DISPUTE_RESOLUTION_DRAW, DISPUTE_RESOLUTION_VOID), 3)
+	}
+
+	dispute.Status = DISPUTE_STATUS_RESOLVED
+	dispute.Resolution = &MatchDisputeResolution{
+		Outcome:           request.Outcome,
+		TeamNumber:        request.TeamNumber,
+		ModeratorUserID:   moderatorUserID,
+		ModeratorCustomID: account.CustomId,
+		Reason:            request.Reason,
+		DateTime:          matchClock.Now().UTC(),
+	}
+	if err := writeMatchDispute(ctx, nk, dispute); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return fmt.Sprintf("The dispute of match **%v** was resolved as **%v**", request.MatchID, request.Outcome), nil
+}
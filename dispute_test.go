@@ -0,0 +1,27 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestMatchDisputeResolveRequiresAModerator(t *testing.T) {
+	ctx := context.Background()
+	nk := NewFakeNakamaModule()
+	playerID := nk.AddUser("111", "player")
+	moderatorID := nk.AddUser("222", "moderator")
+	if err := writeUserRole(ctx, nk, &UserRole{UserID: moderatorID, Role: ROLE_MODERATOR}); err != nil {
+		t.Fatal(err)
+	}
+
+	request := &MatchDisputeResolveRequest{MatchID: "match", UserID: playerID, Outcome: DISPUTE_RESOLUTION_VOID}
+	if _, err := MatchDisputeResolveRPC(ctx, nil, nil, nk, string(Marshal(request))); err == nil || !strings.Contains(err.Error(), "not a moderator") {
+		t.Errorf("expected a player to be denied, got %v", err)
+	}
+
+	request.UserID = moderatorID
+	if _, err := MatchDisputeResolveRPC(ctx, nil, nil, nk, string(Marshal(request))); err == nil || !strings.Contains(err.Error(), "No dispute found") {
+		t.Errorf("expected the moderator to reach the dispute lookup, got %v", err)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/smtp"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// sendEmail sends a plain text email through the SMTP server of the configuration, the recipient must be a valid email
+func sendEmail(to string, subject string, body string) error {
+	config := getConfig()
+	if config.SMTPAddress == "" {
+		return runtime.NewError("Email delivery is not configured", 14)
+	}
+	if !isEmailValid(to) {
+		return errInvalidArgument("%v is not a valid email", to)
+	}
+	host, _, err := net.SplitHostPort(config.SMTPAddress)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	var auth smtp.Auth
+	if config.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", config.SMTPUsername, config.SMTPPassword, host)
+	}
+	message := fmt.Sprintf("From: %v\r\nTo: %v\r\nSubject: %v\r\nContent-Type: text/plain; charset=UTF-8\r\n\r\n%v\r\n",
+		config.SMTPFrom, to, subject, body)
+	if err := smtp.SendMail(config.SMTPAddress, auth, config.SMTPFrom, []string{to}, []byte(message)); err != nil {
+		log.Errorf("failed to send email: %v", err)
+		return err
+	}
+	return nil
+}
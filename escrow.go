@@ -0,0 +1,410 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	MATCH_ESCROW_COLLECTION = "match_escrow"
+
+	ESCROW_STATUS_HELD     = "held"
+	ESCROW_STATUS_REFUNDED = "refunded"
+	ESCROW_STATUS_PAID     = "paid"
+	// ESCROW_STATUS_REFUNDING and ESCROW_STATUS_PAYING mark an escrow whose entries are recorded but whose
+	// wallet updates may not be applied yet, the settlement is resumed from them
+	ESCROW_STATUS_REFUNDING = "refunding"
+	ESCROW_STATUS_PAYING    = "paying"
+
+	ESCROW_ENTRY_DEBIT  = "debit"
+	ESCROW_ENTRY_REFUND = "refund"
+	ESCROW_ENTRY_PAYOUT = "payout"
+	ESCROW_ENTRY_RAKE   = "rake"
+)
+
+// EscrowEntry is a single movement of coins between a wallet and the escrow of a match
+type EscrowEntry struct {
+	UserID   string
+	Type     string
+	Amount   float64
+	Reason   string
+	DateTime time.Time
+}
+
+// MatchEscrow is the auditable ledger of the entry fees held for a match, the terms are copied from the reward rule
+// when the fees are collected so later rule changes do not affect the match
+type MatchEscrow struct {
+	MatchID    string
+	RewardRule string
+	Currency   string
+	EntryFee   float64
+	HouseRake  float64
+	Pool       float64
+	Status     string
+	Entries    []*EscrowEntry
+	Version    string
+}
+
+func init() {
+	registerMatchTransitionHook(MATCH_PHASE_CANCELED, func(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, transition *MatchTransition) error {
+		return refundMatchEscrow(ctx, nk, matchState, transition.Reason)
+	})
+}
+
+func readMatchEscrow(ctx context.Context, nk runtime.NakamaModule, matchID string) (*MatchEscrow, error) {
+	var escrow *MatchEscrow
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: MATCH_ESCROW_COLLECTION,
+		Key:        matchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &escrow); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	escrow.Version = storageObjects[0].Version
+	return escrow, nil
+}
+
+func writeMatchEscrow(ctx context.Context, nk runtime.NakamaModule, escrow *MatchEscrow) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      MATCH_ESCROW_COLLECTION,
+			Key:             escrow.MatchID,
+			Value:           string(Marshal(escrow)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         escrow.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for escrow of match %v", escrow.MatchID)
+	}
+	escrow.Version = acks[0].Version
+	return nil
+}
+
+func getEscrowWalletUpdate(escrow *MatchEscrow, entry *EscrowEntry, amount float64) *runtime.WalletUpdate {
+	return &runtime.WalletUpdate{
+		UserID:    entry.UserID,
+		Changeset: map[string]interface{}{escrow.Currency: amount},
+		Metadata: map[string]interface{}{
+			"MatchID":    escrow.MatchID,
+			"RewardRule": escrow.RewardRule,
+			"Escrow":     entry.Type,
+			"Amount":     entry.Amount,
+			"Reason":     entry.Reason,
+		},
+	}
+}
+
+// collectEntryFees debits the entry fee of the reward rule from every user of the match into the match escrow
+func collectEntryFees(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) error {
+	rule, err := readRewardRule(ctx, nk, s)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if rule.EntryFee <= 0 {
+		return nil
+	}
+
+	escrow := &MatchEscrow{
+		MatchID:    s.MatchID,
+		RewardRule: rule.Name,
+		Currency:   rule.Currency,
+		EntryFee:   rule.EntryFee,
+		HouseRake:  rule.HouseRake,
+		Status:     ESCROW_STATUS_HELD,
+		Version:    "*",
+	}
+	var walletUpdates []*runtime.WalletUpdate
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		entry := &EscrowEntry{
+			UserID:   teamUser.User.Nakama.ID,
+			Type:     ESCROW_ENTRY_DEBIT,
+			Amount:   rule.EntryFee,
+			Reason:   "entry fee",
+			DateTime: matchClock.Now().UTC(),
+		}
+		escrow.Entries = append(escrow.Entries, entry)
+		escrow.Pool += entry.Amount
+		walletUpdates = append(walletUpdates, getEscrowWalletUpdate(escrow, entry, -entry.Amount))
+	}
+
+	if err := nk.WalletsUpdate(ctx, walletUpdates, true); err != nil {
+		log.Errorf("failed to collect entry fees: %v", err)
+		return runtime.NewError(fmt.Sprintf("Unable to collect the entry fee of %v %v for match **%v**", rule.EntryFee, rule.Currency, s.MatchID), 9)
+	}
+	if err := writeMatchEscrow(ctx, nk, escrow); err != nil {
+		log.Error(err)
+		for _, walletUpdate := range walletUpdates {
+			walletUpdate.Changeset[escrow.Currency] = rule.EntryFee
+			walletUpdate.Metadata["Escrow"] = ESCROW_ENTRY_REFUND
+		}
+		if err := nk.WalletsUpdate(ctx, walletUpdates, true); err != nil {
+			log.Errorf("failed to return entry fees: %v", err)
+		}
+		return err
+	}
+	log.Infof("match_id: %v escrow holds %v %v", s.MatchID, escrow.Pool, escrow.Currency)
+	return nil
+}
+
+// cancelMatchAfterEntryFeeFailure cancels a match which could not be created because the entry fees were not collected
+func cancelMatchAfterEntryFeeFailure(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, reason error) error {
+	s.Active = false
+	if err := transitionMatch(ctx, nk, s, MATCH_PHASE_CANCELED, "entry fee not collected", ""); err != nil {
+		log.Error(err)
+	}
+	if err := notifyDiscordUsers(
+		nakamaCommands.GetUsersFromMatch(s),
+		fmt.Sprintf("Match **%v** was canceled: %v", s.MatchID, reason.Error())); err != nil {
+		log.Error(err)
+	}
+	return stopMatch(ctx, nk, s)
+}
+
+// refundMatchEscrow returns the held entry fees to the users, it does nothing when no fees are held
+func refundMatchEscrow(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, reason string) error {
+	escrow, err := readMatchEscrow(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if escrow == nil {
+		return nil
+	}
+	switch escrow.Status {
+	case ESCROW_STATUS_HELD:
+	case ESCROW_STATUS_REFUNDING:
+		_, err := settleMatchEscrow(ctx, nk, escrow)
+		return err
+	default:
+		return nil
+	}
+
+	for _, debit := range escrow.Entries {
+		if debit.Type != ESCROW_ENTRY_DEBIT {
+			continue
+		}
+		escrow.Entries = append(escrow.Entries, &EscrowEntry{
+			UserID:   debit.UserID,
+			Type:     ESCROW_ENTRY_REFUND,
+			Amount:   debit.Amount,
+			Reason:   reason,
+			DateTime: matchClock.Now().UTC(),
+		})
+	}
+	escrow.Status = ESCROW_STATUS_REFUNDING
+	escrow.Pool = 0
+	if err := writeMatchEscrow(ctx, nk, escrow); err != nil {
+		log.Error(err)
+		return err
+	}
+	if _, err := settleMatchEscrow(ctx, nk, escrow); err != nil {
+		return err
+	}
+	log.Infof("match_id: %v escrow refunded: %v", s.MatchID, reason)
+	return nil
+}
+
+// getEscrowContributors returns the users who paid the entry fee of the match
+func getEscrowContributors(escrow *MatchEscrow) []string {
+	var userIDs []string
+	for _, entry := range escrow.Entries {
+		if entry.Type == ESCROW_ENTRY_DEBIT {
+			userIDs = append(userIDs, entry.UserID)
+		}
+	}
+	return userIDs
+}
+
+// getEscrowPayoutUserIDs returns the contributors who share the prize pool, the contributors of the winner team or
+// every contributor on a draw. Users who joined the match after the fees were collected do not share the pool,
+// when none of the winners paid the fee the pool is split between all contributors.
+func getEscrowPayoutUserIDs(escrow *MatchEscrow, winnerTeam *nakamaCommands.Team) []string {
+	contributors := getEscrowContributors(escrow)
+	if winnerTeam == nil {
+		return contributors
+	}
+	var userIDs []string
+	for _, userID := range contributors {
+		for _, teamUser := range winnerTeam.TeamUsers {
+			if teamUser.User.Nakama.ID == userID {
+				userIDs = append(userIDs, userID)
+				break
+			}
+		}
+	}
+	if len(userIDs) == 0 {
+		return contributors
+	}
+	return userIDs
+}
+
+// payoutMatchEscrow pays the prize pool minus the house rake to the contributors of the winner team, or splits it
+// between all contributors on a draw. It returns the amount paid to every user.
+func payoutMatchEscrow(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, winnerTeam *nakamaCommands.Team) (map[string]float64, error) {
+	escrow, err := readMatchEscrow(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if escrow == nil {
+		return map[string]float64{}, nil
+	}
+	switch escrow.Status {
+	case ESCROW_STATUS_HELD:
+	case ESCROW_STATUS_PAYING:
+		return settleMatchEscrow(ctx, nk, escrow)
+	case ESCROW_STATUS_PAID:
+		return getEscrowAmounts(escrow, ESCROW_ENTRY_PAYOUT), nil
+	default:
+		return map[string]float64{}, nil
+	}
+
+	userIDs := getEscrowPayoutUserIDs(escrow, winnerTeam)
+	if len(userIDs) == 0 {
+		return map[string]float64{}, nil
+	}
+
+	rake := escrow.Pool * escrow.HouseRake
+	share := (escrow.Pool - rake) / float64(len(userIDs))
+	for _, userID := range userIDs {
+		escrow.Entries = append(escrow.Entries, &EscrowEntry{
+			UserID:   userID,
+			Type:     ESCROW_ENTRY_PAYOUT,
+			Amount:   share,
+			Reason:   "prize pool",
+			DateTime: matchClock.Now().UTC(),
+		})
+	}
+	if rake > 0 {
+		escrow.Entries = append(escrow.Entries, &EscrowEntry{
+			UserID:   nakamaContext.NakamaSystemUserID,
+			Type:     ESCROW_ENTRY_RAKE,
+			Amount:   rake,
+			Reason:   "house rake",
+			DateTime: matchClock.Now().UTC(),
+		})
+	}
+
+	escrow.Status = ESCROW_STATUS_PAYING
+	escrow.Pool = 0
+	if err := writeMatchEscrow(ctx, nk, escrow); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	payouts, err := settleMatchEscrow(ctx, nk, escrow)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof("match_id: %v prize pool paid, %v per user, rake %v", s.MatchID, share, rake)
+	return payouts, nil
+}
+
+// getEscrowAmounts returns the amount of the entries of a type for every user
+func getEscrowAmounts(escrow *MatchEscrow, entryType string) map[string]float64 {
+	amounts := make(map[string]float64)
+	for _, entry := range escrow.Entries {
+		if entry.Type == entryType {
+			amounts[entry.UserID] += entry.Amount
+		}
+	}
+	return amounts
+}
+
+// getEscrowSettlement returns the entry type credited and the final status of an escrow being paid out or refunded
+func getEscrowSettlement(status string) (string, string) {
+	if status == ESCROW_STATUS_REFUNDING {
+		return ESCROW_ENTRY_REFUND, ESCROW_STATUS_REFUNDED
+	}
+	return ESCROW_ENTRY_PAYOUT, ESCROW_STATUS_PAID
+}
+
+// listWalletLedger returns every item of the wallet ledger of the user, following the cursor until the last page
+func listWalletLedger(ctx context.Context, nk runtime.NakamaModule, userID string) ([]runtime.WalletLedgerItem, error) {
+	var items []runtime.WalletLedgerItem
+	cursor := ""
+	for {
+		page, nextCursor, err := nk.WalletLedgerList(ctx, userID, nakamaCommands.MAX_LIST_LIMIT, cursor)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		items = append(items, page...)
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	return items, nil
+}
+
+func hasEscrowWalletEntry(items []runtime.WalletLedgerItem, matchID string, entryType string) bool {
+	for _, item := range items {
+		metadata := item.GetMetadata()
+		if metadata["MatchID"] == matchID && metadata["Escrow"] == entryType {
+			return true
+		}
+	}
+	return false
+}
+
+// settleMatchEscrow credits the wallets for the entries recorded when the escrow was marked as paying or refunding and
+// then marks it as paid or refunded. Entries already found in the wallet ledger of a user are skipped, so an interrupted
+// settlement can be resumed. It returns the amount credited to every user.
+func settleMatchEscrow(ctx context.Context, nk runtime.NakamaModule, escrow *MatchEscrow) (map[string]float64, error) {
+	entryType, status := getEscrowSettlement(escrow.Status)
+	var walletUpdates []*runtime.WalletUpdate
+	for _, entry := range escrow.Entries {
+		if entry.Type != entryType {
+			continue
+		}
+		items, err := listWalletLedger(ctx, nk, entry.UserID)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if hasEscrowWalletEntry(items, escrow.MatchID, entryType) {
+			log.Infof("match_id: %v escrow %v already credited to %v", escrow.MatchID, entryType, entry.UserID)
+			continue
+		}
+		walletUpdates = append(walletUpdates, getEscrowWalletUpdate(escrow, entry, entry.Amount))
+	}
+	if len(walletUpdates) > 0 {
+		if err := nk.WalletsUpdate(ctx, walletUpdates, true); err != nil {
+			log.Errorf("failed to settle the escrow of match %v: %v", escrow.MatchID, err)
+			return nil, err
+		}
+	}
+	escrow.Status = status
+	if err := writeMatchEscrow(ctx, nk, escrow); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return getEscrowAmounts(escrow, entryType), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func TestListWalletLedgerPages(t *testing.T) {
+	ctx := context.Background()
+	nk := NewFakeNakamaModule()
+	userID := nk.AddUser("ledger", "ledger")
+	count := 2*nakamaCommands.MAX_LIST_LIMIT + 1
+	for i := 0; i < count; i++ {
+		if err := nk.WalletsUpdate(ctx, []*runtime.WalletUpdate{&runtime.WalletUpdate{
+			UserID:    userID,
+			Changeset: map[string]interface{}{REWARD_CURRENCY_COINS: 1},
+			Metadata:  map[string]interface{}{"MatchID": fmt.Sprintf("match-%v", i), "Escrow": ESCROW_ENTRY_PAYOUT},
+		}}, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, cursor, err := nk.WalletLedgerList(ctx, userID, nakamaCommands.MAX_LIST_LIMIT, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page) != nakamaCommands.MAX_LIST_LIMIT || cursor == "" {
+		t.Fatalf("expected a full first page with a cursor, got %v items and cursor %q", len(page), cursor)
+	}
+
+	items, err := listWalletLedger(ctx, nk, userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != count {
+		t.Errorf("expected %v ledger items, got %v", count, len(items))
+	}
+	if !hasEscrowWalletEntry(items, fmt.Sprintf("match-%v", count-1), ESCROW_ENTRY_PAYOUT) {
+		t.Error("expected the entry of the last page to be found")
+	}
+}
@@ -0,0 +1,870 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes/empty"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/golang/protobuf/ptypes/wrappers"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+	"google.golang.org/grpc"
+	"open-match.dev/open-match/pkg/pb"
+)
+
+// The fakes below let the match flow run in memory without Nakama, Discord or Open Match.
+// They embed the interface they fake, so calling a method which is not faked panics on the nil embedded value.
+
+var (
+	errFakeStorageVersion = errors.New("Storage write rejected - version check failed.")
+	errFakeNoRows         = errors.New("sql: no rows in result set")
+)
+
+type fakeStorageKey struct {
+	Collection string
+	Key        string
+	UserID     string
+}
+
+type fakeLeaderboard struct {
+	ID          string
+	SortOrder   string
+	Operator    string
+	Metadata    map[string]interface{}
+	Title       string
+	MaxNumScore int
+	Records     map[string]*api.LeaderboardRecord
+}
+
+type fakeWalletLedgerItem struct {
+	runtime.WalletLedgerItem
+	UserID    string
+	Changeset map[string]interface{}
+	Metadata  map[string]interface{}
+}
+
+func (i *fakeWalletLedgerItem) GetMetadata() map[string]interface{} {
+	return i.Metadata
+}
+
+// FakeNakamaModule is an in-memory runtime.NakamaModule with versioned storage, wallets, leaderboards and tournaments
+type FakeNakamaModule struct {
+	runtime.NakamaModule
+
+	mu            sync.Mutex
+	clock         Clock
+	accounts      map[string]*api.Account
+	storage       map[fakeStorageKey]*api.StorageObject
+	wallets       map[string]map[string]float64
+	walletLedger  map[string][]runtime.WalletLedgerItem
+	leaderboards  map[string]*fakeLeaderboard
+	tournaments   map[string]*fakeLeaderboard
+	matches       map[string]map[string]interface{}
+	notifications int
+	next          int
+}
+
+func NewFakeNakamaModule() *FakeNakamaModule {
+	return &FakeNakamaModule{
+		clock:        systemClock{},
+		accounts:     make(map[string]*api.Account),
+		storage:      make(map[fakeStorageKey]*api.StorageObject),
+		wallets:      make(map[string]map[string]float64),
+		walletLedger: make(map[string][]runtime.WalletLedgerItem),
+		leaderboards: make(map[string]*fakeLeaderboard),
+		tournaments:  make(map[string]*fakeLeaderboard),
+		matches:      make(map[string]map[string]interface{}),
+	}
+}
+
+// SetClock sets the clock of the create and update times
+func (nk *FakeNakamaModule) SetClock(clock Clock) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	nk.clock = clock
+}
+
+func (nk *FakeNakamaModule) timestamp() *timestamp.Timestamp {
+	return &timestamp.Timestamp{Seconds: nk.clock.Now().Unix()}
+}
+
+// AddUser creates an account with the custom ID and returns its user ID
+func (nk *FakeNakamaModule) AddUser(customID string, username string) string {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	return nk.addUser(customID, username)
+}
+
+func (nk *FakeNakamaModule) addUser(customID string, username string) string {
+	for _, account := range nk.accounts {
+		if account.CustomId == customID {
+			return account.User.Id
+		}
+	}
+	// the user ID is derived from the custom ID so simulation transcripts are reproducible
+	userID := uuid.NewV5(uuid.NamespaceOID, customID).String()
+	nk.accounts[userID] = &api.Account{
+		User: &api.User{
+			Id:          userID,
+			Username:    username,
+			DisplayName: username,
+			CreateTime:  nk.timestamp(),
+			UpdateTime:  nk.timestamp(),
+		},
+		CustomId: customID,
+		Wallet:   "{}",
+	}
+	nk.wallets[userID] = make(map[string]float64)
+	return userID
+}
+
+// Wallet returns a copy of the wallet of the user
+func (nk *FakeNakamaModule) Wallet(userID string) map[string]float64 {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	wallet := make(map[string]float64)
+	for currency, amount := range nk.wallets[userID] {
+		wallet[currency] = amount
+	}
+	return wallet
+}
+
+// Matches returns the params of the authoritative matches created so far keyed by match ID
+func (nk *FakeNakamaModule) Matches() map[string]map[string]interface{} {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	matches := make(map[string]map[string]interface{})
+	for id, params := range nk.matches {
+		matches[id] = params
+	}
+	return matches
+}
+
+func (nk *FakeNakamaModule) AuthenticateCustom(ctx context.Context, id, username string, create bool) (string, string, bool, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	for _, account := range nk.accounts {
+		if account.CustomId == id {
+			return account.User.Id, account.User.Username, false, nil
+		}
+	}
+	if !create {
+		return "", "", false, errors.New("User account not found.")
+	}
+	userID := nk.addUser(id, username)
+	return userID, username, true, nil
+}
+
+func (nk *FakeNakamaModule) AccountGetId(ctx context.Context, userID string) (*api.Account, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	account, ok := nk.accounts[userID]
+	if !ok {
+		return nil, errors.New("account not found")
+	}
+	copied := *account
+	user := *account.User
+	copied.User = &user
+	copied.Wallet = string(Marshal(nk.wallets[userID]))
+	return &copied, nil
+}
+
+func (nk *FakeNakamaModule) AccountUpdateId(ctx context.Context, userID, username string, metadata map[string]interface{}, displayName, timezone, location, langTag, avatarUrl string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	account, ok := nk.accounts[userID]
+	if !ok {
+		return errors.New("account not found")
+	}
+	if username != "" {
+		account.User.Username = username
+	}
+	if displayName != "" {
+		account.User.DisplayName = displayName
+	}
+	if metadata != nil {
+		account.User.Metadata = string(Marshal(metadata))
+	}
+	account.User.Timezone = timezone
+	account.User.Location = location
+	account.User.LangTag = langTag
+	account.User.AvatarUrl = avatarUrl
+	account.User.UpdateTime = nk.timestamp()
+	return nil
+}
+
+func (nk *FakeNakamaModule) UsersGetId(ctx context.Context, userIDs []string) ([]*api.User, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	var users []*api.User
+	for _, userID := range userIDs {
+		if account, ok := nk.accounts[userID]; ok {
+			users = append(users, account.User)
+		}
+	}
+	return users, nil
+}
+
+func (nk *FakeNakamaModule) UsersGetUsername(ctx context.Context, usernames []string) ([]*api.User, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	var users []*api.User
+	for _, username := range usernames {
+		for _, account := range nk.accounts {
+			if account.User.Username == username {
+				users = append(users, account.User)
+			}
+		}
+	}
+	return users, nil
+}
+
+func (nk *FakeNakamaModule) LinkEmail(ctx context.Context, userID, email, password string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	for id, account := range nk.accounts {
+		if account.Email == email && id != userID {
+			return errors.New("Email is already in use.")
+		}
+	}
+	account, ok := nk.accounts[userID]
+	if !ok {
+		return errors.New("account not found")
+	}
+	account.Email = email
+	return nil
+}
+
+func (nk *FakeNakamaModule) UnlinkEmail(ctx context.Context, userID, email string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	if account, ok := nk.accounts[userID]; ok && account.Email == email {
+		account.Email = ""
+	}
+	return nil
+}
+
+// LinkSteam treats the token as the Steam ID
+func (nk *FakeNakamaModule) LinkSteam(ctx context.Context, userID, token string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	for id, account := range nk.accounts {
+		if account.User.SteamId == token && id != userID {
+			return errors.New("Steam ID is already in use.")
+		}
+	}
+	account, ok := nk.accounts[userID]
+	if !ok {
+		return errors.New("account not found")
+	}
+	account.User.SteamId = token
+	return nil
+}
+
+func (nk *FakeNakamaModule) UnlinkSteam(ctx context.Context, userID, token string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	if account, ok := nk.accounts[userID]; ok && account.User.SteamId == token {
+		account.User.SteamId = ""
+	}
+	return nil
+}
+
+func (nk *FakeNakamaModule) MatchCreate(ctx context.Context, module string, params map[string]interface{}) (string, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	nk.next++
+	matchID := fmt.Sprintf("match-%v.%v", nk.next, module)
+	nk.matches[matchID] = params
+	return matchID, nil
+}
+
+func (nk *FakeNakamaModule) NotificationsSend(ctx context.Context, notifications []*runtime.NotificationSend) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	nk.notifications += len(notifications)
+	return nil
+}
+
+func getFakeStorageVersion(value string) string {
+	return fmt.Sprintf("%x", md5.Sum([]byte(value)))
+}
+
+// checkStorageVersion applies the Nakama rules: "" writes unconditionally, "*" only creates, anything else must match
+func checkFakeStorageVersion(object *api.StorageObject, version string) error {
+	switch {
+	case version == "":
+		return nil
+	case version == "*" && object == nil:
+		return nil
+	case version != "*" && object != nil && object.Version == version:
+		return nil
+	}
+	return errFakeStorageVersion
+}
+
+func (nk *FakeNakamaModule) StorageRead(ctx context.Context, reads []*runtime.StorageRead) ([]*api.StorageObject, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	var objects []*api.StorageObject
+	for _, read := range reads {
+		if object, ok := nk.storage[fakeStorageKey{read.Collection, read.Key, read.UserID}]; ok {
+			copied := *object
+			objects = append(objects, &copied)
+		}
+	}
+	return objects, nil
+}
+
+func (nk *FakeNakamaModule) StorageWrite(ctx context.Context, writes []*runtime.StorageWrite) ([]*api.StorageObjectAck, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	for _, write := range writes {
+		if err := checkFakeStorageVersion(nk.storage[fakeStorageKey{write.Collection, write.Key, write.UserID}], write.Version); err != nil {
+			return nil, err
+		}
+	}
+	var acks []*api.StorageObjectAck
+	for _, write := range writes {
+		key := fakeStorageKey{write.Collection, write.Key, write.UserID}
+		createTime := nk.timestamp()
+		if object, ok := nk.storage[key]; ok {
+			createTime = object.CreateTime
+		}
+		object := &api.StorageObject{
+			Collection:      write.Collection,
+			Key:             write.Key,
+			UserId:          write.UserID,
+			Value:           write.Value,
+			Version:         getFakeStorageVersion(write.Value),
+			PermissionRead:  int32(write.PermissionRead),
+			PermissionWrite: int32(write.PermissionWrite),
+			CreateTime:      createTime,
+			UpdateTime:      nk.timestamp(),
+		}
+		nk.storage[key] = object
+		acks = append(acks, &api.StorageObjectAck{
+			Collection: object.Collection,
+			Key:        object.Key,
+			Version:    object.Version,
+			UserId:     object.UserId,
+		})
+	}
+	return acks, nil
+}
+
+func (nk *FakeNakamaModule) StorageDelete(ctx context.Context, deletes []*runtime.StorageDelete) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	for _, d := range deletes {
+		object, ok := nk.storage[fakeStorageKey{d.Collection, d.Key, d.UserID}]
+		if ok && d.Version != "" && object.Version != d.Version {
+			return errFakeStorageVersion
+		}
+	}
+	for _, d := range deletes {
+		delete(nk.storage, fakeStorageKey{d.Collection, d.Key, d.UserID})
+	}
+	return nil
+}
+
+// StorageList lists the objects of the collection ordered by key, the cursor is the offset of the next page
+func (nk *FakeNakamaModule) StorageList(ctx context.Context, userID, collection string, limit int, cursor string) ([]*api.StorageObject, string, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	var objects []*api.StorageObject
+	for key, object := range nk.storage {
+		if key.Collection == collection && (userID == "" || key.UserID == userID) {
+			copied := *object
+			objects = append(objects, &copied)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if objects[i].UserId != objects[j].UserId {
+			return objects[i].UserId < objects[j].UserId
+		}
+		return objects[i].Key < objects[j].Key
+	})
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, "", errors.New("invalid cursor")
+		}
+	}
+	if offset > len(objects) {
+		offset = len(objects)
+	}
+	objects = objects[offset:]
+	nextCursor := ""
+	if limit > 0 && len(objects) > limit {
+		objects = objects[:limit]
+		nextCursor = strconv.Itoa(offset + limit)
+	}
+	return objects, nextCursor, nil
+}
+
+func getFakeAmount(value interface{}) float64 {
+	switch v := value.(type) {
+	case float64:
+		return v
+	case float32:
+		return float64(v)
+	case int:
+		return float64(v)
+	case int64:
+		return float64(v)
+	}
+	return 0
+}
+
+// WalletsUpdate applies all the updates or none, an update leaving a negative balance is rejected
+func (nk *FakeNakamaModule) WalletsUpdate(ctx context.Context, updates []*runtime.WalletUpdate, updateLedger bool) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	balances := make(map[string]map[string]float64)
+	for _, update := range updates {
+		wallet, ok := balances[update.UserID]
+		if !ok {
+			current, ok := nk.wallets[update.UserID]
+			if !ok {
+				return fmt.Errorf("wallet of user %v not found", update.UserID)
+			}
+			wallet = make(map[string]float64)
+			for currency, amount := range current {
+				wallet[currency] = amount
+			}
+			balances[update.UserID] = wallet
+		}
+		for currency, value := range update.Changeset {
+			wallet[currency] += getFakeAmount(value)
+			if wallet[currency] < 0 {
+				return fmt.Errorf("wallet update rejected negative value for user %v", update.UserID)
+			}
+		}
+	}
+	for userID, wallet := range balances {
+		nk.wallets[userID] = wallet
+	}
+	if updateLedger {
+		for _, update := range updates {
+			nk.walletLedger[update.UserID] = append(nk.walletLedger[update.UserID], &fakeWalletLedgerItem{
+				UserID:    update.UserID,
+				Changeset: update.Changeset,
+				Metadata:  update.Metadata,
+			})
+		}
+	}
+	return nil
+}
+
+// WalletLedgerList pages through the ledger in insertion order, the cursor is the offset of the next page
+func (nk *FakeNakamaModule) WalletLedgerList(ctx context.Context, userID string, limit int, cursor string) ([]runtime.WalletLedgerItem, string, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	items := nk.walletLedger[userID]
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 || offset > len(items) {
+			return nil, "", errors.New("invalid cursor")
+		}
+	}
+	items = items[offset:]
+	nextCursor := ""
+	if limit > 0 && len(items) > limit {
+		items = items[:limit]
+		nextCursor = strconv.Itoa(offset + limit)
+	}
+	return append([]runtime.WalletLedgerItem{}, items...), nextCursor, nil
+}
+
+func (nk *FakeNakamaModule) LeaderboardCreate(ctx context.Context, id string, authoritative bool, sortOrder, operator, resetSchedule string, metadata map[string]interface{}) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	if _, ok := nk.leaderboards[id]; !ok {
+		nk.leaderboards[id] = &fakeLeaderboard{
+			ID:        id,
+			SortOrder: sortOrder,
+			Operator:  operator,
+			Metadata:  metadata,
+			Records:   make(map[string]*api.LeaderboardRecord),
+		}
+	}
+	return nil
+}
+
+func (nk *FakeNakamaModule) LeaderboardDelete(ctx context.Context, id string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	delete(nk.leaderboards, id)
+	return nil
+}
+
+func (nk *FakeNakamaModule) LeaderboardRecordWrite(ctx context.Context, id, ownerID, username string, score, subscore int64, metadata map[string]interface{}) (*api.LeaderboardRecord, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	leaderboard, ok := nk.leaderboards[id]
+	if !ok {
+		return nil, errors.New("leaderboard not found")
+	}
+	return nk.writeRecord(leaderboard, ownerID, username, score, subscore, metadata)
+}
+
+func (nk *FakeNakamaModule) LeaderboardRecordDelete(ctx context.Context, id, ownerID string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	if leaderboard, ok := nk.leaderboards[id]; ok {
+		delete(leaderboard.Records, ownerID)
+	}
+	return nil
+}
+
+func (nk *FakeNakamaModule) LeaderboardRecordsList(ctx context.Context, id string, ownerIDs []string, limit int, cursor string, expiry int64) ([]*api.LeaderboardRecord, []*api.LeaderboardRecord, string, string, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	leaderboard, ok := nk.leaderboards[id]
+	if !ok {
+		leaderboard, ok = nk.tournaments[id]
+	}
+	if !ok {
+		return nil, nil, "", "", errors.New("leaderboard not found")
+	}
+
+	records := leaderboard.rankedRecords()
+	var ownerRecords []*api.LeaderboardRecord
+	for _, record := range records {
+		for _, ownerID := range ownerIDs {
+			if record.OwnerId == ownerID {
+				ownerRecords = append(ownerRecords, record)
+			}
+		}
+	}
+	offset := 0
+	if cursor != "" {
+		var err error
+		if offset, err = strconv.Atoi(cursor); err != nil || offset < 0 {
+			return nil, nil, "", "", errors.New("invalid cursor")
+		}
+	}
+	if offset > len(records) {
+		offset = len(records)
+	}
+	records = records[offset:]
+	nextCursor := ""
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+		nextCursor = strconv.Itoa(offset + limit)
+	}
+	prevCursor := ""
+	if offset > 0 {
+		prevCursor = strconv.Itoa(offset - limit)
+		if offset-limit < 0 {
+			prevCursor = "0"
+		}
+	}
+	return records, ownerRecords, nextCursor, prevCursor, nil
+}
+
+func (nk *FakeNakamaModule) TournamentCreate(ctx context.Context, id string, sortOrder, operator, resetSchedule string, metadata map[string]interface{}, title, description string, category, startTime, endTime, duration, maxSize, maxNumScore int, joinRequired bool) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	if _, ok := nk.tournaments[id]; ok {
+		return errors.New("tournament already exists")
+	}
+	nk.tournaments[id] = &fakeLeaderboard{
+		ID:          id,
+		SortOrder:   sortOrder,
+		Operator:    operator,
+		Metadata:    metadata,
+		Title:       title,
+		MaxNumScore: maxNumScore,
+		Records:     make(map[string]*api.LeaderboardRecord),
+	}
+	return nil
+}
+
+func (nk *FakeNakamaModule) TournamentDelete(ctx context.Context, id string) error {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	delete(nk.tournaments, id)
+	return nil
+}
+
+func (nk *FakeNakamaModule) TournamentsGetId(ctx context.Context, tournamentIDs []string) ([]*api.Tournament, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	var tournaments []*api.Tournament
+	for _, id := range tournamentIDs {
+		if tournament, ok := nk.tournaments[id]; ok {
+			tournaments = append(tournaments, &api.Tournament{Id: tournament.ID, Title: tournament.Title})
+		}
+	}
+	return tournaments, nil
+}
+
+func (nk *FakeNakamaModule) TournamentRecordWrite(ctx context.Context, id, ownerID, username string, score, subscore int64, metadata map[string]interface{}) (*api.LeaderboardRecord, error) {
+	nk.mu.Lock()
+	defer nk.mu.Unlock()
+	tournament, ok := nk.tournaments[id]
+	if !ok {
+		return nil, errors.New("tournament not found")
+	}
+	if record, ok := tournament.Records[ownerID]; ok && tournament.MaxNumScore > 0 && int(record.NumScore) >= tournament.MaxNumScore {
+		return nil, errors.New("max number score count reached")
+	}
+	return nk.writeRecord(tournament, ownerID, username, score, subscore, metadata)
+}
+
+// writeRecord applies the operator of the leaderboard, a "best" write which does not improve the record fails like Nakama does
+func (nk *FakeNakamaModule) writeRecord(leaderboard *fakeLeaderboard, ownerID, username string, score, subscore int64, metadata map[string]interface{}) (*api.LeaderboardRecord, error) {
+	record, ok := leaderboard.Records[ownerID]
+	if !ok {
+		record = &api.LeaderboardRecord{
+			LeaderboardId: leaderboard.ID,
+			OwnerId:       ownerID,
+			CreateTime:    nk.timestamp(),
+		}
+		leaderboard.Records[ownerID] = record
+	} else {
+		switch leaderboard.Operator {
+		case LEADERBOARD_OPERATOR_INCR:
+			score += record.Score
+			subscore += record.Subscore
+		case LEADERBOARD_OPERATOR_DECR:
+			score = record.Score - score
+			subscore = record.Subscore - subscore
+		case LEADERBOARD_OPERATOR_BEST:
+			better := score > record.Score || (score == record.Score && subscore > record.Subscore)
+			if leaderboard.SortOrder == LEADERBOARD_SORT_ORDER_ASC {
+				better = score < record.Score || (score == record.Score && subscore < record.Subscore)
+			}
+			if !better {
+				return nil, errFakeNoRows
+			}
+		}
+	}
+	record.Username = &wrappers.StringValue{Value: username}
+	record.Score = score
+	record.Subscore = subscore
+	record.NumScore++
+	if metadata != nil {
+		record.Metadata = string(Marshal(metadata))
+	}
+	record.UpdateTime = nk.timestamp()
+	copied := *record
+	return &copied, nil
+}
+
+func (l *fakeLeaderboard) rankedRecords() []*api.LeaderboardRecord {
+	var records []*api.LeaderboardRecord
+	for _, record := range l.Records {
+		copied := *record
+		records = append(records, &copied)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Score != records[j].Score {
+			if l.SortOrder == LEADERBOARD_SORT_ORDER_ASC {
+				return records[i].Score < records[j].Score
+			}
+			return records[i].Score > records[j].Score
+		}
+		if records[i].Subscore != records[j].Subscore {
+			if l.SortOrder == LEADERBOARD_SORT_ORDER_ASC {
+				return records[i].Subscore < records[j].Subscore
+			}
+			return records[i].Subscore > records[j].Subscore
+		}
+		return records[i].OwnerId < records[j].OwnerId
+	})
+	for i, record := range records {
+		record.Rank = int64(i + 1)
+	}
+	return records
+}
+
+// FakeClock is a Clock which only moves when it is advanced
+type FakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// FakeDiscordMessage is a message the fake Discord notifier received
+type FakeDiscordMessage struct {
+	ChannelID string
+	Content   string
+	Embed     *discordgo.MessageEmbed
+}
+
+// FakeDiscordNotifier records the messages and channels instead of calling Discord
+type FakeDiscordNotifier struct {
+	mu       sync.Mutex
+	channels map[string]*discordgo.Channel
+	messages []*FakeDiscordMessage
+	next     int
+}
+
+func NewFakeDiscordNotifier() *FakeDiscordNotifier {
+	return &FakeDiscordNotifier{channels: make(map[string]*discordgo.Channel)}
+}
+
+// Messages returns the messages sent so far in order
+func (d *FakeDiscordNotifier) Messages() []*FakeDiscordMessage {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]*FakeDiscordMessage{}, d.messages...)
+}
+
+func (d *FakeDiscordNotifier) nextID(prefix string) string {
+	d.next++
+	return fmt.Sprintf("%v-%v", prefix, d.next)
+}
+
+func (d *FakeDiscordNotifier) send(message *FakeDiscordMessage) *discordgo.Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.messages = append(d.messages, message)
+	return &discordgo.Message{ID: d.nextID("message"), ChannelID: message.ChannelID, Content: message.Content}
+}
+
+func (d *FakeDiscordNotifier) Channel(channelID string) (*discordgo.Channel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	channel, ok := d.channels[channelID]
+	if !ok {
+		return nil, fmt.Errorf("channel %v not found", channelID)
+	}
+	return channel, nil
+}
+
+func (d *FakeDiscordNotifier) ChannelDelete(channelID string) (*discordgo.Channel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	channel, ok := d.channels[channelID]
+	if !ok {
+		return nil, fmt.Errorf("channel %v not found", channelID)
+	}
+	delete(d.channels, channelID)
+	return channel, nil
+}
+
+func (d *FakeDiscordNotifier) ChannelInviteCreate(channelID string, i discordgo.Invite) (*discordgo.Invite, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	channel, ok := d.channels[channelID]
+	if !ok {
+		return nil, fmt.Errorf("channel %v not found", channelID)
+	}
+	return &discordgo.Invite{Code: d.nextID("invite"), Channel: channel}, nil
+}
+
+func (d *FakeDiscordNotifier) ChannelMessageSend(channelID string, content string) (*discordgo.Message, error) {
+	return d.send(&FakeDiscordMessage{ChannelID: channelID, Content: content}), nil
+}
+
+func (d *FakeDiscordNotifier) ChannelMessageSendEmbed(channelID string, embed *discordgo.MessageEmbed) (*discordgo.Message, error) {
+	return d.send(&FakeDiscordMessage{ChannelID: channelID, Content: embed.Description, Embed: embed}), nil
+}
+
+func (d *FakeDiscordNotifier) ChannelMessageDelete(channelID string, messageID string) error {
+	return nil
+}
+
+func (d *FakeDiscordNotifier) GuildChannelCreateComplex(guildID string, data discordgo.GuildChannelCreateData) (*discordgo.Channel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	channel := &discordgo.Channel{
+		ID:      d.nextID("channel"),
+		GuildID: guildID,
+		Name:    data.Name,
+		Topic:   data.Topic,
+		Type:    data.Type,
+	}
+	d.channels[channel.ID] = channel
+	return channel, nil
+}
+
+func (d *FakeDiscordNotifier) UserChannelCreate(recipientID string) (*discordgo.Channel, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	channel := &discordgo.Channel{ID: "dm-" + recipientID, Type: discordgo.ChannelTypeDM}
+	d.channels[channel.ID] = channel
+	return channel, nil
+}
+
+// FakeOpenMatchFrontend keeps the tickets in memory, only CreateTicket, GetTicket and DeleteTicket are faked
+type FakeOpenMatchFrontend struct {
+	pb.FrontendServiceClient
+
+	mu      sync.Mutex
+	tickets map[string]*pb.Ticket
+	next    int
+}
+
+func NewFakeOpenMatchFrontend() *FakeOpenMatchFrontend {
+	return &FakeOpenMatchFrontend{tickets: make(map[string]*pb.Ticket)}
+}
+
+func (f *FakeOpenMatchFrontend) CreateTicket(ctx context.Context, in *pb.CreateTicketRequest, opts ...grpc.CallOption) (*pb.Ticket, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if in.Ticket == nil {
+		return nil, errors.New("ticket is required")
+	}
+	ticket := *in.Ticket
+	f.next++
+	ticket.Id = fmt.Sprintf("ticket-%v", f.next)
+	f.tickets[ticket.Id] = &ticket
+	return &ticket, nil
+}
+
+func (f *FakeOpenMatchFrontend) GetTicket(ctx context.Context, in *pb.GetTicketRequest, opts ...grpc.CallOption) (*pb.Ticket, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ticket, ok := f.tickets[in.TicketId]
+	if !ok {
+		return nil, fmt.Errorf("ticket %v not found", in.TicketId)
+	}
+	return ticket, nil
+}
+
+func (f *FakeOpenMatchFrontend) DeleteTicket(ctx context.Context, in *pb.DeleteTicketRequest, opts ...grpc.CallOption) (*empty.Empty, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.tickets, in.TicketId)
+	return &empty.Empty{}, nil
+}
+
+// useFakeRuntime replaces Discord and Open Match with in-memory fakes and returns them with a fake Nakama module
+func useFakeRuntime() (*FakeNakamaModule, *FakeDiscordNotifier, *FakeOpenMatchFrontend) {
+	discord := NewFakeDiscordNotifier()
+	setDiscordNotifier(discord)
+	frontend := NewFakeOpenMatchFrontend()
+	setOpenMatchFrontend(frontend)
+	return NewFakeNakamaModule(), discord, frontend
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	firebase "firebase.google.com/go"
+	"firebase.google.com/go/auth"
+	"github.com/gofrs/uuid"
+	common_api "github.com/heroiclabs/nakama-common/api"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+	"google.golang.org/api/option"
+)
+
+const (
+	IDENTITY_VERIFIER_DISCORD  = "discord"
+	IDENTITY_VERIFIER_FIREBASE = "firebase"
+	IDENTITY_VERIFIER_OIDC     = "oidc"
+
+	// IDENTITY_CREDENTIAL_VAR is the account var holding the credential to verify, the username is verified when it is missing
+	IDENTITY_CREDENTIAL_VAR = "Credential"
+
+	OIDC_JWKS_CACHE_DURATION   = time.Hour
+	OIDC_JWKS_REFRESH_INTERVAL = time.Minute
+	OIDC_CLOCK_SKEW            = time.Minute
+)
+
+var (
+	identityVerifier     IdentityVerifier
+	identityVerifierOnce sync.Once
+)
+
+// Identity is what an identity provider vouches for about the player logging in for the first time
+type Identity struct {
+	Subject     string
+	Email       string
+	PhoneNumber string
+}
+
+// IdentityVerifier verifies the credential a player presents on the first login
+type IdentityVerifier interface {
+	Verify(ctx context.Context, in *common_api.AuthenticateCustomRequest, credential string) (*Identity, error)
+}
+
+func errUnauthenticated(format string, args ...interface{}) error {
+	return runtime.NewError(fmt.Sprintf(format, args...), 16)
+}
+
+// getIdentityVerifier returns the verifier chosen by IDENTITY_VERIFIER, Firebase by default
+func getIdentityVerifier() IdentityVerifier {
+	identityVerifierOnce.Do(func() {
+		if identityVerifier != nil {
+			return
+		}
+		config := getConfig()
+		switch config.IdentityVerifier {
+		case IDENTITY_VERIFIER_DISCORD:
+			identityVerifier = &discordIdentityVerifier{}
+		case IDENTITY_VERIFIER_OIDC:
+			identityVerifier = &oidcIdentityVerifier{
+				issuer:   config.OIDCIssuer,
+				audience: config.OIDCAudience,
+				jwksURL:  config.OIDCJWKSURL,
+				client:   &http.Client{Timeout: 10 * time.Second},
+			}
+		default:
+			identityVerifier = &firebaseIdentityVerifier{
+				credentialsFile: config.FirebaseCredentialsFile,
+			}
+		}
+	})
+	return identityVerifier
+}
+
+// setIdentityVerifier replaces the configured verifier, it must be called before the first login is handled
+func setIdentityVerifier(verifier IdentityVerifier) {
+	identityVerifier = verifier
+}
+
+func getIdentityCredential(in *common_api.AuthenticateCustomRequest) string {
+	if val, ok := in.Account.Vars[IDENTITY_CREDENTIAL_VAR]; ok && val != "" {
+		return val
+	}
+	return in.Username
+}
+
+// discordIdentityVerifier trusts the Discord account the bot authenticates, the credential is not verified
+// so no email is linked from it
+type discordIdentityVerifier struct{}
+
+func (v *discordIdentityVerifier) Verify(ctx context.Context, in *common_api.AuthenticateCustomRequest, credential string) (*Identity, error) {
+	return &Identity{Subject: in.Account.Id}, nil
+}
+
+// firebaseIdentityVerifier requires an active Firebase user with a verified email, found by email or UID
+type firebaseIdentityVerifier struct {
+	credentialsFile string
+}
+
+func (v *firebaseIdentityVerifier) Verify(ctx context.Context, in *common_api.AuthenticateCustomRequest, credential string) (*Identity, error) {
+	app, err := firebase.NewApp(context.Background(), nil, option.WithCredentialsFile(v.credentialsFile))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	client, err := app.Auth(context.Background())
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	var user *auth.UserRecord
+	if isEmailValid(credential) {
+		user, err = getFirebaseUserByEmail(client, credential)
+	} else {
+		log.Info("provided firebase credential is not email, try login by uuid")
+		user, err = getFirebaseUserByUID(client, credential)
+	}
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if user == nil {
+		return nil, errUnauthenticated("Firebase user %v not found", credential)
+	}
+	if err := isFirebaseUserActive(user); err != nil {
+		return nil, err
+	}
+	if err := isFirebaseUserVerified(user); err != nil {
+		return nil, err
+	}
+
+	// Update firebase PhotoURL from the discord PhotoURL
+	if val, ok := in.Account.Vars["Author.AvatarUrl"]; ok {
+		firebaseUserToUpdate := &auth.UserToUpdate{}
+		if _, err := client.UpdateUser(context.Background(), user.UID, firebaseUserToUpdate.PhotoURL(val)); err != nil {
+			log.Error(err)
+		}
+	}
+	return &Identity{Subject: user.UID, Email: user.Email, PhoneNumber: user.PhoneNumber}, nil
+}
+
+// oidcIdentityVerifier verifies an RS256 ID token against the keys published by the issuer
+type oidcIdentityVerifier struct {
+	issuer   string
+	audience string
+	jwksURL  string
+	client   *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+type oidcHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type oidcClaims struct {
+	Issuer        string          `json:"iss"`
+	Subject       string          `json:"sub"`
+	Audience      json.RawMessage `json:"aud"`
+	ExpiresAt     int64           `json:"exp"`
+	NotBefore     int64           `json:"nbf"`
+	Email         string          `json:"email"`
+	EmailVerified bool            `json:"email_verified"`
+	PhoneNumber   string          `json:"phone_number"`
+}
+
+type oidcJWKS struct {
+	Keys []struct {
+		Kty string `json:"kty"`
+		Kid string `json:"kid"`
+		N   string `json:"n"`
+		E   string `json:"e"`
+	} `json:"keys"`
+}
+
+func (c *oidcClaims) hasAudience(audience string) bool {
+	var single string
+	if err := json.Unmarshal(c.Audience, &single); err == nil {
+		return single == audience
+	}
+	var multiple []string
+	if err := json.Unmarshal(c.Audience, &multiple); err == nil {
+		for _, v := range multiple {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (v *oidcIdentityVerifier) Verify(ctx context.Context, in *common_api.AuthenticateCustomRequest, credential string) (*Identity, error) {
+	parts := strings.Split(credential, ".")
+	if len(parts) != 3 {
+		return nil, errUnauthenticated("Identity token is malformed")
+	}
+	var header oidcHeader
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, errUnauthenticated("Identity token header is malformed")
+	}
+	if header.Alg != "RS256" {
+		return nil, errUnauthenticated("Identity token algorithm %v is not supported", header.Alg)
+	}
+	key, err := v.getKey(ctx, header.Kid)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errUnauthenticated("Identity token signature is malformed")
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature); err != nil {
+		return nil, errUnauthenticated("Identity token signature is invalid")
+	}
+
+	var claims oidcClaims
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, errUnauthenticated("Identity token claims are malformed")
+	}
+	now := time.Now().UTC()
+	switch {
+	case claims.Issuer != v.issuer:
+		return nil, errUnauthenticated("Identity token issuer %v is not trusted", claims.Issuer)
+	case !claims.hasAudience(v.audience):
+		return nil, errUnauthenticated("Identity token is not issued for %v", v.audience)
+	case now.After(time.Unix(claims.ExpiresAt, 0).Add(OIDC_CLOCK_SKEW)):
+		return nil, errUnauthenticated("Identity token expired")
+	case claims.NotBefore != 0 && now.Add(OIDC_CLOCK_SKEW).Before(time.Unix(claims.NotBefore, 0)):
+		return nil, errUnauthenticated("Identity token is not valid yet")
+	case claims.Subject == "":
+		return nil, errUnauthenticated("Identity token has no subject")
+	}
+
+	identity := &Identity{Subject: claims.Subject, PhoneNumber: claims.PhoneNumber}
+	if claims.EmailVerified {
+		identity.Email = claims.Email
+	}
+	return identity, nil
+}
+
+// getKey returns the key with the kid, the keys are fetched again when they are stale or the kid is unknown
+func (v *oidcIdentityVerifier) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	key, ok := v.keys[kid]
+	stale := time.Since(v.keysFetched) > OIDC_JWKS_CACHE_DURATION
+	if ok && !stale {
+		return key, nil
+	}
+	if stale || time.Since(v.keysFetched) > OIDC_JWKS_REFRESH_INTERVAL {
+		keys, err := v.fetchKeys(ctx)
+		if err != nil {
+			return nil, err
+		}
+		v.keys = keys
+		v.keysFetched = time.Now()
+	}
+	if key, ok := v.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, errUnauthenticated("Identity token key %v is unknown", kid)
+}
+
+func (v *oidcIdentityVerifier) fetchKeys(ctx context.Context) (map[string]*rsa.PublicKey, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, v.jwksURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := v.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected JWKS response status %v from %v", response.StatusCode, v.jwksURL)
+	}
+
+	var jwks oidcJWKS
+	if err := json.NewDecoder(response.Body).Decode(&jwks); err != nil {
+		return nil, err
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			log.Errorf("JWKS key %v modulus is malformed: %v", jwk.Kid, err)
+			continue
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			log.Errorf("JWKS key %v exponent is malformed: %v", jwk.Kid, err)
+			continue
+		}
+		keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	return keys, nil
+}
+
+// firstLogin verifies the credential with the configured identity provider, links the verified email and verifies the account
+func firstLogin(ctx context.Context, db *sql.DB, nk runtime.NakamaModule, in *common_api.AuthenticateCustomRequest, account *common_api.Account, credential string) error {
+	identity, err := getIdentityVerifier().Verify(ctx, in, credential)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if identity.Email != "" {
+		// Link the email before the user update to check if the email is already in use
+		if err := nk.LinkEmail(ctx, account.User.Id, identity.Email, uuid.Must(uuid.NewV4()).String()); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	// Verify account, set verify_time
+	if err := verifyNakamaAccount(ctx, db, account.User.Id); err != nil {
+		log.Error(err)
+		return err
+	}
+	nakamaAccountToUpdateJSON, err := getNakamaAccountToUpdateJson(account, in)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if _, err := AccountUpdateIDRPC(ctx, nil, nil, nk, nakamaAccountToUpdateJSON); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
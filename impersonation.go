@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/gofrs/uuid"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	IMPERSONATION_COLLECTION = "impersonation"
+)
+
+// Impersonation records an RPC the system called on behalf of a user, ActorUserID is the system user for server to server calls
+type Impersonation struct {
+	ActorUserID string
+	UserID      string
+	RPC         string
+	MatchID     string
+	DateTime    time.Time
+}
+
+func writeImpersonation(ctx context.Context, nk runtime.NakamaModule, impersonation *Impersonation) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      IMPERSONATION_COLLECTION,
+			Key:             uuid.Must(uuid.NewV4()).String(),
+			Value:           string(Marshal(impersonation)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_NO_READ,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for impersonation of user %v", impersonation.UserID)
+	}
+	return nil
+}
+
+// getActingUserID returns the user an RPC acts for. Player sessions always act for themselves,
+// only the system may act as the requested user and every such call is recorded.
+func getActingUserID(ctx context.Context, nk runtime.NakamaModule, rpc string, matchID string, requestedUserID string) (string, error) {
+	callerID := getCallerUserID(ctx)
+	if getCallerRole(ctx) != ROLE_SYSTEM {
+		sessionContext, err := unpackContext(ctx)
+		if err != nil {
+			return "", err
+		}
+		if requestedUserID != "" && requestedUserID != sessionContext.UserID {
+			log.Warnf("user_id: %v denied to call %v as user_id: %v", sessionContext.UserID, rpc, requestedUserID)
+			return "", errPermissionDenied("User %v is not allowed to act on behalf of user %v", sessionContext.UserID, requestedUserID)
+		}
+		return sessionContext.UserID, nil
+	}
+
+	if requestedUserID == "" {
+		if callerID == "" {
+			return "", errInvalidArgument("UserID is required")
+		}
+		return callerID, nil
+	}
+	if requestedUserID == callerID {
+		return requestedUserID, nil
+	}
+
+	if callerID == "" {
+		callerID = nakamaContext.NakamaSystemUserID
+	}
+	if err := writeImpersonation(ctx, nk, &Impersonation{
+		ActorUserID: callerID,
+		UserID:      requestedUserID,
+		RPC:         rpc,
+		MatchID:     matchID,
+		DateTime:    matchClock.Now().UTC(),
+	}); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	log.Infof("user_id: %v called %v as user_id: %v", callerID, rpc, requestedUserID)
+	return requestedUserID, nil
+}
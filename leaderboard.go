@@ -20,5 +20,18 @@ func CreateLeaderboardsIfNotExist(ctx context.Context, nk runtime.NakamaModule)
 	); err != nil {
 		log.Error(err)
 	}
+	profiles, err := listMatchProfiles(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, profile := range profiles {
+		if err := createRatingLeaderboard(ctx, nk, profile.Name); err != nil {
+			log.Error(err)
+		}
+	}
+	if err := createSeasonLeaderboards(ctx, nk); err != nil {
+		log.Error(err)
+	}
 	return nil
 }
@@ -36,90 +36,167 @@ func MarshalIndent(v interface{}) string {
 }
 
 func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, initializer runtime.Initializer) error {
+	config, err := loadConfig(getRuntimeEnv(ctx))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	setConfig(config)
+
 	NewDiscordSessionSingleton()
+	NewOpenMatchFrontEndSingleton()
 
 	//UpdateKaggleCompetitions()
 
-	if err := initializer.RegisterRpc("TournamentCreate", TournamentCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("TournamentCreate", authorizeRPC("TournamentCreate", TournamentCreateRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("TournamentDelete", TournamentDeleteRPC); err != nil {
+	if err := initializer.RegisterRpc("TournamentDelete", authorizeRPC("TournamentDelete", TournamentDeleteRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("MatchCreate", MatchCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchCreate", authorizeRPC("MatchCreate", MatchCreateRPC)); err != nil {
 		return err
 	}
 	/*
-		if err := initializer.RegisterRpc("MatchGet", MatchGetRPC); err != nil {
+		if err := initializer.RegisterRpc("MatchGet", authorizeRPC("MatchGet", MatchGetRPC)); err != nil {
 			return err
 		}
 	*/
-	if err := initializer.RegisterRpc("MatchReady", MatchReadyRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchReady", authorizeRPC("MatchReady", MatchReadyRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("MatchCancel", authorizeRPC("MatchCancel", MatchCancelRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("MatchResult", authorizeRPC("MatchResult", MatchResultRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("MatchStateGet", authorizeRPC("MatchStateGet", MatchStateGetRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("MatchStateListGet", authorizeRPC("MatchStateListGet", MatchStateListGetRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("MatchLifecycleGet", authorizeRPC("MatchLifecycleGet", MatchLifecycleGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("MatchCancel", MatchCancelRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchRandomGet", authorizeRPC("MatchRandomGet", MatchRandomGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("MatchResult", MatchResultRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchDisputeResolve", authorizeRPC("MatchDisputeResolve", MatchDisputeResolveRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("MatchStateGet", MatchStateGetRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchProfileCreate", authorizeRPC("MatchProfileCreate", MatchProfileCreateRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("MatchStateListGet", MatchStateListGetRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchProfileUpdate", authorizeRPC("MatchProfileUpdate", MatchProfileUpdateRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("LeaderboardCreate", LeaderboardCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchProfileDisable", authorizeRPC("MatchProfileDisable", MatchProfileDisableRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("LeaderboardDelete", LeaderboardDeleteRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchProfileGet", authorizeRPC("MatchProfileGet", MatchProfileGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("LeaderboardRecordWrite", LeaderboardRecordWriteRPC); err != nil {
+	if err := initializer.RegisterRpc("MatchProfileList", authorizeRPC("MatchProfileList", MatchProfileListRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("ConfigGet", authorizeRPC("ConfigGet", ConfigGetRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("PayoutReconcile", authorizeRPC("PayoutReconcile", PayoutReconcileRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("SeasonCreate", authorizeRPC("SeasonCreate", SeasonCreateRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("SeasonEnd", authorizeRPC("SeasonEnd", SeasonEndRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("SeasonList", authorizeRPC("SeasonList", SeasonListRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("SeasonPlacementsGet", authorizeRPC("SeasonPlacementsGet", SeasonPlacementsGetRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("BracketCreate", authorizeRPC("BracketCreate", BracketCreateRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("BracketRegister", authorizeRPC("BracketRegister", BracketRegisterRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("BracketStart", authorizeRPC("BracketStart", BracketStartRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("BracketGet", authorizeRPC("BracketGet", BracketGetRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("RoleSet", authorizeRPC("RoleSet", RoleSetRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("LeaderboardCreate", authorizeRPC("LeaderboardCreate", LeaderboardCreateRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("LeaderboardDelete", authorizeRPC("LeaderboardDelete", LeaderboardDeleteRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("LeaderboardRecordWrite", authorizeRPC("LeaderboardRecordWrite", LeaderboardRecordWriteRPC)); err != nil {
 		return err
 	}
 	if err := initializer.RegisterBeforeAuthenticateCustom(beforeAuthenticateCustom); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("AccountUpdateID", AccountUpdateIDRPC); err != nil {
+	if err := initializer.RegisterRpc("AccountUpdateID", authorizeRPC("AccountUpdateID", AccountUpdateIDRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("AccountByUsernameGet", authorizeRPC("AccountByUsernameGet", AccountByUsernameGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("AccountByUsernameGet", AccountByUsernameGetRPC); err != nil {
+	if err := initializer.RegisterRpc("AccountByCustomIDGet", authorizeRPC("AccountByCustomIDGet", AccountByCustomIDGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("AccountByCustomIDGet", AccountByCustomIDGetRPC); err != nil {
+	if err := initializer.RegisterRpc("AccountsByCustomIDGet", authorizeRPC("AccountsByCustomIDGet", AccountsByCustomIDGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("LastUserDataCreate", LastUserDataCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("AccountLinkStart", authorizeRPC("AccountLinkStart", AccountLinkStartRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("PoolJoin", PoolJoinRPC); err != nil {
+	if err := initializer.RegisterRpc("AccountLinkConfirm", authorizeRPC("AccountLinkConfirm", AccountLinkConfirmRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("PoolPick", PoolPickRPC); err != nil {
+	if err := initializer.RegisterRpc("AccountLinksGet", authorizeRPC("AccountLinksGet", AccountLinksGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("StorageWrite", StorageWriteRPC); err != nil {
+	if err := initializer.RegisterRpc("LastUserDataCreate", authorizeRPC("LastUserDataCreate", LastUserDataCreateRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("SubmitCreate", SubmitCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("PoolJoin", authorizeRPC("PoolJoin", PoolJoinRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("TicketStateCreate", TicketStateCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("PoolPick", authorizeRPC("PoolPick", PoolPickRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("StorageWrite", authorizeRPC("StorageWrite", StorageWriteRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("SubmitCreate", authorizeRPC("SubmitCreate", SubmitCreateRPC)); err != nil {
+		return err
+	}
+	if err := initializer.RegisterRpc("TicketStateCreate", authorizeRPC("TicketStateCreate", TicketStateCreateRPC)); err != nil {
 		return err
 	}
 
 	// open-match RPC
-	if err := initializer.RegisterRpc("OpenMatchFrontendTicketCreate", OpenMatchFrontendTicketCreateRPC); err != nil {
+	if err := initializer.RegisterRpc("OpenMatchFrontendTicketCreate", authorizeRPC("OpenMatchFrontendTicketCreate", OpenMatchFrontendTicketCreateRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("OpenMatchFrontendTicketGet", OpenMatchFrontendTicketGetRPC); err != nil {
+	if err := initializer.RegisterRpc("OpenMatchFrontendTicketGet", authorizeRPC("OpenMatchFrontendTicketGet", OpenMatchFrontendTicketGetRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("OpenMatchFrontendTicketDelete", OpenMatchFrontendTicketDeleteRPC); err != nil {
+	if err := initializer.RegisterRpc("OpenMatchFrontendTicketDelete", authorizeRPC("OpenMatchFrontendTicketDelete", OpenMatchFrontendTicketDeleteRPC)); err != nil {
 		return err
 	}
-	if err := initializer.RegisterRpc("OpenMatchFrontendTicketWatchAssignments", OpenMatchFrontendTicketWatchAssignmentsRPC); err != nil {
+	if err := initializer.RegisterRpc("OpenMatchFrontendTicketWatchAssignments", authorizeRPC("OpenMatchFrontendTicketWatchAssignments", OpenMatchFrontendTicketWatchAssignmentsRPC)); err != nil {
 		return err
 	}
 
@@ -148,12 +225,19 @@ func InitModule(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runti
 	if err := CreateFakeUsers(ctx, nk); err != nil {
 		return err
 	}
+	if err := seedMatchProfileCatalog(ctx, nk); err != nil {
+		return err
+	}
 	if err := RestoreActiveMatchesAfterRestart(ctx, nk); err != nil {
 		return err
 	}
 	if err := CreateLeaderboardsIfNotExist(ctx, nk); err != nil {
 		return err
 	}
+	if err := endExpiredSeasons(ctx, nk); err != nil {
+		log.Error(err)
+	}
+	go runSeasonEndSchedule(ctx, nk)
 	log.Infof("nakama-plugin-challenge-league.so module loaded")
 	return nil
 }
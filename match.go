@@ -5,8 +5,6 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"math/rand"
-	"os"
 	"strconv"
 	"time"
 
@@ -141,10 +139,11 @@ func MatchCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk r
 		}
 	}
 
-	currentTime := time.Now()
+	currentTime := matchClock.Now()
 	duration := int(tickets[0].SearchFields.DoubleArgs[nakamaCommands.SEARCH_MIN_DURATION])
 
-	rand.Seed(time.Now().Unix())
+	random := newMatchRandom(oMMatch.MatchId)
+	captainTurnUserID := captains[random.Intn(MATCH_RANDOM_CAPTAIN_TURN, len(captains))]
 	matchState := &nakamaCommands.MatchState{
 		Debug:             true,
 		Active:            true,
@@ -152,7 +151,7 @@ func MatchCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk r
 		MatchID:           oMMatch.MatchId,
 		MatchProfile:      oMMatch.MatchProfile,
 		MatchType:         matchType,
-		CaptainTurnUserID: captains[rand.Intn(len(captains))],
+		CaptainTurnUserID: captainTurnUserID,
 		CaptainUserIDs:    captains,
 		Status:            nakamaCommands.MATCH_STATUS_CREATED,
 		ReadyUserIDs:      userIDsReady,
@@ -169,13 +168,26 @@ func MatchCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk r
 		Duration:          time.Duration(duration) * time.Hour, //time.Second * time.Duration(100),
 	}
 	log.Info(duration)
-	_, err = writeMatchState(ctx, nk, matchState)
-	if err != nil {
+	return startMatchState(ctx, nk, matchState, random)
+}
+
+// startMatchState pins the match profile version, stores a new match state with the draws made so far, collects the entry fees
+// and starts the match module which runs the MatchLoop
+func startMatchState(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, random *MatchRandom) (string, error) {
+	if err := pinMatchProfile(ctx, nk, matchState); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if err := writeMatchStateRecord(ctx, nk, &MatchStateRecord{
+		MatchState: matchState,
+		Lifecycle:  newCreatedMatchLifecycle(matchState),
+		Random:     random,
+	}); err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	for _, team := range teams {
+	for _, team := range matchState.Teams {
 		for _, teamUser := range team.TeamUsers {
 			if err := createOrUpdateLastUserData(ctx, nk, &nakamaCommands.UserData{
 				MatchID: matchState.MatchID,
@@ -186,9 +198,17 @@ func MatchCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk r
 		}
 	}
 
+	if err := collectEntryFees(ctx, nk, matchState); err != nil {
+		log.Error(err)
+		if err := cancelMatchAfterEntryFeeFailure(ctx, nk, matchState, err); err != nil {
+			log.Error(err)
+		}
+		return "", err
+	}
+
 	module := nakamaCommands.DEFAULT_NAKAMA_MATCH_MODULE
 	params := make(map[string]interface{})
-	params["MatchID"] = oMMatch.MatchId
+	params["MatchID"] = matchState.MatchID
 
 	if result, err := nk.MatchCreate(
 		ctx,
@@ -209,40 +229,49 @@ func MatchCancelRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk r
 		return "", err
 	}
 
-	account, err := nk.AccountGetId(ctx, request.UserID)
+	userID, err := getActingUserID(ctx, nk, "MatchCancel", request.MatchID, request.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	request.UserID = userID
 
-	matchState, err := readMatchState(ctx, nk, getDummyMatchState(request.MatchID, nakamaCommands.MATCH_COLLECTION))
+	account, err := nk.AccountGetId(ctx, request.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	if matchState.Started {
-		return fmt.Sprintf("Match **%v** is started, **unable to cancel** it!", matchState.MatchID), nil
-	}
-
-	if !nakamaCommands.IsUserIDInMatch(account.User.Id, matchState) {
-		return fmt.Sprintf("User <@%v> not found in match **%v**", account.User.Id, matchState.MatchID), nil
-	}
-
-	matchState.Status = nakamaCommands.MATCH_STATUS_CANCELED
-	matchState.Active = false
-
-	if _, err := writeMatchState(ctx, nk, matchState); err != nil {
+	msg := ""
+	canceledBefore := false
+	matchState, err := updateMatchState(ctx, nk, request.MatchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		if err := checkMatchAction(tx, MATCH_ACTION_CANCEL); err != nil {
+			return err
+		}
+		if !nakamaCommands.IsUserIDInMatch(account.User.Id, matchState) {
+			msg = fmt.Sprintf("User <@%v> not found in match **%v**", account.User.Id, matchState.MatchID)
+			return errMatchStateUnchanged
+		}
+		canceledBefore = nakamaCommands.IsStringInSlice(request.UserID, matchState.CancelUserIDs)
+		if !canceledBefore {
+			matchState.CancelUserIDs = append(matchState.CancelUserIDs, request.UserID)
+		}
+		matchState.Active = false
+		return stageMatchTransition(tx, MATCH_PHASE_CANCELED, "canceled by user", request.UserID)
+	})
+	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	if msg != "" {
+		return msg, nil
+	}
+
 	if err := deleteTicketsFromMatchState(ctx, nk, matchState); err != nil {
 		log.Error(err)
 		return "", err
 	}
-	if !nakamaCommands.IsStringInSlice(request.UserID, matchState.CancelUserIDs) {
-		matchState.CancelUserIDs = append(matchState.CancelUserIDs, request.UserID)
-
+	if !canceledBefore {
 		if err := notifyDiscordUsers(
 			nakamaCommands.GetUsersFromMatch(matchState),
 			fmt.Sprintf("<@%v> is **not** ready for a Match **%v**, match has been canceled", account.CustomId, request.MatchID)); err != nil {
@@ -261,39 +290,48 @@ func MatchReadyRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk ru
 		return "", err
 	}
 
-	account, err := nk.AccountGetId(ctx, request.UserID)
+	userID, err := getActingUserID(ctx, nk, "MatchReady", request.MatchID, request.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	request.UserID = userID
 
-	matchState, err := readMatchState(ctx, nk, getDummyMatchState(request.MatchID, nakamaCommands.MATCH_COLLECTION))
+	account, err := nk.AccountGetId(ctx, request.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	if !nakamaCommands.IsUserIDInMatch(account.User.Id, matchState) {
-		return "", fmt.Errorf("User <@%v> not found in match **%v**", account.User.Id, matchState.MatchID)
-	}
-
-	if !nakamaCommands.IsStringInSlice(request.UserID, matchState.ReadyUserIDs) {
-		matchState.ReadyUserIDs = append(matchState.ReadyUserIDs, request.UserID)
-
-		_, err = writeMatchState(ctx, nk, matchState)
-		if err != nil {
-			log.Error(err)
-			return "", err
+	readyBefore := false
+	matchState, err := updateMatchState(ctx, nk, request.MatchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		if err := checkMatchAction(tx, MATCH_ACTION_READY); err != nil {
+			return err
 		}
-		if err := notifyDiscordUsers(
-			nakamaCommands.GetUsersFromMatch(matchState),
-			fmt.Sprintf("<@%v> is ready for a Match **%v**", account.CustomId, request.MatchID)); err != nil {
-			log.Error(err)
-			return "", err
+		if !nakamaCommands.IsUserIDInMatch(account.User.Id, matchState) {
+			return fmt.Errorf("User <@%v> not found in match **%v**", account.User.Id, matchState.MatchID)
 		}
-	} else {
+		readyBefore = nakamaCommands.IsStringInSlice(request.UserID, matchState.ReadyUserIDs)
+		if readyBefore {
+			return errMatchStateUnchanged
+		}
+		matchState.ReadyUserIDs = append(matchState.ReadyUserIDs, request.UserID)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if readyBefore {
 		return fmt.Sprintf("User <@%v> is ready", account.CustomId), nil
 	}
+
+	if err := notifyDiscordUsers(
+		nakamaCommands.GetUsersFromMatch(matchState),
+		fmt.Sprintf("<@%v> is ready for a Match **%v**", account.CustomId, request.MatchID)); err != nil {
+		log.Error(err)
+		return "", err
+	}
 	return "", nil
 }
 
@@ -366,6 +404,10 @@ func stopMatch(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.M
 		log.Error(err)
 		return err
 	}
+	if err := deleteMatchDraftTurn(ctx, nk, s.MatchID); err != nil {
+		log.Error(err)
+	}
+	forgetMatchProfilePin(s.MatchID)
 	if err := deleteMatchState(ctx, nk, s); err != nil {
 		log.Errorf("Error: %+v, returning previous state", err)
 		return err
@@ -375,20 +417,24 @@ func stopMatch(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.M
 
 func (m *Match) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, dispatcher runtime.MatchDispatcher, tick int64, state interface{}, messages []runtime.MatchData) interface{} {
 	s := state.(*nakamaCommands.MatchState)
-	var err error
-	if s != nil {
-		if s, err = readMatchState(ctx, nk, getDummyMatchState(s.MatchID, nakamaCommands.MATCH_COLLECTION)); err != nil {
-			log.Errorf("Error: %+v, returning previous state", err)
-			return state
-		}
-	} else {
+	if s == nil {
 		log.Error("Match state is nil")
 		return nil
 	}
+	record, err := readMatchStateRecord(ctx, nk, getDummyMatchState(s.MatchID, nakamaCommands.MATCH_COLLECTION))
+	if err != nil {
+		log.Errorf("Error: %+v, returning previous state", err)
+		return state
+	}
+	s = record.MatchState
+	lifecycle := record.Lifecycle
 	if s.Debug {
-		log.Infof("match loop match_id %v tick %v match.Status %v", s.MatchID, tick, s.Status)
+		log.Infof("match loop match_id %v tick %v match.Status %v phase %v", s.MatchID, tick, s.Status, lifecycle.Phase)
 	}
-	if len(s.CancelUserIDs) > 0 && !s.Started {
+	if lifecycle.Phase == MATCH_PHASE_CANCELED || (len(s.CancelUserIDs) > 0 && !s.Started) {
+		if err := transitionMatch(ctx, nk, s, MATCH_PHASE_CANCELED, "canceled by user", ""); err != nil {
+			log.Error(err)
+		}
 		if err := notifyDiscordUsers(
 			nakamaCommands.GetUsersFromMatch(s),
 			fmt.Sprintf("Match **%v** was canceled", s.MatchID)); err != nil {
@@ -407,75 +453,134 @@ func (m *Match) MatchLoop(ctx context.Context, logger runtime.Logger, db *sql.DB
 		return nil
 	}
 
-	maxUsersCount := nakamaCommands.CAPTAINS_DRAFT_MODES_MAP[s.MatchProfile].TeamCount * nakamaCommands.CAPTAINS_DRAFT_MODES_MAP[s.MatchProfile].UsersInTeam
+	profile, err := getMatchProfile(ctx, nk, s)
+	if err != nil {
+		log.Error(err)
+		return s
+	}
+	settings := getMatchSettings(ctx, nk, s)
+	maxUsersCount := profile.TeamCount * profile.UsersInTeam
+	teamUsersCount := len(nakamaCommands.GetTeamUsersFromTeams(s.Teams))
 	readyUsersCount := len(s.ReadyUserIDs)
-	if readyUsersCount < maxUsersCount {
+	if readyUsersCount < teamUsersCount {
 		log.Infof("match_id: %v Not all users ready, awaiting for them", s.MatchID)
-		log.Infof("ReadyUsersCount: %v, maxUsersCount: %v", readyUsersCount, maxUsersCount)
-		if s.Status != nakamaCommands.MATCH_STATUS_AWAITNG_USERS_READY {
-			s.Status = nakamaCommands.MATCH_STATUS_AWAITNG_USERS_READY
-			s = writeMatchStateInLoop(ctx, nk, s)
+		log.Infof("ReadyUsersCount: %v, teamUsersCount: %v", readyUsersCount, teamUsersCount)
+		if isReadyTimeoutExpired(s, settings) {
+			if err := cancelMatchAfterReadyTimeout(ctx, nk, s, settings); err != nil {
+				log.Error(err)
+				return s
+			}
+			return nil
+		}
+		if lifecycle.Phase != MATCH_PHASE_AWAITING_READY {
+			s = writeMatchStateInLoop(ctx, nk, s, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+				return stageMatchTransition(tx, MATCH_PHASE_AWAITING_READY, "awaiting users ready", "")
+			})
 		}
 		return s
 	}
 
-	if s.DateTimeStart.Unix() == s.DateTimeEnd.Unix() {
-		if !s.Started {
-			if s.MatchType == nakamaCommands.MATCH_TYPE_CAPTAINS_DRAFT {
-				log.Infof("match_id: %v Waiting for the draft completion", s.MatchID)
-				mode := nakamaCommands.CAPTAINS_DRAFT_MODES_MAP[s.MatchProfile]
-				log.Infof("mode: %v ", mode)
-				teamUsersCount := len(nakamaCommands.GetTeamUsersFromTeams(s.Teams))
-				log.Infof("TeamUsers count: %v, maxUsersCount: %v", teamUsersCount, maxUsersCount)
-				if teamUsersCount < maxUsersCount {
-					return s
+	if !s.Started {
+		if s.MatchType == nakamaCommands.MATCH_TYPE_CAPTAINS_DRAFT {
+			log.Infof("match_id: %v Waiting for the draft completion", s.MatchID)
+			log.Infof("TeamUsers count: %v, maxUsersCount: %v", teamUsersCount, maxUsersCount)
+			if teamUsersCount < maxUsersCount {
+				if lifecycle.Phase != MATCH_PHASE_DRAFTING {
+					return writeMatchStateInLoop(ctx, nk, s, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+						return stageMatchTransition(tx, MATCH_PHASE_DRAFTING, "all captains ready", "")
+					})
+				}
+				if err := checkDraftTurnTimeout(ctx, nk, s, teamUsersCount, settings); err != nil {
+					log.Error(err)
 				}
+				return s
 			}
+		}
 
-			s, err = createNakamaTournament(ctx, logger, db, nk, s)
-			if err != nil {
-				log.Error(err)
-			}
+		if startedState, err := createNakamaTournament(ctx, logger, db, nk, s); err != nil {
+			log.Error(err)
+		} else {
+			s = startedState
+		}
 
-			if err := createDiscordChannels(s); err != nil {
-				log.Error(err)
-			}
+		if err := createDiscordChannels(s); err != nil {
+			log.Error(err)
+		}
 
-			s.Started = true
-			s.Status = nakamaCommands.MATCH_STATUS_IN_PROGRESS
-			msg, err := notifyDiscordChannel(os.Getenv("DISCORD_ANNOUNCEMENTS_MATCH_MAKER_CHANNEL_ID"), nakamaCommands.PrintMatchState(s))
-			s.DiscordNewMatchMessage = nakamaCommands.DiscordMessage{ID: msg.ID, ChannelID: msg.ChannelID, GuildID: msg.GuildID}
-			if err != nil {
-				log.Error(err)
-			}
-			s = writeMatchStateInLoop(ctx, nk, s)
+		discordChannels := s.DiscordChannels
+		s = writeMatchStateInLoop(ctx, nk, s, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+			matchState.DiscordChannels = discordChannels
+			matchState.Started = true
+			return stageMatchTransition(tx, MATCH_PHASE_IN_PROGRESS, "all users ready", "")
+		})
+		msg, err := notifyDiscordChannel(getConfig().DiscordAnnouncementsMatchMakerChannelID, nakamaCommands.PrintMatchState(s))
+		if err != nil {
+			log.Error(err)
+		}
+		if msg != nil {
+			discordNewMatchMessage := nakamaCommands.DiscordMessage{ID: msg.ID, ChannelID: msg.ChannelID, GuildID: msg.GuildID}
+			s = writeMatchStateInLoop(ctx, nk, s, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+				matchState.DiscordNewMatchMessage = discordNewMatchMessage
+				return nil
+			})
+		}
 
-			if err := deleteTicketsByPoolUserIDs(ctx, nk, s); err != nil {
-				log.Error(err)
-			}
+		if err := deleteTicketsByPoolUserIDs(ctx, nk, s); err != nil {
+			log.Error(err)
 		}
 	}
 
-	if s.DateTimeEnd.Unix() < time.Now().UTC().Unix() {
-		winnerTeam, err := getWinnerTeam(ctx, nk, s)
+	if lifecycle.Phase == MATCH_PHASE_DISPUTED {
+		dispute, err := readMatchDispute(ctx, nk, s.MatchID)
 		if err != nil {
 			log.Error(err)
+			return s
 		}
-		s.Status = nakamaCommands.MATCH_STATUS_ENDED_AFTER_TIME_EXPIRED
-		msg := "> The Match **%v** time is over.\n"
-		if err := distributeRewardsWithMessage(ctx, nk, winnerTeam, s, msg); err != nil {
-			log.Error(err)
+		if dispute == nil || dispute.Status != DISPUTE_STATUS_RESOLVED {
+			return s
 		}
-		if err := stopMatch(ctx, nk, s); err != nil {
+		if err := applyMatchDisputeResolution(ctx, nk, s, dispute); err != nil {
 			log.Error(err)
+			return s
 		}
 		return nil
 	}
 
-	if consensusEstablished, winnerTeam := isResultConsensusEstablished(s); consensusEstablished {
+	consensus := evaluateResultConsensus(s, settings)
+	if consensus.Outcome == CONSENSUS_OUTCOME_DISPUTE {
+		log.Infof("match_id: %v reported results conflict", s.MatchID)
+		if err := openMatchDispute(ctx, nk, s); err != nil {
+			log.Error(err)
+			return s
+		}
+		return writeMatchStateInLoop(ctx, nk, s, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+			return stageMatchTransition(tx, MATCH_PHASE_DISPUTED, "reported results conflict", "")
+		})
+	}
+	if consensus.Outcome == CONSENSUS_OUTCOME_WINNER || consensus.Outcome == CONSENSUS_OUTCOME_DRAW {
 		log.Infof("Consensus established")
-		s.Status = nakamaCommands.MATCH_STATUS_COMPLETED_AHEAD_OF_SCHEDULE
+		if err := transitionMatch(ctx, nk, s, MATCH_PHASE_CONSENSUS, "result consensus established", ""); err != nil {
+			log.Error(err)
+		}
 		msg := "> The Match **%v** was completed ahead of schedule\n"
+		if err := distributeRewardsWithMessage(ctx, nk, consensus.WinnerTeam, s, msg); err != nil {
+			log.Error(err)
+		}
+		if err := stopMatch(ctx, nk, s); err != nil {
+			log.Error(err)
+		}
+		return nil
+	}
+
+	if s.DateTimeEnd.Unix() < matchClock.Now().UTC().Unix() {
+		winnerTeam, err := getWinnerTeam(ctx, nk, s)
+		if err != nil {
+			log.Error(err)
+		}
+		if err := transitionMatch(ctx, nk, s, MATCH_PHASE_EXPIRED, "match time is over", ""); err != nil {
+			log.Error(err)
+		}
+		msg := "> The Match **%v** time is over.\n"
 		if err := distributeRewardsWithMessage(ctx, nk, winnerTeam, s, msg); err != nil {
 			log.Error(err)
 		}
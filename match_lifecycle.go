@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+type MatchPhase string
+
+const (
+	MATCH_PHASE_CREATED        MatchPhase = "created"
+	MATCH_PHASE_AWAITING_READY MatchPhase = "awaiting-ready"
+	MATCH_PHASE_DRAFTING       MatchPhase = "drafting"
+	MATCH_PHASE_IN_PROGRESS    MatchPhase = "in-progress"
+	MATCH_PHASE_CONSENSUS      MatchPhase = "consensus"
+	MATCH_PHASE_EXPIRED        MatchPhase = "expired"
+	MATCH_PHASE_CANCELED       MatchPhase = "canceled"
+	MATCH_PHASE_DISPUTED       MatchPhase = "disputed"
+	MATCH_PHASE_RESOLVED       MatchPhase = "resolved"
+	MATCH_PHASE_ARCHIVED       MatchPhase = "archived"
+)
+
+type MatchAction string
+
+const (
+	MATCH_ACTION_READY     MatchAction = "ready"
+	MATCH_ACTION_CANCEL    MatchAction = "cancel"
+	MATCH_ACTION_POOL_JOIN MatchAction = "pool-join"
+	MATCH_ACTION_POOL_PICK MatchAction = "pool-pick"
+	MATCH_ACTION_RESULT    MatchAction = "result"
+)
+
+// matchPhaseTransitions lists the phases reachable from each phase
+var matchPhaseTransitions = map[MatchPhase][]MatchPhase{
+	MATCH_PHASE_CREATED:        {MATCH_PHASE_AWAITING_READY, MATCH_PHASE_DRAFTING, MATCH_PHASE_IN_PROGRESS, MATCH_PHASE_CANCELED},
+	MATCH_PHASE_AWAITING_READY: {MATCH_PHASE_DRAFTING, MATCH_PHASE_IN_PROGRESS, MATCH_PHASE_CANCELED},
+	MATCH_PHASE_DRAFTING:       {MATCH_PHASE_IN_PROGRESS, MATCH_PHASE_CANCELED},
+	MATCH_PHASE_IN_PROGRESS:    {MATCH_PHASE_CONSENSUS, MATCH_PHASE_EXPIRED, MATCH_PHASE_DISPUTED},
+	MATCH_PHASE_DISPUTED:       {MATCH_PHASE_RESOLVED},
+	MATCH_PHASE_CONSENSUS:      {MATCH_PHASE_ARCHIVED},
+	MATCH_PHASE_EXPIRED:        {MATCH_PHASE_ARCHIVED},
+	MATCH_PHASE_CANCELED:       {MATCH_PHASE_ARCHIVED},
+	MATCH_PHASE_RESOLVED:       {MATCH_PHASE_ARCHIVED},
+	MATCH_PHASE_ARCHIVED:       {},
+}
+
+// matchStopPhases lists the terminal phase a match is moved into when it is stopped before reaching one
+var matchStopPhases = map[MatchPhase]MatchPhase{
+	MATCH_PHASE_CREATED:        MATCH_PHASE_CANCELED,
+	MATCH_PHASE_AWAITING_READY: MATCH_PHASE_CANCELED,
+	MATCH_PHASE_DRAFTING:       MATCH_PHASE_CANCELED,
+	MATCH_PHASE_IN_PROGRESS:    MATCH_PHASE_EXPIRED,
+}
+
+// matchActionPhases lists the phases in which each user action is legal
+var matchActionPhases = map[MatchAction][]MatchPhase{
+	MATCH_ACTION_READY:     {MATCH_PHASE_CREATED, MATCH_PHASE_AWAITING_READY},
+	MATCH_ACTION_CANCEL:    {MATCH_PHASE_CREATED, MATCH_PHASE_AWAITING_READY, MATCH_PHASE_DRAFTING},
+	MATCH_ACTION_POOL_JOIN: {MATCH_PHASE_CREATED, MATCH_PHASE_AWAITING_READY, MATCH_PHASE_DRAFTING},
+	MATCH_ACTION_POOL_PICK: {MATCH_PHASE_DRAFTING},
+	MATCH_ACTION_RESULT:    {MATCH_PHASE_IN_PROGRESS},
+}
+
+// matchPhaseStatuses keeps MatchState.Status in sync for the clients that still read it
+var matchPhaseStatuses = map[MatchPhase]string{
+	MATCH_PHASE_CREATED:        nakamaCommands.MATCH_STATUS_CREATED,
+	MATCH_PHASE_AWAITING_READY: nakamaCommands.MATCH_STATUS_AWAITNG_USERS_READY,
+	MATCH_PHASE_DRAFTING:       nakamaCommands.MATCH_STATUS_AWAITNG_USERS_READY,
+	MATCH_PHASE_IN_PROGRESS:    nakamaCommands.MATCH_STATUS_IN_PROGRESS,
+	MATCH_PHASE_CONSENSUS:      nakamaCommands.MATCH_STATUS_COMPLETED_AHEAD_OF_SCHEDULE,
+	MATCH_PHASE_EXPIRED:        nakamaCommands.MATCH_STATUS_ENDED_AFTER_TIME_EXPIRED,
+	MATCH_PHASE_CANCELED:       nakamaCommands.MATCH_STATUS_CANCELED,
+	MATCH_PHASE_RESOLVED:       nakamaCommands.MATCH_STATUS_COMPLETED_AHEAD_OF_SCHEDULE,
+}
+
+type MatchTransition struct {
+	From     MatchPhase
+	To       MatchPhase
+	Reason   string
+	UserID   string
+	DateTime time.Time
+}
+
+// MatchLifecycle is the phase of a match and every transition which led to it, it is stored with the MatchState
+type MatchLifecycle struct {
+	MatchID string
+	Phase   MatchPhase
+	History []*MatchTransition
+}
+
+type MatchLifecycleGetRequest struct {
+	MatchID string
+}
+
+// MatchTransitionHook is called after a transition into the phase it was registered for has been committed
+type MatchTransitionHook func(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, transition *MatchTransition) error
+
+var matchTransitionHooks = map[MatchPhase][]MatchTransitionHook{}
+
+func registerMatchTransitionHook(phase MatchPhase, hook MatchTransitionHook) {
+	matchTransitionHooks[phase] = append(matchTransitionHooks[phase], hook)
+}
+
+func isMatchPhaseInSlice(phase MatchPhase, phases []MatchPhase) bool {
+	for _, v := range phases {
+		if v == phase {
+			return true
+		}
+	}
+	return false
+}
+
+func isMatchTransitionAllowed(from MatchPhase, to MatchPhase) bool {
+	return isMatchPhaseInSlice(to, matchPhaseTransitions[from])
+}
+
+// inferMatchPhase derives the phase of a match created before the lifecycle was tracked
+func inferMatchPhase(s *nakamaCommands.MatchState) MatchPhase {
+	switch {
+	case s.StorageCollection == nakamaCommands.MATCH_ARCHIVE_COLLECTION:
+		return MATCH_PHASE_ARCHIVED
+	case s.Status == nakamaCommands.MATCH_STATUS_CANCELED || (len(s.CancelUserIDs) > 0 && !s.Started):
+		return MATCH_PHASE_CANCELED
+	case s.Status == nakamaCommands.MATCH_STATUS_COMPLETED_AHEAD_OF_SCHEDULE:
+		return MATCH_PHASE_CONSENSUS
+	case s.Status == nakamaCommands.MATCH_STATUS_ENDED_AFTER_TIME_EXPIRED:
+		return MATCH_PHASE_EXPIRED
+	case s.Started:
+		return MATCH_PHASE_IN_PROGRESS
+	case s.Status == nakamaCommands.MATCH_STATUS_AWAITNG_USERS_READY:
+		return MATCH_PHASE_AWAITING_READY
+	}
+	return MATCH_PHASE_CREATED
+}
+
+func newMatchLifecycle(matchState *nakamaCommands.MatchState) *MatchLifecycle {
+	return &MatchLifecycle{
+		MatchID: matchState.MatchID,
+		Phase:   inferMatchPhase(matchState),
+		History: []*MatchTransition{},
+	}
+}
+
+// newCreatedMatchLifecycle returns the lifecycle stored with a new match state
+func newCreatedMatchLifecycle(matchState *nakamaCommands.MatchState) *MatchLifecycle {
+	lifecycle := newMatchLifecycle(matchState)
+	lifecycle.Phase = MATCH_PHASE_CREATED
+	lifecycle.History = append(lifecycle.History, &MatchTransition{
+		To:       MATCH_PHASE_CREATED,
+		Reason:   "match created",
+		DateTime: matchClock.Now().UTC(),
+	})
+	return lifecycle
+}
+
+// readMatchLifecycle returns the lifecycle stored with the active or the archived match state
+func readMatchLifecycle(ctx context.Context, nk runtime.NakamaModule, matchID string) (*MatchLifecycle, error) {
+	record, err := readMatchStateRecord(ctx, nk, getDummyMatchState(matchID, ""))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return record.Lifecycle, nil
+}
+
+// applyMatchTransition moves the lifecycle into the given phase and keeps MatchState.Status in sync,
+// the returned transition is nil when the match already is in the phase
+func applyMatchTransition(lifecycle *MatchLifecycle, matchState *nakamaCommands.MatchState, to MatchPhase, reason string, userID string) (*MatchTransition, error) {
+	if status, ok := matchPhaseStatuses[to]; ok {
+		matchState.Status = status
+	}
+	if lifecycle.Phase == to {
+		return nil, nil
+	}
+	if !isMatchTransitionAllowed(lifecycle.Phase, to) {
+		return nil, runtime.NewError(fmt.Sprintf("Match **%v** can not move from phase **%v** to **%v**", matchState.MatchID, lifecycle.Phase, to), 9)
+	}
+
+	transition := &MatchTransition{
+		From:     lifecycle.Phase,
+		To:       to,
+		Reason:   reason,
+		UserID:   userID,
+		DateTime: matchClock.Now().UTC(),
+	}
+	lifecycle.Phase = to
+	lifecycle.History = append(lifecycle.History, transition)
+	log.Infof("Match %v transition %v -> %v: %v", matchState.MatchID, transition.From, transition.To, reason)
+	return transition, nil
+}
+
+func runMatchTransitionHooks(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, transitions []*MatchTransition) {
+	for _, transition := range transitions {
+		for _, hook := range matchTransitionHooks[transition.To] {
+			if err := hook(ctx, nk, matchState, transition); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+// transitionMatch moves the match into the given phase with its own match state update,
+// inside a MatchStateMutation use stageMatchTransition instead.
+// The phase hooks run only after the commit, so a retried or failed write never runs them.
+// Transitioning into the current phase only updates the status.
+func transitionMatch(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, to MatchPhase, reason string, userID string) error {
+	committed, err := updateMatchState(ctx, nk, matchState.MatchID, func(current *nakamaCommands.MatchState, tx *matchStateTx) error {
+		status := current.Status
+		if err := stageMatchTransition(tx, to, reason, userID); err != nil {
+			return err
+		}
+		if len(tx.transitions) == 0 && current.Status == status {
+			return errMatchStateUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	matchState.Status = committed.Status
+	matchState.Version = committed.Version
+	return nil
+}
+
+// stageMatchTransition moves the match state of the transaction into the given phase,
+// the transition is committed by the match state write of the transaction
+func stageMatchTransition(tx *matchStateTx, to MatchPhase, reason string, userID string) error {
+	transition, err := applyMatchTransition(tx.record.Lifecycle, tx.record.MatchState, to, reason, userID)
+	if err != nil {
+		return err
+	}
+	if transition != nil {
+		tx.transitions = append(tx.transitions, transition)
+	}
+	return nil
+}
+
+// checkMatchAction returns an error when the action is illegal in the phase of the match state of the transaction
+func checkMatchAction(tx *matchStateTx, action MatchAction) error {
+	lifecycle := tx.record.Lifecycle
+	if !isMatchPhaseInSlice(lifecycle.Phase, matchActionPhases[action]) {
+		return runtime.NewError(fmt.Sprintf("Unable to %v, match **%v** is in phase **%v**", action, tx.record.MatchID, lifecycle.Phase), 9)
+	}
+	return nil
+}
+
+func MatchLifecycleGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *MatchLifecycleGetRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("MatchID is required")
+	}
+	if err := validateRequired("MatchID", request.MatchID); err != nil {
+		return "", err
+	}
+
+	lifecycle, err := readMatchLifecycle(ctx, nk, request.MatchID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if lifecycle == nil {
+		return "", runtime.NewError(fmt.Sprintf("No match lifecycle found with ID: %v", request.MatchID), 5)
+	}
+	return MarshalIndent(lifecycle), nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+// MatchProfileSettings holds the server side behaviour of a match profile
+type MatchProfileSettings struct {
+	ReadyTimeoutSeconds   int
+	NoShowCooldownSeconds int
+	PickTimeoutSeconds    int
+	AutoPickStrategy      string
+	ConsensusPolicy       string
+	RatingSystem          string
+}
+
+func (s *MatchProfileSettings) ReadyTimeout() time.Duration {
+	return time.Duration(s.ReadyTimeoutSeconds) * time.Second
+}
+
+func (s *MatchProfileSettings) NoShowCooldown() time.Duration {
+	return time.Duration(s.NoShowCooldownSeconds) * time.Second
+}
+
+func (s *MatchProfileSettings) PickTimeout() time.Duration {
+	return time.Duration(s.PickTimeoutSeconds) * time.Second
+}
+
+func (c *Config) getDefaultMatchProfileSettings() *MatchProfileSettings {
+	return &MatchProfileSettings{
+		ReadyTimeoutSeconds:   c.MatchReadyTimeoutSeconds,
+		NoShowCooldownSeconds: c.MatchNoShowCooldownSeconds,
+		PickTimeoutSeconds:    c.MatchPickTimeoutSeconds,
+		AutoPickStrategy:      c.MatchAutoPickStrategy,
+		ConsensusPolicy:       c.ResultConsensusPolicy,
+		RatingSystem:          c.RatingSystem,
+	}
+}
+
+// getMatchProfileSettings returns the defaults overridden by the profile entry of MATCH_PROFILE_SETTINGS
+func (c *Config) getMatchProfileSettings(matchProfile string) (*MatchProfileSettings, error) {
+	settings := c.getDefaultMatchProfileSettings()
+	if profile, ok := c.MatchProfileSettings[matchProfile]; ok {
+		if err := json.Unmarshal(profile, settings); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+func getMatchProfileSettings(matchProfile string) *MatchProfileSettings {
+	settings, err := getConfig().getMatchProfileSettings(matchProfile)
+	if err != nil {
+		log.Errorf("Invalid MATCH_PROFILE_SETTINGS for profile %v: %v", matchProfile, err)
+		return getConfig().getDefaultMatchProfileSettings()
+	}
+	return settings
+}
@@ -0,0 +1,628 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+	"open-match.dev/open-match/pkg/pb"
+)
+
+const (
+	MATCH_PROFILE_COLLECTION         = "match_profile"
+	MATCH_PROFILE_VERSION_COLLECTION = "match_profile_version"
+	MATCH_PROFILE_PIN_COLLECTION     = "match_profile_pin"
+
+	// MATCH_PROFILE_CATALOG_RELOAD_INTERVAL is how long a node serves the cached catalog before reading it again,
+	// the changes made on the node itself are applied at once
+	MATCH_PROFILE_CATALOG_RELOAD_INTERVAL = 30 * time.Second
+)
+
+// MatchProfile is a match format of the catalog stored in the MATCH_PROFILE_COLLECTION of the system user.
+// Every change stores a new ProfileVersion in the MATCH_PROFILE_VERSION_COLLECTION, a match keeps the version it was started with.
+type MatchProfile struct {
+	Name           string
+	ProfileVersion int
+	TeamCount      int
+	UsersInTeam    int
+	// DraftOrder is the number of users picked by the captain on turn, turn by turn, the captains alternate one pick per turn afterwards
+	DraftOrder []int
+	// DurationHours replaces the duration requested by the tickets when it is set
+	DurationHours int
+	// ConsensusPolicy replaces the consensus policy of the match profile settings when it is set
+	ConsensusPolicy string
+	// RewardRule is the key of the REWARD_RULE_COLLECTION applied before the keys derived from the match
+	RewardRule      string
+	Disabled        bool
+	UpdatedBy       string
+	DateTimeUpdated time.Time
+	Version         string
+}
+
+// MatchProfilePin records the profile version a match was started with
+type MatchProfilePin struct {
+	MatchID        string
+	Name           string
+	ProfileVersion int
+	Version        string
+}
+
+type MatchProfileGetRequest struct {
+	Name string
+	// ProfileVersion is the version to return, the current version when it is 0
+	ProfileVersion int
+}
+
+type MatchProfileDisableRequest struct {
+	Name string
+}
+
+type matchProfileCache struct {
+	sync.RWMutex
+	catalog  map[string]*MatchProfile
+	loadedAt time.Time
+	versions map[string]*MatchProfile
+	pins     map[string]*MatchProfilePin
+}
+
+var matchProfiles = newMatchProfileCache()
+
+func newMatchProfileCache() *matchProfileCache {
+	return &matchProfileCache{
+		versions: make(map[string]*MatchProfile),
+		pins:     make(map[string]*MatchProfilePin),
+	}
+}
+
+// resetMatchProfileCache drops everything cached from the storage, the match simulation starts with an empty cache
+func resetMatchProfileCache() {
+	matchProfiles = newMatchProfileCache()
+}
+
+func getMatchProfileVersionKey(name string, profileVersion int) string {
+	return fmt.Sprintf("%v.%v", name, profileVersion)
+}
+
+// getDefaultMatchProfiles returns the first version of the captains draft modes compiled in the nakama-go commands
+func getDefaultMatchProfiles() []*MatchProfile {
+	var profiles []*MatchProfile
+	for name, mode := range nakamaCommands.CAPTAINS_DRAFT_MODES_MAP {
+		profiles = append(profiles, &MatchProfile{
+			Name:           name,
+			ProfileVersion: 1,
+			TeamCount:      mode.TeamCount,
+			UsersInTeam:    mode.UsersInTeam,
+			DraftOrder:     append([]int{}, mode.UsersPerCaptainTurn...),
+			Version:        "*",
+		})
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles
+}
+
+func validateMatchProfile(profile *MatchProfile) error {
+	if err := validateRequired("Name", profile.Name); err != nil {
+		return err
+	}
+	if profile.TeamCount < 2 || profile.UsersInTeam < 1 {
+		return errInvalidArgument("Match profile %v needs at least 2 teams of 1 user", profile.Name)
+	}
+	picks := 0
+	for _, usersOnCaptainTurn := range profile.DraftOrder {
+		if usersOnCaptainTurn < 1 {
+			return errInvalidArgument("Match profile %v DraftOrder must pick at least 1 user per turn", profile.Name)
+		}
+		picks += usersOnCaptainTurn
+	}
+	if maxPicks := profile.TeamCount * (profile.UsersInTeam - 1); picks > maxPicks {
+		return errInvalidArgument("Match profile %v DraftOrder picks %v users, only %v are drafted", profile.Name, picks, maxPicks)
+	}
+	if profile.DurationHours < 0 {
+		return errInvalidArgument("Match profile %v DurationHours must not be negative", profile.Name)
+	}
+	if _, ok := consensusPolicies[profile.ConsensusPolicy]; profile.ConsensusPolicy != "" && !ok {
+		return errInvalidArgument("Match profile %v has an unknown consensus policy %q", profile.Name, profile.ConsensusPolicy)
+	}
+	return nil
+}
+
+func readMatchProfile(ctx context.Context, nk runtime.NakamaModule, name string) (*MatchProfile, error) {
+	var profile *MatchProfile
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: MATCH_PROFILE_COLLECTION,
+		Key:        name,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &profile); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	profile.Version = storageObjects[0].Version
+	return profile, nil
+}
+
+// readMatchProfileVersion returns a stored version of the profile, the versions never change so they are cached
+func readMatchProfileVersion(ctx context.Context, nk runtime.NakamaModule, name string, profileVersion int) (*MatchProfile, error) {
+	key := getMatchProfileVersionKey(name, profileVersion)
+	matchProfiles.RLock()
+	profile, ok := matchProfiles.versions[key]
+	matchProfiles.RUnlock()
+	if ok {
+		return profile, nil
+	}
+
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: MATCH_PROFILE_VERSION_COLLECTION,
+		Key:        key,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &profile); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	matchProfiles.Lock()
+	matchProfiles.versions[key] = profile
+	matchProfiles.Unlock()
+	return profile, nil
+}
+
+// writeMatchProfile stores the profile and its new version in one write, the write fails when the profile was changed meanwhile
+func writeMatchProfile(ctx context.Context, nk runtime.NakamaModule, profile *MatchProfile) error {
+	value := string(Marshal(profile))
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      MATCH_PROFILE_COLLECTION,
+			Key:             profile.Name,
+			Value:           value,
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         profile.Version,
+		},
+		&runtime.StorageWrite{
+			Collection:      MATCH_PROFILE_VERSION_COLLECTION,
+			Key:             getMatchProfileVersionKey(profile.Name, profile.ProfileVersion),
+			Value:           value,
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         "*",
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 2 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for match profile %v", profile.Name)
+	}
+	profile.Version = acks[0].Version
+
+	matchProfiles.Lock()
+	matchProfiles.loadedAt = time.Time{}
+	matchProfiles.Unlock()
+	return nil
+}
+
+// listMatchProfiles returns the current version of every profile of the catalog ordered by name
+func listMatchProfiles(ctx context.Context, nk runtime.NakamaModule) ([]*MatchProfile, error) {
+	var profiles []*MatchProfile
+	cursor := ""
+	for {
+		storageObjects, nextCursor, err := nk.StorageList(ctx, nakamaContext.NakamaSystemUserID, MATCH_PROFILE_COLLECTION, nakamaCommands.MAX_LIST_LIMIT, cursor)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		for _, object := range storageObjects {
+			var profile *MatchProfile
+			if err := json.Unmarshal([]byte(object.Value), &profile); err != nil {
+				log.Error(err)
+				return nil, err
+			}
+			profile.Version = object.Version
+			profiles = append(profiles, profile)
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].Name < profiles[j].Name
+	})
+	return profiles, nil
+}
+
+// getMatchProfileCatalog returns the catalog by profile name, it is read again from the storage
+// once MATCH_PROFILE_CATALOG_RELOAD_INTERVAL has passed so the changes of the other nodes are picked up
+func getMatchProfileCatalog(ctx context.Context, nk runtime.NakamaModule) (map[string]*MatchProfile, error) {
+	matchProfiles.RLock()
+	catalog := matchProfiles.catalog
+	loadedAt := matchProfiles.loadedAt
+	matchProfiles.RUnlock()
+	if catalog != nil && matchClock.Now().Sub(loadedAt) < MATCH_PROFILE_CATALOG_RELOAD_INTERVAL {
+		return catalog, nil
+	}
+
+	profiles, err := listMatchProfiles(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	catalog = make(map[string]*MatchProfile)
+	for _, profile := range profiles {
+		catalog[profile.Name] = profile
+	}
+	matchProfiles.Lock()
+	matchProfiles.catalog = catalog
+	matchProfiles.loadedAt = matchClock.Now()
+	matchProfiles.Unlock()
+	return catalog, nil
+}
+
+// seedMatchProfileCatalog stores the compiled-in captains draft modes missing from the catalog,
+// the catalog is the only source of the match profiles afterwards
+func seedMatchProfileCatalog(ctx context.Context, nk runtime.NakamaModule) error {
+	profiles, err := listMatchProfiles(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	stored := make(map[string]bool)
+	for _, profile := range profiles {
+		stored[profile.Name] = true
+	}
+	for _, profile := range getDefaultMatchProfiles() {
+		if stored[profile.Name] {
+			continue
+		}
+		profile.DateTimeUpdated = matchClock.Now().UTC()
+		if err := writeMatchProfile(ctx, nk, profile); err != nil {
+			log.Error(err)
+			return err
+		}
+		log.Infof("Match profile %v version %v seeded", profile.Name, profile.ProfileVersion)
+	}
+	return nil
+}
+
+func readMatchProfilePin(ctx context.Context, nk runtime.NakamaModule, matchID string) (*MatchProfilePin, error) {
+	matchProfiles.RLock()
+	pin, ok := matchProfiles.pins[matchID]
+	matchProfiles.RUnlock()
+	if ok {
+		return pin, nil
+	}
+
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: MATCH_PROFILE_PIN_COLLECTION,
+		Key:        matchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &pin); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	pin.Version = storageObjects[0].Version
+	matchProfiles.Lock()
+	matchProfiles.pins[matchID] = pin
+	matchProfiles.Unlock()
+	return pin, nil
+}
+
+func writeMatchProfilePin(ctx context.Context, nk runtime.NakamaModule, pin *MatchProfilePin) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      MATCH_PROFILE_PIN_COLLECTION,
+			Key:             pin.MatchID,
+			Value:           string(Marshal(pin)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         pin.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for match profile pin %v", pin.MatchID)
+	}
+	pin.Version = acks[0].Version
+	return nil
+}
+
+// pinMatchProfile records the current version of the match profile for a new match and applies its duration,
+// a profile missing from the catalog is not pinned and the match runs with the defaults
+func pinMatchProfile(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) error {
+	catalog, err := getMatchProfileCatalog(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	profile, ok := catalog[s.MatchProfile]
+	if !ok {
+		log.Infof("match_id: %v match profile %v is not in the catalog, defaults are used", s.MatchID, s.MatchProfile)
+		return nil
+	}
+	if profile.Disabled {
+		return runtime.NewError(fmt.Sprintf("Match profile **%v** is disabled", profile.Name), 9)
+	}
+	if err := writeMatchProfilePin(ctx, nk, &MatchProfilePin{
+		MatchID:        s.MatchID,
+		Name:           profile.Name,
+		ProfileVersion: profile.ProfileVersion,
+		Version:        "*",
+	}); err != nil {
+		log.Error(err)
+		return err
+	}
+	if profile.DurationHours > 0 {
+		s.Duration = time.Duration(profile.DurationHours) * time.Hour
+	}
+	log.Infof("match_id: %v match profile %v version %v", s.MatchID, profile.Name, profile.ProfileVersion)
+	return nil
+}
+
+// forgetMatchProfilePin drops the cached pin of a stopped match, the stored pin is kept with the match history
+func forgetMatchProfilePin(matchID string) {
+	matchProfiles.Lock()
+	delete(matchProfiles.pins, matchID)
+	matchProfiles.Unlock()
+}
+
+// getMatchProfile returns the profile version the match was started with. A match started before the catalog
+// gets the current version and a profile unknown to the catalog gets an empty profile, like a missing compiled-in mode.
+func getMatchProfile(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) (*MatchProfile, error) {
+	pin, err := readMatchProfilePin(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if pin != nil {
+		profile, err := readMatchProfileVersion(ctx, nk, pin.Name, pin.ProfileVersion)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if profile != nil {
+			return profile, nil
+		}
+		log.Errorf("match_id: %v match profile %v version %v is missing, the current version is used", s.MatchID, pin.Name, pin.ProfileVersion)
+	}
+
+	catalog, err := getMatchProfileCatalog(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if profile, ok := catalog[s.MatchProfile]; ok {
+		return profile, nil
+	}
+	return &MatchProfile{Name: s.MatchProfile}, nil
+}
+
+// getMatchSettings returns the match profile settings with the overrides of the profile version of the match
+func getMatchSettings(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) *MatchProfileSettings {
+	settings := getMatchProfileSettings(s.MatchProfile)
+	profile, err := getMatchProfile(ctx, nk, s)
+	if err != nil {
+		log.Error(err)
+		return settings
+	}
+	if profile.ConsensusPolicy != "" {
+		settings.ConsensusPolicy = profile.ConsensusPolicy
+	}
+	return settings
+}
+
+// checkTicketMatchProfile refuses a ticket which requests a disabled match profile
+func checkTicketMatchProfile(ctx context.Context, nk runtime.NakamaModule, ticket *pb.Ticket) error {
+	if ticket.SearchFields == nil {
+		return nil
+	}
+	catalog, err := getMatchProfileCatalog(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, tag := range ticket.SearchFields.Tags {
+		if profile, ok := catalog[tag]; ok && profile.Disabled {
+			return runtime.NewError(fmt.Sprintf("Match profile **%v** is disabled", profile.Name), 9)
+		}
+	}
+	return nil
+}
+
+func createRatingLeaderboard(ctx context.Context, nk runtime.NakamaModule, matchProfile string) error {
+	return nk.LeaderboardCreate(
+		ctx,
+		getRatingLeaderboardID(matchProfile),
+		true,
+		"desc",
+		"set",
+		"",
+		make(map[string]interface{}),
+	)
+}
+
+func MatchProfileCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var profile *MatchProfile
+	if err := decodeRequest(payload, &profile); err != nil {
+		return "", err
+	}
+	if profile == nil {
+		return "", errInvalidArgument("Match profile is required")
+	}
+	if err := validateMatchProfile(profile); err != nil {
+		return "", err
+	}
+	current, err := readMatchProfile(ctx, nk, profile.Name)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if current != nil {
+		return "", runtime.NewError(fmt.Sprintf("Match profile **%v** already exists", profile.Name), 6)
+	}
+
+	profile.ProfileVersion = 1
+	profile.UpdatedBy = getCallerUserID(ctx)
+	profile.DateTimeUpdated = matchClock.Now().UTC()
+	profile.Version = "*"
+	if err := writeMatchProfile(ctx, nk, profile); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if err := createRatingLeaderboard(ctx, nk, profile.Name); err != nil {
+		log.Error(err)
+	}
+	log.Infof("Match profile %v version %v created by %v", profile.Name, profile.ProfileVersion, profile.UpdatedBy)
+	return MarshalIndent(profile), nil
+}
+
+// MatchProfileUpdateRPC replaces the profile with a new version, the matches in flight keep their version
+func MatchProfileUpdateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var profile *MatchProfile
+	if err := decodeRequest(payload, &profile); err != nil {
+		return "", err
+	}
+	if profile == nil {
+		return "", errInvalidArgument("Match profile is required")
+	}
+	if err := validateMatchProfile(profile); err != nil {
+		return "", err
+	}
+	current, err := readMatchProfile(ctx, nk, profile.Name)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if current == nil {
+		return "", errNotFound("No match profile found with name: %v", profile.Name)
+	}
+
+	profile.ProfileVersion = current.ProfileVersion + 1
+	profile.UpdatedBy = getCallerUserID(ctx)
+	profile.DateTimeUpdated = matchClock.Now().UTC()
+	profile.Version = current.Version
+	if err := writeMatchProfile(ctx, nk, profile); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	log.Infof("Match profile %v version %v updated by %v", profile.Name, profile.ProfileVersion, profile.UpdatedBy)
+	return MarshalIndent(profile), nil
+}
+
+// MatchProfileDisableRPC stops the profile from being queued and matched, a later update enables it again
+func MatchProfileDisableRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *MatchProfileDisableRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Name is required")
+	}
+	if err := validateRequired("Name", request.Name); err != nil {
+		return "", err
+	}
+	profile, err := readMatchProfile(ctx, nk, request.Name)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if profile == nil {
+		return "", errNotFound("No match profile found with name: %v", request.Name)
+	}
+	if profile.Disabled {
+		return MarshalIndent(profile), nil
+	}
+
+	profile.Disabled = true
+	profile.ProfileVersion++
+	profile.UpdatedBy = getCallerUserID(ctx)
+	profile.DateTimeUpdated = matchClock.Now().UTC()
+	if err := writeMatchProfile(ctx, nk, profile); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	log.Infof("Match profile %v version %v disabled by %v", profile.Name, profile.ProfileVersion, profile.UpdatedBy)
+	return MarshalIndent(profile), nil
+}
+
+func MatchProfileGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *MatchProfileGetRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Name is required")
+	}
+	if err := validateRequired("Name", request.Name); err != nil {
+		return "", err
+	}
+
+	var profile *MatchProfile
+	var err error
+	if request.ProfileVersion > 0 {
+		profile, err = readMatchProfileVersion(ctx, nk, request.Name, request.ProfileVersion)
+	} else {
+		profile, err = readMatchProfile(ctx, nk, request.Name)
+	}
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if profile == nil {
+		return "", errNotFound("No match profile found with name: %v", request.Name)
+	}
+	return MarshalIndent(profile), nil
+}
+
+func MatchProfileListRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	profiles, err := listMatchProfiles(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return MarshalIndent(profiles), nil
+}
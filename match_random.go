@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"sync"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	MATCH_RANDOM_CAPTAIN_TURN = "captain-turn"
+	MATCH_RANDOM_AUTO_PICK    = "auto-pick"
+)
+
+// MatchRandomDraw is a single random choice made for a match, Result is in [0, N)
+type MatchRandomDraw struct {
+	Purpose  string
+	N        int
+	Result   int
+	DateTime time.Time
+}
+
+// MatchRandom is the seeded randomness of a match, stored in the match state record.
+// Draw i is made with a source seeded with Seed+i, so every choice can be replayed from the seed.
+type MatchRandom struct {
+	MatchID string
+	Seed    int64
+	Draws   []*MatchRandomDraw
+}
+
+type MatchRandomGetRequest struct {
+	MatchID string
+}
+
+var (
+	// matchSeedSource draws the seeds of new matches together with the matchClock, the match simulation fixes both
+	matchSeedSource     rand.Source = rand.NewSource(time.Now().UnixNano())
+	matchSeedSourceLock sync.Mutex
+)
+
+func setMatchSeedSource(source rand.Source) {
+	matchSeedSourceLock.Lock()
+	defer matchSeedSourceLock.Unlock()
+	matchSeedSource = source
+}
+
+// getMatchSeed mixes the match ID into the seed source and the clock time, so matches created at the same time get different seeds
+func getMatchSeed(matchID string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(matchID))
+	matchSeedSourceLock.Lock()
+	defer matchSeedSourceLock.Unlock()
+	return matchSeedSource.Int63() ^ matchClock.Now().UnixNano() ^ int64(h.Sum64())
+}
+
+func newMatchRandom(matchID string) *MatchRandom {
+	return &MatchRandom{
+		MatchID: matchID,
+		Seed:    getMatchSeed(matchID),
+		Draws:   []*MatchRandomDraw{},
+	}
+}
+
+// Intn returns a number in [0, n) and records the draw, the caller is responsible for writing the match state record
+func (r *MatchRandom) Intn(purpose string, n int) int {
+	result := rand.New(rand.NewSource(r.Seed + int64(len(r.Draws)))).Intn(n)
+	r.Draws = append(r.Draws, &MatchRandomDraw{
+		Purpose:  purpose,
+		N:        n,
+		Result:   result,
+		DateTime: matchClock.Now().UTC(),
+	})
+	return result
+}
+
+// readMatchRandom returns the randomness stored with the active or the archived match state, nil when the match made no draw
+func readMatchRandom(ctx context.Context, nk runtime.NakamaModule, matchID string) (*MatchRandom, error) {
+	record, err := readMatchStateRecord(ctx, nk, getDummyMatchState(matchID, ""))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return record.Random, nil
+}
+
+// drawMatchRandom makes a recorded draw for a running match through updateMatchState, so a concurrent write of the
+// match state makes the draw again from the new record. A match created before the randomness was recorded gets its seed on the first draw.
+func drawMatchRandom(ctx context.Context, nk runtime.NakamaModule, matchID string, purpose string, n int) (int, error) {
+	var result int
+	var seed int64
+	if _, err := updateMatchState(ctx, nk, matchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		record := tx.record
+		if record.Random == nil {
+			record.Random = newMatchRandom(matchID)
+		}
+		result = record.Random.Intn(purpose, n)
+		seed = record.Random.Seed
+		return nil
+	}); err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	log.Infof("match_id: %v random %v draw %v of %v with seed %v", matchID, purpose, result, n, seed)
+	return result, nil
+}
+
+func MatchRandomGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *MatchRandomGetRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("MatchID is required")
+	}
+	if err := validateRequired("MatchID", request.MatchID); err != nil {
+		return "", err
+	}
+
+	random, err := readMatchRandom(ctx, nk, request.MatchID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if random == nil {
+		return "", runtime.NewError(fmt.Sprintf("No match random found with ID: %v", request.MatchID), 5)
+	}
+	return MarshalIndent(random), nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+func isReadyTimeoutExpired(s *nakamaCommands.MatchState, settings *MatchProfileSettings) bool {
+	if settings.ReadyTimeoutSeconds <= 0 {
+		return false
+	}
+	// DateTimeStart holds the match creation time until the match is started
+	return matchClock.Now().UTC().After(s.DateTimeStart.Add(settings.ReadyTimeout()))
+}
+
+// cancelMatchAfterReadyTimeout cancels the match, requeues the tickets of the ready users and puts the no-shows on cooldown
+func cancelMatchAfterReadyTimeout(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, settings *MatchProfileSettings) error {
+	requeueTicketStates := make(map[string]*nakamaCommands.TicketState)
+	var notReadyUserIDs []string
+	var notReadyUserCustomIDs []string
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		userID := teamUser.User.Nakama.ID
+		if !nakamaCommands.IsStringInSlice(userID, s.ReadyUserIDs) {
+			notReadyUserIDs = append(notReadyUserIDs, userID)
+			notReadyUserCustomIDs = append(notReadyUserCustomIDs, fmt.Sprintf("<@%v>", teamUser.User.Nakama.CustomID))
+			continue
+		}
+		ticketState, err := readTicketState(ctx, nk, teamUser.TicketID, userID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		if ticketState != nil {
+			requeueTicketStates[userID] = ticketState
+		}
+	}
+	for _, userID := range s.PoolUserIDs {
+		ticketState, err := readLastUserIDTicketState(ctx, nk, userID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		requeueTicketStates[userID] = ticketState
+	}
+
+	s.Active = false
+	if err := transitionMatch(ctx, nk, s, MATCH_PHASE_CANCELED, "ready timeout", ""); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if err := notifyDiscordUsers(
+		nakamaCommands.GetUsersFromMatch(s),
+		fmt.Sprintf("Match **%v** was canceled, %v did not get ready in time", s.MatchID, strings.Join(notReadyUserCustomIDs, ", "))); err != nil {
+		log.Error(err)
+	}
+
+	if err := stopMatch(ctx, nk, s); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	for userID, ticketState := range requeueTicketStates {
+		ticket, err := requeueTicketState(ctx, nk, ticketState, userID)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		log.Infof("User %v requeued with ticket %v after ready timeout of match %v", userID, ticket.Id, s.MatchID)
+	}
+
+	for _, userID := range notReadyUserIDs {
+		if err := createQueueCooldown(ctx, nk, userID, s.MatchID, "not ready in time", settings.NoShowCooldown()); err != nil {
+			log.Error(err)
+		}
+	}
+	return nil
+}
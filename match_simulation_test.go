@@ -0,0 +1,585 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/golang/protobuf/ptypes/any"
+	log "github.com/micro/go-micro/v2/logger"
+	"open-match.dev/open-match/pkg/pb"
+)
+
+const (
+	SIMULATION_ACTION_READY  = "ready"
+	SIMULATION_ACTION_CANCEL = "cancel"
+	SIMULATION_ACTION_JOIN   = "join"
+	SIMULATION_ACTION_PICK   = "pick"
+	SIMULATION_ACTION_SUBMIT = "submit"
+	SIMULATION_ACTION_RESULT = "result"
+	SIMULATION_ACTION_WAIT   = "wait"
+
+	SIMULATION_EVENT_ACTION  = "action"
+	SIMULATION_EVENT_ERROR   = "error"
+	SIMULATION_EVENT_DISCORD = "discord"
+	SIMULATION_EVENT_PHASE   = "phase"
+	SIMULATION_EVENT_END     = "end"
+
+	// SIMULATION_CAPTAIN_ON_TURN as the Player of a pick is the captain whose draft turn it is
+	SIMULATION_CAPTAIN_ON_TURN = -1
+
+	SIMULATION_MATCH_PROFILE_1V1 = "1v1"
+	SIMULATION_MAX_TICKS         = 1000
+	SIMULATION_TICK              = time.Second
+)
+
+// simulationStartTime is the fake clock time of tick 0, fixed so transcripts can be compared between runs
+var simulationStartTime = time.Date(2020, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// SimulationStep is a scripted player action performed before the MatchLoop of its tick.
+// Player and Target are the N of the testuser#N users, a wait only advances the clock by Duration.
+type SimulationStep struct {
+	Tick      int64
+	Action    string
+	Player    int
+	Target    int
+	Score     int64
+	Subscore  int64
+	Win       bool
+	Draw      bool
+	ProofLink string
+	Duration  time.Duration
+}
+
+// SimulationScenario is a match between testuser#0..N-1. The first TeamCount users are the captains,
+// the others are drafted from the pool in a captains draft and play in the team of their index otherwise.
+// A non-zero Seed replaces the seed of the match randomness, e.g. to replay a match from MatchRandomGet.
+// Env is the runtime env the config of the scenario is loaded from.
+type SimulationScenario struct {
+	Name          string
+	MatchProfile  string
+	MatchType     string
+	TeamCount     int
+	UsersInTeam   int
+	DurationHours int
+	Seed          int64
+	Env           map[string]string
+	Steps         []*SimulationStep
+	MaxTicks      int64
+}
+
+type SimulationEvent struct {
+	Tick int64
+	Time time.Time
+	Type string
+	Text string
+}
+
+// SimulationTranscript is everything observable the simulated match produced, in order
+type SimulationTranscript struct {
+	Scenario string
+	MatchID  string
+	Seed     int64
+	Phase    MatchPhase
+	Events   []*SimulationEvent
+	Wallets  map[string]map[string]float64
+}
+
+func (t *SimulationTranscript) String() string {
+	var lines []string
+	for _, event := range t.Events {
+		lines = append(lines, fmt.Sprintf("%04d %v %-7v %v", event.Tick, event.Time.Format(time.RFC3339), event.Type, event.Text))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Find returns the first event of the type whose text contains the given text, nil when there is none
+func (t *SimulationTranscript) Find(eventType string, text string) *SimulationEvent {
+	for _, event := range t.Events {
+		if event.Type == eventType && strings.Contains(event.Text, text) {
+			return event
+		}
+	}
+	return nil
+}
+
+type matchSimulation struct {
+	ctx        context.Context
+	scenario   *SimulationScenario
+	nk         *FakeNakamaModule
+	discord    *FakeDiscordNotifier
+	clock      *FakeClock
+	match      *Match
+	state      interface{}
+	matchID    string
+	userIDs    []string
+	usernames  []string
+	tick       int64
+	phase      MatchPhase
+	messages   int
+	transcript *SimulationTranscript
+}
+
+// RunMatchSimulation plays the scenario tick by tick through MatchInit and MatchLoop on the fake runtime.
+// It replaces the Discord, Open Match and clock singletons, so it must never run inside a live server.
+func RunMatchSimulation(ctx context.Context, scenario *SimulationScenario) (*SimulationTranscript, error) {
+	restoreConfig, err := setSimulationConfig(scenario.Env)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	defer restoreConfig()
+
+	s, err := newMatchSimulation(ctx, scenario)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if err := s.start(); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	s.run()
+	return s.transcript, nil
+}
+
+// setSimulationConfig loads the config from the env of the scenario and returns a func restoring the previous config
+func setSimulationConfig(env map[string]string) (func(), error) {
+	simulationEnv := map[string]string{"DISCORD_TOKEN": "simulation", "IDENTITY_VERIFIER": IDENTITY_VERIFIER_DISCORD}
+	for name, value := range env {
+		simulationEnv[name] = value
+	}
+	config, err := loadConfig(simulationEnv)
+	if err != nil {
+		return nil, err
+	}
+	previous := getConfig()
+	setConfig(config)
+	return func() {
+		setConfig(previous)
+	}, nil
+}
+
+func newMatchSimulation(ctx context.Context, scenario *SimulationScenario) (*matchSimulation, error) {
+	if scenario.TeamCount < 2 || scenario.UsersInTeam < 1 {
+		return nil, fmt.Errorf("Scenario %v needs at least 2 teams of 1 user", scenario.Name)
+	}
+	if scenario.MatchType != nakamaCommands.MATCH_TYPE_CAPTAINS_DRAFT && scenario.UsersInTeam != 1 {
+		return nil, fmt.Errorf("Scenario %v has %v users in team, only a captains draft has more than 1", scenario.Name, scenario.UsersInTeam)
+	}
+
+	nk, discord, _ := useFakeRuntime()
+	clock := NewFakeClock(simulationStartTime)
+	nk.SetClock(clock)
+	setMatchClock(clock)
+	setMatchSeedSource(rand.NewSource(simulationStartTime.UnixNano()))
+	resetMatchProfileCache()
+
+	s := &matchSimulation{
+		ctx:      ctx,
+		scenario: scenario,
+		nk:       nk,
+		discord:  discord,
+		clock:    clock,
+		match:    &Match{},
+		matchID:  "simulation-" + scenario.Name,
+	}
+	s.transcript = &SimulationTranscript{
+		Scenario: scenario.Name,
+		MatchID:  s.matchID,
+		Wallets:  make(map[string]map[string]float64),
+	}
+
+	if err := seedMatchProfileCatalog(ctx, nk); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if err := CreateLeaderboardsIfNotExist(ctx, nk); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for i := 0; i < scenario.TeamCount*scenario.UsersInTeam; i++ {
+		username := getFakeUsername(i)
+		userID, _, _, err := nk.AuthenticateCustom(ctx, username, username, true)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		s.userIDs = append(s.userIDs, userID)
+		s.usernames = append(s.usernames, username)
+	}
+	return s, nil
+}
+
+// createTicket queues the user like the Discord bot does, the Discord channel of a user is named after the user
+func (s *matchSimulation) createTicket(i int) (*nakamaCommands.TeamUser, error) {
+	teamUser, err := nakamaCommands.UnmarshalTeamUser(Marshal(map[string]interface{}{
+		"User": map[string]interface{}{
+			"Nakama":  map[string]interface{}{"ID": s.userIDs[i], "CustomID": s.usernames[i]},
+			"Discord": map[string]interface{}{"ChannelID": s.usernames[i], "Username": s.usernames[i]},
+		},
+	}))
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	ticket, err := OpenMatchFrontendTicketCreate(&pb.CreateTicketRequest{
+		Ticket: &pb.Ticket{
+			SearchFields: &pb.SearchFields{
+				DoubleArgs: map[string]float64{nakamaCommands.SEARCH_MIN_DURATION: float64(s.scenario.DurationHours)},
+				Tags:       []string{s.scenario.MatchProfile},
+			},
+			Extensions: map[string]*any.Any{
+				nakamaCommands.TICKET_EXTENSION_USER: &any.Any{Value: Marshal(teamUser)},
+			},
+		},
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if err := writeTicketState(s.ctx, s.nk, &nakamaCommands.TicketState{
+		Ticket:  ticket,
+		Version: "*",
+	}, s.userIDs[i]); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if err := createOrUpdateLastUserData(s.ctx, s.nk, &nakamaCommands.UserData{
+		TicketID: ticket.Id,
+	}, s.userIDs[i]); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	teamUser.TicketID = ticket.Id
+	teamUser.Reward = 0
+	return teamUser, nil
+}
+
+// start creates the match the way Open Match would have assigned it and runs MatchInit
+func (s *matchSimulation) start() error {
+	var captains []string
+	var teams []*nakamaCommands.Team
+	for i := range s.userIDs {
+		teamUser, err := s.createTicket(i)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		if i >= s.scenario.TeamCount {
+			continue
+		}
+		teamUser.Captain = true
+		captains = append(captains, teamUser.User.Nakama.CustomID)
+		teams = append(teams, &nakamaCommands.Team{
+			Name:      "",
+			TeamUsers: []*nakamaCommands.TeamUser{teamUser},
+			ID:        i,
+		})
+	}
+
+	random := newMatchRandom(s.matchID)
+	if s.scenario.Seed != 0 {
+		random.Seed = s.scenario.Seed
+	}
+	captainTurnUserID := captains[random.Intn(MATCH_RANDOM_CAPTAIN_TURN, len(captains))]
+	s.transcript.Seed = random.Seed
+
+	currentTime := s.clock.Now()
+	if _, err := startMatchState(s.ctx, s.nk, &nakamaCommands.MatchState{
+		Debug:             true,
+		Active:            true,
+		Started:           false,
+		MatchID:           s.matchID,
+		MatchProfile:      s.scenario.MatchProfile,
+		MatchType:         s.scenario.MatchType,
+		CaptainTurnUserID: captainTurnUserID,
+		CaptainUserIDs:    captains,
+		Status:            nakamaCommands.MATCH_STATUS_CREATED,
+		ReadyUserIDs:      []string{},
+		Results:           []*nakamaCommands.MatchResult{},
+		Teams:             teams,
+		PoolUserIDs:       []string{},
+		PoolUserCustomIDs: []string{},
+		StorageUserID:     nakamaContext.NakamaSystemUserID,
+		StorageCollection: nakamaCommands.MATCH_COLLECTION,
+		Version:           "*",
+		CancelUserIDs:     []string{},
+		DateTimeStart:     currentTime,
+		DateTimeEnd:       currentTime,
+		Duration:          time.Duration(s.scenario.DurationHours) * time.Hour,
+	}, random); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	state, _, _ := s.match.MatchInit(s.ctx, nil, nil, s.nk, map[string]interface{}{"MatchID": s.matchID})
+	if state == nil {
+		return fmt.Errorf("Match %v failed to init", s.matchID)
+	}
+	s.state = state
+	s.recordChanges()
+	return nil
+}
+
+// run performs the steps of every tick followed by the MatchLoop until the loop ends the match or MaxTicks is reached
+func (s *matchSimulation) run() {
+	maxTicks := s.scenario.MaxTicks
+	if maxTicks <= 0 {
+		maxTicks = SIMULATION_MAX_TICKS
+	}
+	for s.tick = 0; s.tick <= maxTicks; s.tick++ {
+		for _, step := range s.scenario.Steps {
+			if step.Tick == s.tick {
+				s.perform(step)
+				s.recordChanges()
+			}
+		}
+		s.state = s.match.MatchLoop(s.ctx, nil, nil, s.nk, nil, s.tick, s.state, nil)
+		s.recordChanges()
+		if s.state == nil {
+			s.record(SIMULATION_EVENT_END, "match loop ended")
+			break
+		}
+		s.clock.Advance(SIMULATION_TICK)
+	}
+	if s.state != nil {
+		s.record(SIMULATION_EVENT_END, fmt.Sprintf("max ticks %v reached", maxTicks))
+	}
+
+	s.transcript.Phase = s.phase
+	for i, userID := range s.userIDs {
+		s.transcript.Wallets[s.usernames[i]] = s.nk.Wallet(userID)
+	}
+}
+
+func (s *matchSimulation) isPlayer(i int) bool {
+	return i >= 0 && i < len(s.userIDs)
+}
+
+// getCaptainOnTurn returns the user index of the captain whose draft turn it is
+func (s *matchSimulation) getCaptainOnTurn() (int, error) {
+	matchState, err := readMatchState(s.ctx, s.nk, getDummyMatchState(s.matchID, nakamaCommands.MATCH_COLLECTION))
+	if err != nil {
+		log.Error(err)
+		return 0, err
+	}
+	for i, username := range s.usernames {
+		if username == matchState.CaptainTurnUserID {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("Captain %v not found in match %v", matchState.CaptainTurnUserID, s.matchID)
+}
+
+// perform calls the RPC of the step as the system on behalf of the player, the way the Discord bot does
+func (s *matchSimulation) perform(step *SimulationStep) {
+	player := step.Player
+	if step.Action == SIMULATION_ACTION_PICK && player == SIMULATION_CAPTAIN_ON_TURN {
+		captain, err := s.getCaptainOnTurn()
+		if err != nil {
+			s.record(SIMULATION_EVENT_ERROR, fmt.Sprintf("%v: %v", step.Action, err))
+			return
+		}
+		player = captain
+	}
+	if step.Action != SIMULATION_ACTION_WAIT && !s.isPlayer(player) {
+		s.record(SIMULATION_EVENT_ERROR, fmt.Sprintf("%v: unknown player %v", step.Action, player))
+		return
+	}
+
+	action := step.Action
+	var msg string
+	var err error
+	switch step.Action {
+	case SIMULATION_ACTION_READY:
+		msg, err = MatchReadyRPC(s.ctx, nil, nil, s.nk, string(Marshal(&nakamaCommands.MatchReadyRequest{
+			MatchID: s.matchID,
+			UserID:  s.userIDs[player],
+		})))
+	case SIMULATION_ACTION_CANCEL:
+		msg, err = MatchCancelRPC(s.ctx, nil, nil, s.nk, string(Marshal(&nakamaCommands.MatchCancelRequest{
+			MatchID: s.matchID,
+			UserID:  s.userIDs[player],
+		})))
+	case SIMULATION_ACTION_JOIN:
+		msg, err = PoolJoinRPC(s.ctx, nil, nil, s.nk, string(Marshal(&nakamaCommands.MatchPoolJoinRequest{
+			MatchID: s.matchID,
+			UserID:  s.userIDs[player],
+		})))
+	case SIMULATION_ACTION_PICK:
+		if !s.isPlayer(step.Target) {
+			err = fmt.Errorf("unknown player %v", step.Target)
+			break
+		}
+		action = fmt.Sprintf("%v %v", step.Action, s.usernames[step.Target])
+		msg, err = PoolPickRPC(s.ctx, nil, nil, s.nk, string(Marshal(&nakamaCommands.MatchPoolPickRequest{
+			MatchID:       s.matchID,
+			CaptainUserID: s.userIDs[player],
+			UserID:        s.userIDs[step.Target],
+		})))
+	case SIMULATION_ACTION_SUBMIT:
+		action = fmt.Sprintf("%v %v/%v", step.Action, step.Score, step.Subscore)
+		msg, err = SubmitCreateRPC(s.ctx, nil, nil, s.nk, string(Marshal(&nakamaCommands.SubmitCreateRequest{
+			MatchID: s.matchID,
+			UserID:  s.userIDs[player],
+			Submit: &nakamaCommands.Submit{
+				Score:    step.Score,
+				Subscore: step.Subscore,
+			},
+		})))
+	case SIMULATION_ACTION_RESULT:
+		switch {
+		case step.Draw:
+			action = step.Action + " draw"
+		case step.Win:
+			action = step.Action + " win"
+		default:
+			action = step.Action + " lose"
+		}
+		msg, err = MatchResultRPC(s.ctx, nil, nil, s.nk, string(Marshal(&nakamaCommands.MatchResultRequest{
+			MatchID: s.matchID,
+			MatchResult: &nakamaCommands.MatchResult{
+				UserID:     s.userIDs[player],
+				Win:        step.Win,
+				Draw:       step.Draw,
+				TeamNumber: -1,
+				ProofLink:  step.ProofLink,
+			},
+		})))
+	case SIMULATION_ACTION_WAIT:
+		s.clock.Advance(step.Duration)
+		s.record(SIMULATION_EVENT_ACTION, fmt.Sprintf("%v %v", step.Action, step.Duration))
+		return
+	default:
+		err = fmt.Errorf("unknown action")
+	}
+
+	text := fmt.Sprintf("%v %v", s.usernames[player], action)
+	if err != nil {
+		s.record(SIMULATION_EVENT_ERROR, fmt.Sprintf("%v: %v", text, err))
+		return
+	}
+	if msg != "" {
+		text = fmt.Sprintf("%v: %v", text, msg)
+	}
+	s.record(SIMULATION_EVENT_ACTION, text)
+}
+
+func (s *matchSimulation) record(eventType string, text string) {
+	s.transcript.Events = append(s.transcript.Events, &SimulationEvent{
+		Tick: s.tick,
+		Time: s.clock.Now(),
+		Type: eventType,
+		Text: text,
+	})
+}
+
+// recordChanges records the Discord messages sent and the phase reached since the previous call
+func (s *matchSimulation) recordChanges() {
+	messages := s.discord.Messages()
+	for _, message := range messages[s.messages:] {
+		s.record(SIMULATION_EVENT_DISCORD, fmt.Sprintf("%v: %v", message.ChannelID, message.Content))
+	}
+	s.messages = len(messages)
+
+	lifecycle, err := readMatchLifecycle(s.ctx, s.nk, s.matchID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if lifecycle != nil && lifecycle.Phase != s.phase {
+		s.record(SIMULATION_EVENT_PHASE, string(lifecycle.Phase))
+		s.phase = lifecycle.Phase
+	}
+}
+
+// getSimulationScenarios returns a 1v1 settled by the reported results, a 1v1 canceled by a player, a 1v1 with a no-show
+// and a captains draft settled by the best submit for every profile seeded in the match profile catalog
+func getSimulationScenarios() []*SimulationScenario {
+	scenarios := []*SimulationScenario{
+		&SimulationScenario{
+			Name:          "1v1",
+			MatchProfile:  SIMULATION_MATCH_PROFILE_1V1,
+			TeamCount:     2,
+			UsersInTeam:   1,
+			DurationHours: 1,
+			Env:           map[string]string{"RESULT_CONSENSUS_RATIO": "1"},
+			Steps: []*SimulationStep{
+				&SimulationStep{Tick: 0, Action: SIMULATION_ACTION_READY, Player: 0},
+				&SimulationStep{Tick: 1, Action: SIMULATION_ACTION_READY, Player: 1},
+				&SimulationStep{Tick: 3, Action: SIMULATION_ACTION_SUBMIT, Player: 0, Score: 10},
+				&SimulationStep{Tick: 3, Action: SIMULATION_ACTION_SUBMIT, Player: 1, Score: 7},
+				&SimulationStep{Tick: 4, Action: SIMULATION_ACTION_RESULT, Player: 0, Win: true},
+				&SimulationStep{Tick: 5, Action: SIMULATION_ACTION_RESULT, Player: 1, Win: false},
+			},
+		},
+		&SimulationScenario{
+			Name:          "1v1-cancel",
+			MatchProfile:  SIMULATION_MATCH_PROFILE_1V1,
+			TeamCount:     2,
+			UsersInTeam:   1,
+			DurationHours: 1,
+			Steps: []*SimulationStep{
+				&SimulationStep{Tick: 0, Action: SIMULATION_ACTION_READY, Player: 0},
+				&SimulationStep{Tick: 2, Action: SIMULATION_ACTION_CANCEL, Player: 1},
+			},
+		},
+		&SimulationScenario{
+			Name:          "1v1-no-show",
+			MatchProfile:  SIMULATION_MATCH_PROFILE_1V1,
+			TeamCount:     2,
+			UsersInTeam:   1,
+			DurationHours: 1,
+			Steps: []*SimulationStep{
+				&SimulationStep{Tick: 0, Action: SIMULATION_ACTION_READY, Player: 0},
+				&SimulationStep{Tick: 1, Action: SIMULATION_ACTION_WAIT, Duration: getMatchProfileSettings(SIMULATION_MATCH_PROFILE_1V1).ReadyTimeout()},
+			},
+		},
+	}
+
+	for _, profile := range getDefaultMatchProfiles() {
+		scenarios = append(scenarios, getCaptainsDraftSimulationScenario(profile.Name, profile.TeamCount, profile.UsersInTeam))
+	}
+	return scenarios
+}
+
+// getCaptainsDraftSimulationScenario readies the captains, drafts the pool in user order, lets testuser#0 submit the best score
+// and ends the match when its time is over
+func getCaptainsDraftSimulationScenario(profile string, teamCount int, usersInTeam int) *SimulationScenario {
+	usersCount := teamCount * usersInTeam
+	var steps []*SimulationStep
+	for i := 0; i < teamCount; i++ {
+		steps = append(steps, &SimulationStep{Tick: 0, Action: SIMULATION_ACTION_READY, Player: i})
+	}
+	for i := teamCount; i < usersCount; i++ {
+		steps = append(steps, &SimulationStep{Tick: 0, Action: SIMULATION_ACTION_JOIN, Player: i})
+	}
+	tick := int64(1)
+	for i := teamCount; i < usersCount; i++ {
+		steps = append(steps, &SimulationStep{Tick: tick, Action: SIMULATION_ACTION_PICK, Player: SIMULATION_CAPTAIN_ON_TURN, Target: i})
+		tick++
+	}
+	tick++
+	for i := 0; i < usersCount; i++ {
+		steps = append(steps, &SimulationStep{Tick: tick, Action: SIMULATION_ACTION_SUBMIT, Player: i, Score: int64(10 * (usersCount - i))})
+	}
+	tick++
+	steps = append(steps, &SimulationStep{Tick: tick, Action: SIMULATION_ACTION_WAIT, Duration: time.Hour})
+
+	return &SimulationScenario{
+		Name:          profile,
+		MatchProfile:  profile,
+		MatchType:     nakamaCommands.MATCH_TYPE_CAPTAINS_DRAFT,
+		TeamCount:     teamCount,
+		UsersInTeam:   usersInTeam,
+		DurationHours: 1,
+		Steps:         steps,
+	}
+}
@@ -4,8 +4,9 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"time"
+	"strings"
 
 	nakamaCommands "github.com/challenge-league/nakama-go/commands"
 	nakamaContext "github.com/challenge-league/nakama-go/context"
@@ -13,27 +14,120 @@ import (
 	log "github.com/micro/go-micro/v2/logger"
 )
 
-func writeMatchStateInLoop(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState) *nakamaCommands.MatchState {
-	matchState, err := writeMatchState(ctx, nk, matchState)
+const (
+	MATCH_STATE_WRITE_RETRIES = 5
+)
+
+// errMatchStateUnchanged can be returned by a MatchStateMutation to skip the write without failing the update
+var errMatchStateUnchanged = errors.New("match state unchanged")
+
+// MatchStateMutation applies a change to a freshly read match state, it may be called several times.
+// The transaction holds the record read with the match state and collects the transitions staged by the mutation.
+type MatchStateMutation func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error
+
+// MatchStateRecord is the stored match state. The lifecycle and the randomness of the match are kept in the same storage object,
+// so a transition or a draw is committed by the match state write and never without it.
+type MatchStateRecord struct {
+	*nakamaCommands.MatchState
+	Lifecycle *MatchLifecycle `json:",omitempty"`
+	Random    *MatchRandom    `json:",omitempty"`
+}
+
+// matchStateTx is the record read by one updateMatchState attempt and the transitions staged by its mutation
+type matchStateTx struct {
+	record      *MatchStateRecord
+	transitions []*MatchTransition
+}
+
+func isStorageVersionConflict(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "version check failed")
+}
+
+// updateMatchState reads the active match state, applies the mutation and writes it back,
+// re-reading and re-applying the mutation when a concurrent write bumped the version.
+// The hooks of the transitions made by the mutation run once the write succeeded.
+func updateMatchState(ctx context.Context, nk runtime.NakamaModule, matchID string, mutate MatchStateMutation) (*nakamaCommands.MatchState, error) {
+	var err error
+	for i := 0; i < MATCH_STATE_WRITE_RETRIES; i++ {
+		var record *MatchStateRecord
+		record, err = readMatchStateRecord(ctx, nk, getDummyMatchState(matchID, nakamaCommands.MATCH_COLLECTION))
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		tx := &matchStateTx{record: record}
+		err = mutate(record.MatchState, tx)
+		if err != nil {
+			if err == errMatchStateUnchanged {
+				return record.MatchState, nil
+			}
+			return nil, err
+		}
+		if err = writeMatchStateRecord(ctx, nk, record); err == nil {
+			runMatchTransitionHooks(ctx, nk, record.MatchState, tx.transitions)
+			return record.MatchState, nil
+		}
+		if !isStorageVersionConflict(err) {
+			log.Error(err)
+			return nil, err
+		}
+		log.Infof("Match %v state version conflict, retry %v", matchID, i+1)
+	}
+	log.Errorf("Match %v state update failed after %v retries: %v", matchID, MATCH_STATE_WRITE_RETRIES, err)
+	return nil, err
+}
+
+// writeMatchStateInLoop applies the mutation through updateMatchState and keeps the previous state on failure,
+// so a failed write never terminates the match
+func writeMatchStateInLoop(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState, mutate MatchStateMutation) *nakamaCommands.MatchState {
+	result, err := updateMatchState(ctx, nk, matchState.MatchID, mutate)
 	if err != nil {
 		log.Errorf("Error %+v", err)
-		return nil
+		return matchState
 	}
-	return matchState
+	return result
 }
 
+// archiveMatchState stores the match in the archive collection with the archived transition appended to its lifecycle.
+// A match stopped before a terminal phase is first moved into its stop phase, a match which can not be archived is kept.
 func archiveMatchState(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) error {
+	record, err := readMatchStateRecord(ctx, nk, getDummyMatchState(s.MatchID, s.StorageCollection))
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	lifecycle := record.Lifecycle
+
 	matchState := *s
 	matchState.StorageCollection = nakamaCommands.MATCH_ARCHIVE_COLLECTION
 	matchState.Active = false
-	matchState.ActualDateTimeEnd = time.Now()
+	matchState.ActualDateTimeEnd = matchClock.Now()
 	matchState.ActualDuration = matchState.ActualDateTimeEnd.Sub(matchState.DateTimeStart)
 	matchState.Version = "*"
 
-	if _, err := writeMatchState(ctx, nk, &matchState); err != nil {
+	var transitions []*MatchTransition
+	if phase, ok := matchStopPhases[lifecycle.Phase]; ok {
+		transition, err := applyMatchTransition(lifecycle, &matchState, phase, fmt.Sprintf("match stopped in phase %v", lifecycle.Phase), "")
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		transitions = append(transitions, transition)
+	}
+	transition, err := applyMatchTransition(lifecycle, &matchState, MATCH_PHASE_ARCHIVED, "match stopped", "")
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if transition != nil {
+		transitions = append(transitions, transition)
+	}
+
+	if err := writeMatchStateRecord(ctx, nk, &MatchStateRecord{MatchState: &matchState, Lifecycle: lifecycle, Random: record.Random}); err != nil {
 		log.Error(err)
 		return err
 	}
+	runMatchTransitionHooks(ctx, nk, &matchState, transitions)
 	return nil
 }
 
@@ -45,10 +139,28 @@ func getDummyMatchState(matchID string, collection string) *nakamaCommands.Match
 	}
 }
 
+// validateMatchStateCollection rejects any collection other than the active and the archived match states,
+// so the match state RPCs cannot read the other collections owned by the system user
+func validateMatchStateCollection(collection string) error {
+	switch collection {
+	case "", nakamaCommands.MATCH_COLLECTION, nakamaCommands.MATCH_ARCHIVE_COLLECTION:
+		return nil
+	}
+	return errInvalidArgument("StorageCollection must be %v or %v", nakamaCommands.MATCH_COLLECTION, nakamaCommands.MATCH_ARCHIVE_COLLECTION)
+}
+
 func MatchStateGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var request *nakamaCommands.MatchStateGetRequest
-	if err := json.Unmarshal([]byte(payload), &request); err != nil {
-		log.Error(err)
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("ID is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return "", err
+	}
+	if err := validateMatchStateCollection(request.StorageCollection); err != nil {
 		return "", err
 	}
 
@@ -103,8 +215,13 @@ func matchStateListGet(ctx context.Context, nk runtime.NakamaModule, userID stri
 
 func MatchStateListGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var request *nakamaCommands.MatchStateListGetRequest
-	if err := json.Unmarshal([]byte(payload), &request); err != nil {
-		log.Error(err)
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		request = &nakamaCommands.MatchStateListGetRequest{}
+	}
+	if err := validateMatchStateCollection(request.StorageCollection); err != nil {
 		return "", err
 	}
 	matchStateList, err := matchStateListGet(ctx, nk, request.UserID, request.StorageCollection)
@@ -132,6 +249,15 @@ func deleteMatchState(ctx context.Context, nk runtime.NakamaModule, matchState *
 }
 
 func readMatchState(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState) (*nakamaCommands.MatchState, error) {
+	record, err := readMatchStateRecord(ctx, nk, matchState)
+	if err != nil {
+		return nil, err
+	}
+	return record.MatchState, nil
+}
+
+// readMatchStateRecord reads the match state with its lifecycle, the lifecycle of a match stored without one is inferred
+func readMatchStateRecord(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState) (*MatchStateRecord, error) {
 	log.Infof("%+v", matchState.StorageCollection)
 	storageCollection := nakamaCommands.MATCH_COLLECTION
 	if matchState.StorageCollection != "" {
@@ -156,22 +282,26 @@ func readMatchState(ctx context.Context, nk runtime.NakamaModule, matchState *na
 	if len(storageObjects) == 0 {
 		return nil, runtime.NewError(fmt.Sprintf("No match found with ID: %v", matchState.MatchID), 404)
 	}
-	var state *nakamaCommands.MatchState
-	if err := json.Unmarshal([]byte(storageObjects[0].Value), &state); err != nil {
+	record := &MatchStateRecord{MatchState: &nakamaCommands.MatchState{}}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), record); err != nil {
 		log.Error(err)
 		return nil, err
 	}
-	state.Version = storageObjects[0].Version
-	return state, nil
+	record.Version = storageObjects[0].Version
+	if record.Lifecycle == nil {
+		record.Lifecycle = newMatchLifecycle(record.MatchState)
+	}
+	return record, nil
 }
 
-func writeMatchState(ctx context.Context, nk runtime.NakamaModule, matchState *nakamaCommands.MatchState) (*nakamaCommands.MatchState, error) {
+func writeMatchStateRecord(ctx context.Context, nk runtime.NakamaModule, record *MatchStateRecord) error {
+	matchState := record.MatchState
 	log.Infof("Writing match state: %+v", matchState)
 	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
 		&runtime.StorageWrite{
 			Collection:      matchState.StorageCollection,
 			Key:             matchState.MatchID,
-			Value:           string(Marshal(matchState)),
+			Value:           string(Marshal(record)),
 			UserID:          matchState.StorageUserID,
 			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
 			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
@@ -181,14 +311,13 @@ func writeMatchState(ctx context.Context, nk runtime.NakamaModule, matchState *n
 
 	if err != nil {
 		log.Error(err)
-		return nil, err
+		return err
 	}
 
 	if len(acks) != 1 {
-		log.Errorf("Invocation failed. Return result not expected: ", len(acks))
-		return nil, err
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for match %v", matchState.MatchID)
 	}
 	matchState.Version = acks[0].Version
-
-	return matchState, err
+	return nil
 }
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+)
+
+func TestMatchStateRPCsRejectOtherCollections(t *testing.T) {
+	ctx := context.Background()
+	nk := NewFakeNakamaModule()
+	if _, err := MatchStateGetRPC(ctx, nil, nil, nk, string(Marshal(&nakamaCommands.MatchStateGetRequest{
+		ID:                "match",
+		StorageCollection: MATCH_ESCROW_COLLECTION,
+	}))); err == nil {
+		t.Error("expected MatchStateGet to reject the escrow collection")
+	}
+	if _, err := MatchStateListGetRPC(ctx, nil, nil, nk, string(Marshal(&nakamaCommands.MatchStateListGetRequest{
+		StorageCollection: PAYOUT_LEDGER_COLLECTION,
+	}))); err == nil {
+		t.Error("expected MatchStateListGet to reject the payout ledger collection")
+	}
+	if _, err := MatchStateGetRPC(ctx, nil, nil, nk, "null"); err == nil {
+		t.Error("expected MatchStateGet to reject a null payload")
+	}
+	if _, err := MatchStateListGetRPC(ctx, nil, nil, nk, "null"); err != nil {
+		t.Errorf("expected MatchStateListGet to list the active matches for a null payload, got %v", err)
+	}
+}
+
+func writeTestMatchStateRecord(t *testing.T, nk *FakeNakamaModule, matchID string, phase MatchPhase) *nakamaCommands.MatchState {
+	matchState := getDummyMatchState(matchID, nakamaCommands.MATCH_COLLECTION)
+	matchState.Version = "*"
+	lifecycle := newCreatedMatchLifecycle(matchState)
+	lifecycle.Phase = phase
+	if err := writeMatchStateRecord(context.Background(), nk, &MatchStateRecord{MatchState: matchState, Lifecycle: lifecycle}); err != nil {
+		t.Fatal(err)
+	}
+	return matchState
+}
+
+func TestArchiveMatchStateReachesTheArchivedPhase(t *testing.T) {
+	ctx := context.Background()
+	nk := NewFakeNakamaModule()
+
+	matchState := writeTestMatchStateRecord(t, nk, "in-progress", MATCH_PHASE_IN_PROGRESS)
+	if err := archiveMatchState(ctx, nk, matchState); err != nil {
+		t.Fatal(err)
+	}
+	record, err := readMatchStateRecord(ctx, nk, getDummyMatchState(matchState.MatchID, nakamaCommands.MATCH_ARCHIVE_COLLECTION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record.Lifecycle.Phase != MATCH_PHASE_ARCHIVED || !hasMatchTransition(record.Lifecycle, MATCH_PHASE_EXPIRED) {
+		t.Errorf("expected the stopped match to expire and be archived, got phase %v", record.Lifecycle.Phase)
+	}
+
+	matchState = writeTestMatchStateRecord(t, nk, "disputed", MATCH_PHASE_DISPUTED)
+	if err := archiveMatchState(ctx, nk, matchState); err == nil {
+		t.Error("expected a disputed match not to be archived")
+	}
+	if _, err := readMatchStateRecord(ctx, nk, getDummyMatchState(matchState.MatchID, nakamaCommands.MATCH_ARCHIVE_COLLECTION)); err == nil {
+		t.Error("expected no archived record for the disputed match")
+	}
+}
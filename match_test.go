@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+)
+
+// findSimulationScenario returns the scenario of getSimulationScenarios with the name
+func findSimulationScenario(t *testing.T, name string) *SimulationScenario {
+	t.Helper()
+	for _, scenario := range getSimulationScenarios() {
+		if scenario.Name == name {
+			return scenario
+		}
+	}
+	t.Fatalf("scenario %v not found", name)
+	return nil
+}
+
+// runScriptedMatch plays the scenario like RunMatchSimulation and returns the simulation so the fake runtime can be inspected
+func runScriptedMatch(t *testing.T, scenario *SimulationScenario) *matchSimulation {
+	t.Helper()
+	restoreConfig, err := setSimulationConfig(scenario.Env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoreConfig()
+
+	s, err := newMatchSimulation(context.Background(), scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.start(); err != nil {
+		t.Fatal(err)
+	}
+	s.run()
+	if event := s.transcript.Find(SIMULATION_EVENT_ERROR, ""); event != nil {
+		t.Fatalf("scenario %v failed at tick %v: %v\n%v", scenario.Name, event.Tick, event.Text, s.transcript)
+	}
+	return s
+}
+
+func hasMatchTransition(lifecycle *MatchLifecycle, to MatchPhase) bool {
+	for _, transition := range lifecycle.History {
+		if transition.To == to {
+			return true
+		}
+	}
+	return false
+}
+
+func TestScriptedMatchRewardPayout(t *testing.T) {
+	s := runScriptedMatch(t, findSimulationScenario(t, "1v1"))
+	ctx := context.Background()
+	winnerID, loserID := s.userIDs[0], s.userIDs[1]
+
+	lifecycle, err := readMatchLifecycle(ctx, s.nk, s.matchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasMatchTransition(lifecycle, MATCH_PHASE_CONSENSUS) || lifecycle.Phase != MATCH_PHASE_ARCHIVED {
+		t.Errorf("expected the reported results to reach %v before the match is %v, got %+v", MATCH_PHASE_CONSENSUS, MATCH_PHASE_ARCHIVED, lifecycle)
+	}
+	if coins := s.nk.Wallet(winnerID)[REWARD_CURRENCY_COINS]; coins != 100 {
+		t.Errorf("expected the winner to be paid 100 %v, got %v", REWARD_CURRENCY_COINS, coins)
+	}
+	if coins := s.nk.Wallet(loserID)[REWARD_CURRENCY_COINS]; coins != 0 {
+		t.Errorf("expected the loser to be paid nothing, got %v %v", coins, REWARD_CURRENCY_COINS)
+	}
+
+	ledger, err := readPayoutLedger(ctx, s.nk, s.matchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ledger == nil || ledger.Status != PAYOUT_STATUS_COMPLETED {
+		t.Fatalf("expected a %v payout ledger, got %+v", PAYOUT_STATUS_COMPLETED, ledger)
+	}
+
+	_, records, _, _, err := s.nk.LeaderboardRecordsList(ctx, nakamaCommands.MAIN_LEADERBOARD, []string{winnerID}, nakamaCommands.MAX_LIST_LIMIT, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Score != LEADERBOARD_WIN_SCORE {
+		t.Errorf("expected the winner to score %v on the leaderboard, got %v", LEADERBOARD_WIN_SCORE, records)
+	}
+
+	reconciliation, err := reconcilePayouts(ctx, s.nk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reconciliation.LedgersResumed != 0 || len(reconciliation.Issues) != 0 {
+		t.Errorf("expected the payout to reconcile cleanly, got %+v", reconciliation)
+	}
+	if coins := s.nk.Wallet(winnerID)[REWARD_CURRENCY_COINS]; coins != 100 {
+		t.Errorf("expected the reconciliation not to pay the winner again, got %v %v", coins, REWARD_CURRENCY_COINS)
+	}
+}
+
+func TestPayoutLedgerResumesTheRatingUpdate(t *testing.T) {
+	s := runScriptedMatch(t, findSimulationScenario(t, "1v1"))
+	ctx := context.Background()
+	winnerID := s.userIDs[0]
+
+	matchState, err := readMatchState(ctx, s.nk, getDummyMatchState(s.matchID, nakamaCommands.MATCH_ARCHIVE_COLLECTION))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ratings, err := readPlayerRatings(ctx, s.nk, []string{winnerID}, matchState.MatchProfile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	matchesCount := ratings[winnerID].MatchesCount
+
+	// a crash after the payouts leaves the ledger paid without the rating update
+	ledger, err := readPayoutLedger(ctx, s.nk, s.matchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ledger.Status = PAYOUT_STATUS_PAID
+	if err := writePayoutLedger(ctx, s.nk, ledger); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyPayoutLedgerRewards(ctx, s.nk, matchState); err != nil {
+		t.Fatal(err)
+	}
+
+	if ledger, err = readPayoutLedger(ctx, s.nk, s.matchID); err != nil {
+		t.Fatal(err)
+	}
+	if ledger.Status != PAYOUT_STATUS_COMPLETED {
+		t.Errorf("expected the resumed payout ledger to be %v, got %v", PAYOUT_STATUS_COMPLETED, ledger.Status)
+	}
+	if ratings, err = readPlayerRatings(ctx, s.nk, []string{winnerID}, matchState.MatchProfile); err != nil {
+		t.Fatal(err)
+	}
+	if ratings[winnerID].MatchesCount != matchesCount+1 {
+		t.Errorf("expected the resumed payout ledger to update the rating, got %v matches", ratings[winnerID].MatchesCount)
+	}
+	if coins := s.nk.Wallet(winnerID)[REWARD_CURRENCY_COINS]; coins != 100 {
+		t.Errorf("expected the resumed payout ledger not to pay the winner again, got %v %v", coins, REWARD_CURRENCY_COINS)
+	}
+}
+
+func TestMatchSimulationScenarios(t *testing.T) {
+	for _, scenario := range getSimulationScenarios() {
+		scenario := scenario
+		t.Run(scenario.Name, func(t *testing.T) {
+			transcript, err := RunMatchSimulation(context.Background(), scenario)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if event := transcript.Find(SIMULATION_EVENT_ERROR, ""); event != nil {
+				t.Errorf("failed at tick %v: %v\n%v", event.Tick, event.Text, transcript)
+			}
+			if transcript.Find(SIMULATION_EVENT_END, "match loop ended") == nil {
+				t.Errorf("expected the match loop to end\n%v", transcript)
+			}
+		})
+	}
+}
+
+func TestMatchSimulationCancel(t *testing.T) {
+	transcript, err := RunMatchSimulation(context.Background(), findSimulationScenario(t, "1v1-cancel"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if transcript.Find(SIMULATION_EVENT_PHASE, string(MATCH_PHASE_CANCELED)) == nil {
+		t.Errorf("expected the match to be %v\n%v", MATCH_PHASE_CANCELED, transcript)
+	}
+	for username, wallet := range transcript.Wallets {
+		if coins := wallet[REWARD_CURRENCY_COINS]; coins != 0 {
+			t.Errorf("expected no reward for a canceled match, %v got %v %v", username, coins, REWARD_CURRENCY_COINS)
+		}
+	}
+}
+
+func TestMatchSimulationTranscriptIsDeterministic(t *testing.T) {
+	scenario := findSimulationScenario(t, "1v1")
+	first, err := RunMatchSimulation(context.Background(), scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := RunMatchSimulation(context.Background(), scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.String() != second.String() {
+		t.Errorf("expected identical transcripts, got\n%v\nand\n%v", first, second)
+	}
+	if first.Seed != second.Seed {
+		t.Errorf("expected the same seed, got %v and %v", first.Seed, second.Seed)
+	}
+}
+
+func TestMatchRandomIsStoredWithTheMatchState(t *testing.T) {
+	s := runScriptedMatch(t, findSimulationScenario(t, "1v1"))
+	random, err := readMatchRandom(context.Background(), s.nk, s.matchID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if random == nil || random.Seed != s.transcript.Seed {
+		t.Fatalf("expected the match random with seed %v, got %+v", s.transcript.Seed, random)
+	}
+	if len(random.Draws) == 0 || random.Draws[0].Purpose != MATCH_RANDOM_CAPTAIN_TURN {
+		t.Errorf("expected the %v draw to be recorded, got %+v", MATCH_RANDOM_CAPTAIN_TURN, random.Draws)
+	}
+}
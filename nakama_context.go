@@ -6,18 +6,16 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
 	"regexp"
 	"strings"
 
 	common_api "github.com/heroiclabs/nakama-common/api"
 	"github.com/heroiclabs/nakama-common/runtime"
-	"google.golang.org/api/option"
 
-	firebase "firebase.google.com/go"
+	"github.com/challenge-league/nakama-plugin-challenge-league/v2/repository"
+
 	"firebase.google.com/go/auth"
-	"github.com/gofrs/uuid"
 )
 
 var (
@@ -89,9 +87,7 @@ func unpackContext(ctx context.Context) (*SessionContext, error) {
 }
 
 func resetVerificationNakamaAccount(ctx context.Context, db *sql.DB, userID string) error {
-	var params []interface{}
-	query := fmt.Sprintf("UPDATE users SET verify_time = '1970-01-01 00:00:00 UTC' WHERE id = '%v'", userID)
-	if _, err := db.ExecContext(ctx, query, params...); err != nil {
+	if err := repository.NewAccountRepository(db).ResetVerification(ctx, userID); err != nil {
 		log.Print(err)
 		return err
 	}
@@ -99,9 +95,7 @@ func resetVerificationNakamaAccount(ctx context.Context, db *sql.DB, userID stri
 }
 
 func verifyNakamaAccount(ctx context.Context, db *sql.DB, userID string) error {
-	var params []interface{}
-	query := fmt.Sprintf("UPDATE users SET verify_time = now() WHERE id = '%v'", userID)
-	if _, err := db.ExecContext(ctx, query, params...); err != nil {
+	if err := repository.NewAccountRepository(db).Verify(ctx, userID); err != nil {
 		log.Print(err)
 		return err
 	}
@@ -132,104 +126,6 @@ func getNakamaAccountToUpdateJson(account *common_api.Account, authenticateCusto
 	return string(nakamaAccountToUpdateJSON), nil
 }
 
-func firstLoginWithFirebase(ctx context.Context, db *sql.DB, nk runtime.NakamaModule, authenticateCustomRequest *common_api.AuthenticateCustomRequest, account *common_api.Account, firebaseCredential string) error {
-	if isEmailValid(firebaseCredential) {
-		if err := nk.LinkEmail(ctx, account.User.Id, firebaseCredential, uuid.Must(uuid.NewV4()).String()); err != nil {
-			log.Print(err)
-			return err
-		}
-	}
-	// Verify account, set verify_time
-	verifyNakamaAccount(ctx, db, account.User.Id)
-	nakamaAccountToUpdateJSON, err := getNakamaAccountToUpdateJson(account, authenticateCustomRequest)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	if _, err := AccountUpdateIDRPC(ctx, nil, nil, nk, string(nakamaAccountToUpdateJSON)); err != nil {
-		log.Print(err)
-		return err
-	}
-	return nil
-}
-
-func firstLoginWithFirebase2(ctx context.Context, db *sql.DB, nk runtime.NakamaModule, authenticateCustomRequest *common_api.AuthenticateCustomRequest, account *common_api.Account, firebaseCredential string) error {
-	opt := option.WithCredentialsFile("dataleague-org-2846b61502d2.json")
-	app, err := firebase.NewApp(context.Background(), nil, opt)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	client, err := app.Auth(context.Background())
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	var user *auth.UserRecord
-	if isEmailValid(firebaseCredential) {
-		user, err = getFirebaseUserByEmail(client, firebaseCredential)
-	} else {
-		log.Print("provided firebase credential is not email, try login by uuid")
-		user, err = getFirebaseUserByUID(client, firebaseCredential)
-	}
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	if err := isFirebaseUserActive(user); err != nil {
-		log.Print(err)
-		return err
-	}
-	if err := isFirebaseUserVerified(user); err != nil {
-		log.Print(err)
-		return err
-	}
-	// Try to link email before the user update to check if email is already in use
-	if err := nk.LinkEmail(ctx, account.User.Id, user.Email, uuid.Must(uuid.NewV4()).String()); err != nil {
-		log.Print(err)
-		return err
-	}
-
-	// Try to link phone number before the user update to check if phone number is already in use
-	// Workaround to pass phone number from firebase to nakama through the PhotoURL field
-	//if err := nk.LinkDevice(ctx, account.User.Id, user.PhotoURL); err != nil {
-
-	/* TODO: FIX
-	if err := nk.LinkDevice(ctx, account.User.Id, user.PhoneNumber); err != nil {
-		log.Print(err)
-		return err
-	}
-	*/
-
-	/*
-		// Workaround to set phone number in firebase from nakama through the PhotoURL field
-		if _, err := client.UpdateUser(context.Background(), user.UID, firebaseUserToUpdate.PhoneNumber(user.PhotoURL)); err != nil {
-			log.Print(err)
-			return err
-		}
-	*/
-
-	// Verify account, set verify_time
-	verifyNakamaAccount(ctx, db, account.User.Id)
-
-	// Update firebase PhotoURL from the discord PhotoURL
-	if val, ok := authenticateCustomRequest.Account.Vars["Author.AvatarUrl"]; ok {
-		firebaseUserToUpdate := &auth.UserToUpdate{}
-		client.UpdateUser(context.Background(), user.UID, firebaseUserToUpdate.PhotoURL(val))
-	}
-
-	nakamaAccountToUpdateJSON, err := getNakamaAccountToUpdateJson(account, authenticateCustomRequest)
-	if err != nil {
-		log.Print(err)
-		return err
-	}
-	if _, err := AccountUpdateIDRPC(ctx, nil, nil, nk, string(nakamaAccountToUpdateJSON)); err != nil {
-		log.Print(err)
-		return err
-	}
-	return nil
-}
-
 func isEmailValid(email string) bool {
 	Re := regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]+$`)
 	return Re.MatchString(email)
@@ -237,10 +133,17 @@ func isEmailValid(email string) bool {
 
 func beforeAuthenticateCustom(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, in *common_api.AuthenticateCustomRequest) (*common_api.AuthenticateCustomRequest, error) {
 	log.Printf("%+v", in)
+	// A secondary Discord account logs in to the account it is linked to
+	customID, err := resolveLinkedDiscordID(ctx, nk, in.Account.Id)
+	if err != nil {
+		log.Print(err)
+		return nil, err
+	}
+	in.Account.Id = customID
 	userID, username, new, err := nk.AuthenticateCustom(ctx, in.Account.Id, in.Username, true)
 	log.Printf("%+v %+v %+v %+v", userID, username, new, err)
 
-	if in.Account.Id == "administrator" {
+	if in.Account.Id == NAKAMA_ADMINISTRATOR_CUSTOM_ID {
 		return in, nil
 	}
 
@@ -278,7 +181,7 @@ func beforeAuthenticateCustom(ctx context.Context, logger runtime.Logger, db *sq
 	*/
 
 	if account.VerifyTime == nil {
-		return in, firstLoginWithFirebase(ctx, db, nk, in, account, in.Username)
+		return in, firstLogin(ctx, db, nk, in, account, getIdentityCredential(in))
 		//return nil, errors.New(`account not verified, please complete registration at **https://dataleague.org** and use the following commands: **dl login your-email@example.com** or **dl login your-uid**`)
 		//return nil, errors.New(`account not verified, please use the following commands: **rm login your-email@example.com** or **rm login your-uid**`)
 	}
@@ -315,21 +218,32 @@ func UserDataFromSession(session *common_api.Session) (map[string]interface{}, e
 }
 
 func AccountUpdateIDRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *AccountUpdateIDRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if err := validateAccountUpdateIDRequest(request); err != nil {
+		log.Print(err)
+		return "", err
+	}
+	if err := checkCallerOwns(ctx, request.ID); err != nil {
+		log.Print(err)
+		return "", err
+	}
+	if err := checkUserExists(ctx, nk, request.ID); err != nil {
 		return "", err
 	}
 
 	if err := nk.AccountUpdateId(
 		ctx,
-		params["ID"].(string),
-		params["Username"].(string),
-		params["Metadata"].(map[string]interface{}),
-		params["DisplayName"].(string),
-		params["Timezone"].(string),
-		params["Location"].(string),
-		params["LangTag"].(string),
-		params["AvatarUrl"].(string),
+		request.ID,
+		request.Username,
+		request.Metadata,
+		request.DisplayName,
+		request.Timezone,
+		request.Location,
+		request.LangTag,
+		request.AvatarUrl,
 	); err != nil {
 		return "", err
 	} else {
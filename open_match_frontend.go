@@ -3,24 +3,19 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"sync"
 	"time"
 
 	"log"
 
 	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/golang/protobuf/ptypes/any"
 	"github.com/heroiclabs/nakama-common/runtime"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/keepalive"
 	"open-match.dev/open-match/pkg/pb"
 )
 
-const (
-	// The endpoint for the Open Match Frontend service.
-	omFrontendEndpoint = "open-match-frontend.open-match.svc.cluster.local:50504"
-)
-
 var (
 	openMatchFrontendServiceClientBuilder *openMatchFrontendServiceClient
 	once                                  sync.Once
@@ -39,7 +34,7 @@ type openMatchFrontendServiceClient struct {
 func NewOpenMatchFrontEndSingleton() *openMatchFrontendServiceClient {
 	once.Do(func() {
 		// Connect to Open Match Frontend.
-		conn, err := grpc.Dial(omFrontendEndpoint, grpc.WithInsecure(), grpc.WithKeepaliveParams(kacp))
+		conn, err := grpc.Dial(getConfig().OpenMatchFrontendEndpoint, grpc.WithInsecure(), grpc.WithKeepaliveParams(kacp))
 		if err != nil {
 			log.Fatalf("Failed to connect to Open Match, got %v", err)
 		}
@@ -55,6 +50,12 @@ func NewOpenMatchFrontEndSingleton() *openMatchFrontendServiceClient {
 	return openMatchFrontendServiceClientBuilder
 }
 
+// setOpenMatchFrontend replaces the Open Match frontend client, OPEN_MATCH_FRONTEND_ENDPOINT is not dialed afterwards
+func setOpenMatchFrontend(client pb.FrontendServiceClient) {
+	once.Do(func() {})
+	openMatchFrontendServiceClientBuilder = &openMatchFrontendServiceClient{client: client}
+}
+
 func (b *openMatchFrontendServiceClient) SetClient(client pb.FrontendServiceClient) *openMatchFrontendServiceClient {
 	b.client = client
 	return b
@@ -75,28 +76,80 @@ func (b *openMatchFrontendServiceClient) GetConn() *grpc.ClientConn {
 
 func OpenMatchFrontendTicketCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var ticketCreateRequest pb.CreateTicketRequest
-	json.Unmarshal([]byte(payload), &ticketCreateRequest)
+	if err := decodeRequest(payload, &ticketCreateRequest); err != nil {
+		return "", err
+	}
 	log.Printf(MarshalIndent(ticketCreateRequest))
 
-	// TODO: Allow only limited number of tickets per user
+	if ticketCreateRequest.Ticket == nil {
+		return "", errInvalidArgument("Ticket is required")
+	}
+	// the ticket is queued for the session user, a system caller queues the user named in the ticket extension
+	requestedUserID := ""
+	if extension, ok := ticketCreateRequest.Ticket.Extensions[nakamaCommands.TICKET_EXTENSION_USER]; ok && extension != nil {
+		requested, err := nakamaCommands.UnmarshalTeamUser(extension.Value)
+		if err != nil {
+			log.Print(err)
+			return "", errInvalidArgument("Invalid ticket extension %v", nakamaCommands.TICKET_EXTENSION_USER)
+		}
+		if requested != nil && requested.User != nil && requested.User.Nakama != nil {
+			requestedUserID = requested.User.Nakama.ID
+		}
+	}
+	userID, err := getActingUserID(ctx, nk, "OpenMatchFrontendTicketCreate", "", requestedUserID)
+	if err != nil {
+		return "", err
+	}
+	// the team user is rebuilt from the account, so the profile of the user in the match state cannot be forged
+	teamUser, err := getAccountTeamUser(ctx, nk, userID)
+	if err != nil {
+		return "", err
+	}
+	if ticketCreateRequest.Ticket.Extensions == nil {
+		ticketCreateRequest.Ticket.Extensions = make(map[string]*any.Any)
+	}
+	ticketCreateRequest.Ticket.Extensions[nakamaCommands.TICKET_EXTENSION_USER] = &any.Any{Value: Marshal(teamUser)}
+	if err := checkQueueCooldown(ctx, nk, userID); err != nil {
+		return "", err
+	}
+	if err := checkTicketQuota(ctx, nk, userID); err != nil {
+		return "", err
+	}
+	if err := checkTicketMatchProfile(ctx, nk, ticketCreateRequest.Ticket); err != nil {
+		return "", err
+	}
+	if err := enrichTicketWithRating(ctx, nk, ticketCreateRequest.Ticket, userID); err != nil {
+		log.Print(err)
+		return "", err
+	}
+
+	resp, err := OpenMatchFrontendTicketCreate(&ticketCreateRequest)
+	if err != nil {
+		return "", err
+	}
+	return MarshalIndent(resp), nil
+}
 
+func OpenMatchFrontendTicketCreate(ticketCreateRequest *pb.CreateTicketRequest) (*pb.Ticket, error) {
 	fe := NewOpenMatchFrontEndSingleton().GetClient()
-	resp, err := fe.CreateTicket(context.Background(), &ticketCreateRequest)
+	resp, err := fe.CreateTicket(context.Background(), ticketCreateRequest)
 	if err != nil {
 		log.Printf("Failed to Create Ticket, got %s", err.Error())
-		return "", err
+		return nil, err
 	}
-
-	var user *nakamaCommands.User
-	json.Unmarshal(resp.Extensions["user"].Value, &user)
 	log.Printf("Ticket created successfully, id: %v", resp.Id)
-	return MarshalIndent(resp), nil
+	return resp, nil
 }
 
 func OpenMatchFrontendTicketGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var ticketGetRequest pb.GetTicketRequest
-	json.Unmarshal([]byte(payload), &ticketGetRequest)
+	if err := decodeRequest(payload, &ticketGetRequest); err != nil {
+		return "", err
+	}
 	log.Printf(MarshalIndent(ticketGetRequest))
+	if err := validateRequired("TicketId", ticketGetRequest.TicketId); err != nil {
+		return "", err
+	}
 
 	fe := NewOpenMatchFrontEndSingleton().GetClient()
 	got, err := fe.GetTicket(context.Background(), &pb.GetTicketRequest{TicketId: ticketGetRequest.TicketId})
@@ -124,8 +177,13 @@ func OpenMatchFrontendTicketDelete(ticketID string) error {
 
 func OpenMatchFrontendTicketDeleteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var ticketDeleteRequest pb.DeleteTicketRequest
-	json.Unmarshal([]byte(payload), &ticketDeleteRequest)
+	if err := decodeRequest(payload, &ticketDeleteRequest); err != nil {
+		return "", err
+	}
 	log.Printf(MarshalIndent(ticketDeleteRequest))
+	if err := validateRequired("TicketId", ticketDeleteRequest.TicketId); err != nil {
+		return "", err
+	}
 
 	err := OpenMatchFrontendTicketDelete(ticketDeleteRequest.TicketId)
 	if err != nil {
@@ -137,8 +195,16 @@ func OpenMatchFrontendTicketDeleteRPC(ctx context.Context, logger runtime.Logger
 
 func OpenMatchFrontendTicketWatchAssignmentsRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var watchAssignmentsRequest *pb.WatchAssignmentsRequest
-	json.Unmarshal([]byte(payload), &watchAssignmentsRequest)
+	if err := decodeRequest(payload, &watchAssignmentsRequest); err != nil {
+		return "", err
+	}
+	if watchAssignmentsRequest == nil {
+		return "", errInvalidArgument("TicketId is required")
+	}
 	log.Printf(MarshalIndent(watchAssignmentsRequest))
+	if err := validateRequired("TicketId", watchAssignmentsRequest.TicketId); err != nil {
+		return "", err
+	}
 
 	fe := NewOpenMatchFrontEndSingleton().GetClient()
 	watchAssignmentsClient, err := fe.WatchAssignments(context.Background(), &pb.WatchAssignmentsRequest{TicketId: watchAssignmentsRequest.TicketId})
@@ -154,7 +220,3 @@ func OpenMatchFrontendTicketWatchAssignmentsRPC(ctx context.Context, logger runt
 	}
 	return MarshalIndent(watchAssignmentsResponse), nil
 }
-
-func init() {
-	NewOpenMatchFrontEndSingleton()
-}
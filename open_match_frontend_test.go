@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/golang/protobuf/ptypes/any"
+	"open-match.dev/open-match/pkg/pb"
+)
+
+func TestTicketCreateRebuildsTheTeamUser(t *testing.T) {
+	restoreConfig, err := setSimulationConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restoreConfig()
+	ctx := context.Background()
+	nk, _, _ := useFakeRuntime()
+	if err := CreateLeaderboardsIfNotExist(ctx, nk); err != nil {
+		t.Fatal(err)
+	}
+	userID := nk.AddUser("111", "alice")
+	if err := nk.AccountUpdateId(ctx, userID, "", map[string]interface{}{"ChannelID": "channel-1", "GuildID": "guild-1"}, "", "", "", "", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := Marshal(map[string]interface{}{
+		"User": map[string]interface{}{
+			"Nakama":  map[string]interface{}{"ID": userID, "CustomID": "999", "Username": "mallory"},
+			"Discord": map[string]interface{}{"ChannelID": "elsewhere", "AuthorID": "999", "Username": "mallory"},
+		},
+	})
+	payload := string(Marshal(&pb.CreateTicketRequest{Ticket: &pb.Ticket{
+		Extensions: map[string]*any.Any{nakamaCommands.TICKET_EXTENSION_USER: &any.Any{Value: forged}},
+	}}))
+	response, err := OpenMatchFrontendTicketCreateRPC(ctx, nil, nil, nk, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ticket *pb.Ticket
+	if err := json.Unmarshal([]byte(response), &ticket); err != nil {
+		t.Fatal(err)
+	}
+	teamUser, err := nakamaCommands.UnmarshalTeamUser(ticket.Extensions[nakamaCommands.TICKET_EXTENSION_USER].Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nakama, discord := teamUser.User.Nakama, teamUser.User.Discord
+	if nakama.ID != userID || nakama.CustomID != "111" || nakama.Username != "alice" {
+		t.Errorf("expected the Nakama user of the account, got %+v", nakama)
+	}
+	if discord.ChannelID != "channel-1" || discord.GuildID != "guild-1" || discord.AuthorID != "111" || discord.Username != "alice" {
+		t.Errorf("expected the Discord user of the account, got %+v", discord)
+	}
+}
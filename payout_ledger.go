@@ -0,0 +1,331 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	PAYOUT_LEDGER_COLLECTION = "payout_ledger"
+
+	PAYOUT_STATUS_PENDING   = "pending"
+	PAYOUT_STATUS_PAID      = "paid"
+	PAYOUT_STATUS_COMPLETED = "completed"
+
+	PAYOUT_ISSUE_MISSING_LEDGER = "missing ledger"
+	PAYOUT_ISSUE_INCOMPLETE     = "incomplete"
+	PAYOUT_ISSUE_MISSING        = "missing payout"
+	PAYOUT_ISSUE_DUPLICATE      = "duplicate payout"
+)
+
+// Payout is the amount credited to a user for a match, Reward comes from the reward rule and Prize from the escrow
+type Payout struct {
+	UserID   string
+	Currency string
+	Outcome  string
+	Reward   float64
+	Prize    float64
+}
+
+// PayoutLedger is created before the rewards of a match are distributed, its existence makes the distribution exactly-once.
+// Its status records the last step done: pending before the payouts, paid before the rating update and completed after it.
+type PayoutLedger struct {
+	MatchID      string
+	WinnerTeamID int
+	Draw         bool
+	RewardRule   string
+	Status       string
+	Payouts      []*Payout
+	DateTime     time.Time
+	Version      string
+}
+
+type PayoutIssue struct {
+	MatchID  string
+	UserID   string
+	Issue    string
+	Expected int
+	Found    int
+}
+
+type PayoutReconciliation struct {
+	MatchesChecked int
+	LedgersResumed int
+	Issues         []*PayoutIssue
+}
+
+func readPayoutLedger(ctx context.Context, nk runtime.NakamaModule, matchID string) (*PayoutLedger, error) {
+	var ledger *PayoutLedger
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: PAYOUT_LEDGER_COLLECTION,
+		Key:        matchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &ledger); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	ledger.Version = storageObjects[0].Version
+	return ledger, nil
+}
+
+func writePayoutLedger(ctx context.Context, nk runtime.NakamaModule, ledger *PayoutLedger) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      PAYOUT_LEDGER_COLLECTION,
+			Key:             ledger.MatchID,
+			Value:           string(Marshal(ledger)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         ledger.Version,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for payout ledger of match %v", ledger.MatchID)
+	}
+	ledger.Version = acks[0].Version
+	return nil
+}
+
+// createPayoutLedger claims the distribution of the match rewards,
+// it returns nil without error when the rewards of the match were already claimed
+func createPayoutLedger(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, winnerTeam *nakamaCommands.Team) (*PayoutLedger, error) {
+	ledger := &PayoutLedger{
+		MatchID:  s.MatchID,
+		Draw:     winnerTeam == nil,
+		Status:   PAYOUT_STATUS_PENDING,
+		DateTime: matchClock.Now().UTC(),
+		Version:  "*",
+	}
+	if winnerTeam != nil {
+		ledger.WinnerTeamID = winnerTeam.ID
+	}
+	if err := writePayoutLedger(ctx, nk, ledger); err != nil {
+		if isStorageVersionConflict(err) {
+			log.Infof("match_id: %v rewards were already distributed", s.MatchID)
+			return nil, nil
+		}
+		log.Error(err)
+		return nil, err
+	}
+	return ledger, nil
+}
+
+// applyPayoutLedgerRewards finishes the steps of an existing payout ledger which are not done yet
+// and restores the rewards of the team users from it
+func applyPayoutLedgerRewards(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) error {
+	ledger, err := readPayoutLedger(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if ledger == nil {
+		return nil
+	}
+	if err := completePayoutLedger(ctx, nk, s, ledger); err != nil {
+		log.Error(err)
+		return err
+	}
+	rewards := make(map[string]float64)
+	for _, payout := range ledger.Payouts {
+		rewards[payout.UserID] = payout.Reward + payout.Prize
+	}
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		teamUser.Reward = rewards[teamUser.User.Nakama.ID]
+	}
+	return nil
+}
+
+// completePayoutLedger runs the steps of the payout ledger from its status on, so a distribution interrupted
+// after the claim is resumed where it stopped. The payouts of a pending ledger are distributed again without crediting
+// the rewards found in the wallet ledgers or the prize pool already settled by the escrow twice,
+// then the ratings of a paid ledger are updated.
+func completePayoutLedger(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, ledger *PayoutLedger) error {
+	winnerTeam, err := getPayoutLedgerWinnerTeam(s, ledger)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if ledger.Status == PAYOUT_STATUS_PENDING {
+		ledger.Payouts = nil
+		if err := distributeRewards(ctx, nk, winnerTeam, s, ledger); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	if ledger.Status != PAYOUT_STATUS_PAID {
+		return nil
+	}
+	if err := updateRatings(ctx, nk, winnerTeam, s); err != nil {
+		log.Error(err)
+		return err
+	}
+	ledger.Status = PAYOUT_STATUS_COMPLETED
+	if err := writePayoutLedger(ctx, nk, ledger); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("match_id: %v payout ledger completed", s.MatchID)
+	return nil
+}
+
+// getPayoutLedgerWinnerTeam returns the team of the match the payout ledger was claimed for, nil for a draw
+func getPayoutLedgerWinnerTeam(s *nakamaCommands.MatchState, ledger *PayoutLedger) (*nakamaCommands.Team, error) {
+	if ledger.Draw {
+		return nil, nil
+	}
+	for _, team := range s.Teams {
+		if team.ID == ledger.WinnerTeamID {
+			return team, nil
+		}
+	}
+	return nil, fmt.Errorf("Winner team %v not found in match %v", ledger.WinnerTeamID, s.MatchID)
+}
+
+func countWalletPayouts(items []runtime.WalletLedgerItem, matchID string) (int, int) {
+	rewards := 0
+	prizes := 0
+	for _, item := range items {
+		metadata := item.GetMetadata()
+		if metadata["MatchID"] != matchID {
+			continue
+		}
+		if _, ok := metadata["Outcome"]; ok {
+			rewards++
+		}
+		if metadata["Escrow"] == ESCROW_ENTRY_PAYOUT {
+			prizes++
+		}
+	}
+	return rewards, prizes
+}
+
+// filterAppliedRewards drops the wallet updates of the users whose reward for the match is already in their wallet ledger,
+// so the rewards of a pending payout ledger can be distributed again without crediting them twice
+func filterAppliedRewards(ctx context.Context, nk runtime.NakamaModule, matchID string, walletUpdates []*runtime.WalletUpdate) ([]*runtime.WalletUpdate, error) {
+	var pending []*runtime.WalletUpdate
+	for _, walletUpdate := range walletUpdates {
+		items, err := listWalletLedger(ctx, nk, walletUpdate.UserID)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if rewards, _ := countWalletPayouts(items, matchID); rewards > 0 {
+			log.Infof("match_id: %v reward already credited to %v", matchID, walletUpdate.UserID)
+			continue
+		}
+		pending = append(pending, walletUpdate)
+	}
+	return pending, nil
+}
+
+func getPayoutIssue(matchID string, userID string, issue string, expected int, found int) *PayoutIssue {
+	if expected == found {
+		return nil
+	}
+	if found > expected {
+		issue = PAYOUT_ISSUE_DUPLICATE
+	}
+	return &PayoutIssue{MatchID: matchID, UserID: userID, Issue: issue, Expected: expected, Found: found}
+}
+
+// reconcilePayouts completes the unfinished payout ledgers of the archived matches and compares the wallet ledger entries
+// of the users against the payout ledgers
+func reconcilePayouts(ctx context.Context, nk runtime.NakamaModule) (*PayoutReconciliation, error) {
+	matchStateList, err := matchStateListGet(ctx, nk, nakamaContext.NakamaSystemUserID, nakamaCommands.MATCH_ARCHIVE_COLLECTION)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	reconciliation := &PayoutReconciliation{Issues: []*PayoutIssue{}}
+	walletLedgers := make(map[string][]runtime.WalletLedgerItem)
+	for _, s := range matchStateList {
+		if s.Status == nakamaCommands.MATCH_STATUS_CANCELED {
+			continue
+		}
+		reconciliation.MatchesChecked++
+
+		ledger, err := readPayoutLedger(ctx, nk, s.MatchID)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if ledger == nil {
+			reconciliation.Issues = append(reconciliation.Issues, &PayoutIssue{MatchID: s.MatchID, Issue: PAYOUT_ISSUE_MISSING_LEDGER})
+			continue
+		}
+		if ledger.Status != PAYOUT_STATUS_COMPLETED {
+			if err := completePayoutLedger(ctx, nk, s, ledger); err != nil {
+				log.Error(err)
+			} else {
+				reconciliation.LedgersResumed++
+				// the wallet ledgers listed before the resume miss the rewards it credited
+				walletLedgers = make(map[string][]runtime.WalletLedgerItem)
+			}
+		}
+		if ledger.Status != PAYOUT_STATUS_COMPLETED {
+			reconciliation.Issues = append(reconciliation.Issues, &PayoutIssue{MatchID: s.MatchID, Issue: PAYOUT_ISSUE_INCOMPLETE})
+		}
+
+		for _, payout := range ledger.Payouts {
+			items, ok := walletLedgers[payout.UserID]
+			if !ok {
+				if items, err = listWalletLedger(ctx, nk, payout.UserID); err != nil {
+					log.Error(err)
+					return nil, err
+				}
+				walletLedgers[payout.UserID] = items
+			}
+
+			expectedRewards := 0
+			if payout.Reward != 0 {
+				expectedRewards = 1
+			}
+			expectedPrizes := 0
+			if payout.Prize != 0 {
+				expectedPrizes = 1
+			}
+			rewards, prizes := countWalletPayouts(items, s.MatchID)
+			if issue := getPayoutIssue(s.MatchID, payout.UserID, PAYOUT_ISSUE_MISSING, expectedRewards, rewards); issue != nil {
+				reconciliation.Issues = append(reconciliation.Issues, issue)
+			}
+			if issue := getPayoutIssue(s.MatchID, payout.UserID, PAYOUT_ISSUE_MISSING, expectedPrizes, prizes); issue != nil {
+				reconciliation.Issues = append(reconciliation.Issues, issue)
+			}
+		}
+	}
+	return reconciliation, nil
+}
+
+func PayoutReconcileRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	reconciliation, err := reconcilePayouts(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	log.Infof("Payout reconciliation checked %v matches, resumed %v ledgers, found %v issues", reconciliation.MatchesChecked, reconciliation.LedgersResumed, len(reconciliation.Issues))
+	return MarshalIndent(reconciliation), nil
+}
@@ -12,9 +12,17 @@ import (
 	log "github.com/micro/go-micro/v2/logger"
 )
 
+const (
+	FAKE_USERS_COUNT = 10
+)
+
+func getFakeUsername(i int) string {
+	return "testuser#" + strconv.Itoa(i)
+}
+
 func CreateFakeUsers(ctx context.Context, nk runtime.NakamaModule) error {
-	for i := 0; i < 10; i++ {
-		username := "testuser#" + strconv.Itoa(i)
+	for i := 0; i < FAKE_USERS_COUNT; i++ {
+		username := getFakeUsername(i)
 		if string1, string2, val, err := nk.AuthenticateCustom(ctx, username, username, true); err != nil {
 			log.Infof("%+s %+s %+s %+s", string1, string2, val, err)
 			log.Error(err)
@@ -30,39 +38,45 @@ func PoolJoinRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runt
 		return "", err
 	}
 
-	msg, err := poolJoin(ctx, nk, request.MatchID, request.UserID)
+	userID, err := getActingUserID(ctx, nk, "PoolJoin", request.MatchID, request.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
-	return msg, nil
-}
 
-func poolJoin(ctx context.Context, nk runtime.NakamaModule, matchID string, userID string) (string, error) {
-	matchState, err := readMatchState(ctx, nk, getDummyMatchState(matchID, nakamaCommands.MATCH_COLLECTION))
+	msg, err := poolJoin(ctx, nk, request.MatchID, userID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	return msg, nil
+}
 
+func poolJoin(ctx context.Context, nk runtime.NakamaModule, matchID string, userID string) (string, error) {
 	account, err := nk.AccountGetId(ctx, userID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	if nakamaCommands.IsStringInSlice(userID, matchState.PoolUserIDs) {
-		return fmt.Sprintf("User <@%v> already joined match pool %v", account.CustomId, matchID), nil
-	}
-
-	matchState.PoolUserIDs = append(matchState.PoolUserIDs, userID)
-	matchState.PoolUserCustomIDs = append(matchState.PoolUserCustomIDs, account.CustomId)
-	_, err = writeMatchState(ctx, nk, matchState)
-	if err != nil {
+	msg := ""
+	if _, err := updateMatchState(ctx, nk, matchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		if err := checkMatchAction(tx, MATCH_ACTION_POOL_JOIN); err != nil {
+			return err
+		}
+		if nakamaCommands.IsStringInSlice(userID, matchState.PoolUserIDs) {
+			msg = fmt.Sprintf("User <@%v> already joined match pool %v", account.CustomId, matchID)
+			return errMatchStateUnchanged
+		}
+		msg = fmt.Sprintf("User <@%v> joined match pool %v", account.CustomId, matchID)
+		matchState.PoolUserIDs = append(matchState.PoolUserIDs, userID)
+		matchState.PoolUserCustomIDs = append(matchState.PoolUserCustomIDs, account.CustomId)
+		return nil
+	}); err != nil {
 		log.Error(err)
 		return "", err
 	}
-	return fmt.Sprintf("User <@%v> joined match pool %v", account.CustomId, matchID), nil
+	return msg, nil
 }
 
 func PoolPickRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
@@ -72,91 +86,110 @@ func PoolPickRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runt
 		return "", err
 	}
 
-	msg, err := poolPick(ctx, nk, request.MatchID, request.CaptainUserID, request.UserID)
+	captainUserID, err := getActingUserID(ctx, nk, "PoolPick", request.MatchID, request.CaptainUserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
-	return msg, nil
-}
 
-func poolPick(ctx context.Context, nk runtime.NakamaModule, matchID string, captainUserID string, userID string) (string, error) {
-	matchState, err := readMatchState(ctx, nk, getDummyMatchState(matchID, nakamaCommands.MATCH_COLLECTION))
+	msg, err := poolPick(ctx, nk, request.MatchID, captainUserID, request.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	return msg, nil
+}
 
+func poolPick(ctx context.Context, nk runtime.NakamaModule, matchID string, captainUserID string, userID string) (string, error) {
 	captainAccount, err := nk.AccountGetId(ctx, captainUserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	if !nakamaCommands.IsStringInSlice(captainAccount.CustomId, matchState.CaptainUserIDs) {
-		return fmt.Sprintf("User <@%v> is not a captain in match %v", captainAccount.CustomId, matchID), nil
-	}
-
-	if captainAccount.CustomId != matchState.CaptainTurnUserID {
-		return fmt.Sprintf("Current captain draft turn is for captain <@%v>, match %v", matchState.CaptainTurnUserID, matchID), nil
-	}
-
 	account, err := nk.AccountGetId(ctx, userID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	if !nakamaCommands.IsStringInSlice(userID, matchState.PoolUserIDs) {
-		return fmt.Sprintf("User <@%v> is not joined match pool %v", account.CustomId, matchID), nil
-	}
+	msg := ""
+	nextCaptainTurnUserIDMsg := ""
+	matchState, err := updateMatchState(ctx, nk, matchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		msg = ""
+		nextCaptainTurnUserIDMsg = ""
+		if err := checkMatchAction(tx, MATCH_ACTION_POOL_PICK); err != nil {
+			return err
+		}
 
-	var newPoolUserIDs []string
-	for _, v := range matchState.PoolUserIDs {
-		if v != userID {
-			newPoolUserIDs = append(newPoolUserIDs, v)
+		if !nakamaCommands.IsStringInSlice(captainAccount.CustomId, matchState.CaptainUserIDs) {
+			msg = fmt.Sprintf("User <@%v> is not a captain in match %v", captainAccount.CustomId, matchID)
+			return errMatchStateUnchanged
 		}
-	}
-	matchState.PoolUserIDs = newPoolUserIDs
 
-	var newPoolUserCustomIDs []string
-	for _, v := range matchState.PoolUserCustomIDs {
-		if v != account.CustomId {
-			newPoolUserIDs = append(newPoolUserIDs, v)
+		if captainAccount.CustomId != matchState.CaptainTurnUserID {
+			msg = fmt.Sprintf("Current captain draft turn is for captain <@%v>, match %v", matchState.CaptainTurnUserID, matchID)
+			return errMatchStateUnchanged
 		}
-	}
-	matchState.PoolUserCustomIDs = newPoolUserCustomIDs
 
-	ticketState, err := readLastUserIDTicketState(ctx, nk, userID)
-	if err != nil {
-		log.Error(err)
-		return "", err
-	}
+		if !nakamaCommands.IsStringInSlice(userID, matchState.PoolUserIDs) {
+			msg = fmt.Sprintf("User <@%v> is not joined match pool %v", account.CustomId, matchID)
+			return errMatchStateUnchanged
+		}
 
-	teamUser, _ := nakamaCommands.UnmarshalTeamUser(ticketState.Ticket.Extensions[nakamaCommands.TICKET_EXTENSION_USER].Value)
-	teamUser.Captain = false
-	teamUser.TicketID = ticketState.Ticket.Id
-	teamUser.Reward = 0
+		var newPoolUserIDs []string
+		for _, v := range matchState.PoolUserIDs {
+			if v != userID {
+				newPoolUserIDs = append(newPoolUserIDs, v)
+			}
+		}
+		matchState.PoolUserIDs = newPoolUserIDs
 
-	teamNumber := nakamaCommands.GetTeamNumberFromUserAndMatch(captainUserID, matchState)
-	log.Infof("%+v\n", teamNumber)
-	matchState.Teams[teamNumber].TeamUsers = append(matchState.Teams[teamNumber].TeamUsers, teamUser)
-	matchState.ReadyUserIDs = append(matchState.ReadyUserIDs, teamUser.User.Nakama.ID)
+		var newPoolUserCustomIDs []string
+		for _, v := range matchState.PoolUserCustomIDs {
+			if v != account.CustomId {
+				newPoolUserCustomIDs = append(newPoolUserCustomIDs, v)
+			}
+		}
+		matchState.PoolUserCustomIDs = newPoolUserCustomIDs
 
-	nextCaptainTurnUserID := getNextCaptainTurnUserID(matchState)
-	log.Infof("Next CaptainTurnUserID %v", nextCaptainTurnUserID)
+		ticketState, err := readLastUserIDTicketState(ctx, nk, userID)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
 
-	nextCaptainTurnUserIDMsg := ""
-	if nextCaptainTurnUserID != matchState.CaptainTurnUserID && nextCaptainTurnUserID != "" {
-		nextCaptainTurnUserIDMsg = fmt.Sprintf("\nCaptain <@%v>'s pick turn!", nextCaptainTurnUserID)
-		matchState.CaptainTurnUserID = nextCaptainTurnUserID
-	}
+		teamUser, _ := nakamaCommands.UnmarshalTeamUser(ticketState.Ticket.Extensions[nakamaCommands.TICKET_EXTENSION_USER].Value)
+		teamUser.Captain = false
+		teamUser.TicketID = ticketState.Ticket.Id
+		teamUser.Reward = 0
 
-	_, err = writeMatchState(ctx, nk, matchState)
+		teamNumber := nakamaCommands.GetTeamNumberFromUserAndMatch(captainUserID, matchState)
+		log.Infof("%+v\n", teamNumber)
+		matchState.Teams[teamNumber].TeamUsers = append(matchState.Teams[teamNumber].TeamUsers, teamUser)
+		matchState.ReadyUserIDs = append(matchState.ReadyUserIDs, teamUser.User.Nakama.ID)
+
+		profile, err := getMatchProfile(ctx, nk, matchState)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		nextCaptainTurnUserID := getNextCaptainTurnUserID(matchState, profile)
+		log.Infof("Next CaptainTurnUserID %v", nextCaptainTurnUserID)
+
+		if nextCaptainTurnUserID != matchState.CaptainTurnUserID && nextCaptainTurnUserID != "" {
+			nextCaptainTurnUserIDMsg = fmt.Sprintf("\nCaptain <@%v>'s pick turn!", nextCaptainTurnUserID)
+			matchState.CaptainTurnUserID = nextCaptainTurnUserID
+		}
+		return nil
+	})
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	if msg != "" {
+		return msg, nil
+	}
 
 	if err := notifyDiscordUsers(
 		nakamaCommands.GetUsersFromMatch(matchState),
@@ -166,14 +199,14 @@ func poolPick(ctx context.Context, nk runtime.NakamaModule, matchID string, capt
 	return "", nil
 }
 
-func getNextCaptainTurnUserID(matchState *nakamaCommands.MatchState) string {
-	usersPerCaptainTurn := nakamaCommands.CAPTAINS_DRAFT_MODES_MAP[matchState.MatchProfile].UsersPerCaptainTurn
+func getNextCaptainTurnUserID(matchState *nakamaCommands.MatchState, profile *MatchProfile) string {
+	usersPerCaptainTurn := profile.DraftOrder
 	log.Infof("usersPerCaptainTurn %v", usersPerCaptainTurn)
 
-	captainsCount := nakamaCommands.CAPTAINS_DRAFT_MODES_MAP[matchState.MatchProfile].TeamCount
+	captainsCount := profile.TeamCount
 	log.Infof("captainsCount %v", captainsCount)
 
-	usersInTeam := nakamaCommands.CAPTAINS_DRAFT_MODES_MAP[matchState.MatchProfile].UsersInTeam
+	usersInTeam := profile.UsersInTeam
 	log.Infof("usersInTeam %v", usersInTeam)
 
 	currentUsersInTeamsCount := len(nakamaCommands.GetTeamUsersFromTeams(matchState.Teams))
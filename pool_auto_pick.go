@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	MATCH_DRAFT_TURN_COLLECTION = "match_draft_turn"
+
+	AUTO_PICK_STRATEGY_RATING   = "rating"
+	AUTO_PICK_STRATEGY_EARLIEST = "earliest"
+	AUTO_PICK_STRATEGY_RANDOM   = "random"
+)
+
+// MatchDraftTurn tracks when the current captain pick turn has started
+type MatchDraftTurn struct {
+	MatchID        string
+	CaptainUserID  string
+	TeamUsersCount int
+	DateTimeStart  time.Time
+	Version        string
+}
+
+func readMatchDraftTurn(ctx context.Context, nk runtime.NakamaModule, matchID string) (*MatchDraftTurn, error) {
+	var turn *MatchDraftTurn
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: MATCH_DRAFT_TURN_COLLECTION,
+		Key:        matchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &turn); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	turn.Version = storageObjects[0].Version
+	return turn, nil
+}
+
+func writeMatchDraftTurn(ctx context.Context, nk runtime.NakamaModule, turn *MatchDraftTurn) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      MATCH_DRAFT_TURN_COLLECTION,
+			Key:             turn.MatchID,
+			Value:           string(Marshal(turn)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         turn.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for draft turn of match %v", turn.MatchID)
+	}
+	turn.Version = acks[0].Version
+	return nil
+}
+
+func deleteMatchDraftTurn(ctx context.Context, nk runtime.NakamaModule, matchID string) error {
+	if err := nk.StorageDelete(ctx, []*runtime.StorageDelete{
+		&runtime.StorageDelete{
+			Collection: MATCH_DRAFT_TURN_COLLECTION,
+			Key:        matchID,
+			UserID:     nakamaContext.NakamaSystemUserID,
+		},
+	}); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+func getCaptainTeamUser(s *nakamaCommands.MatchState, captainCustomID string) *nakamaCommands.TeamUser {
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		if teamUser.Captain && teamUser.User.Nakama.CustomID == captainCustomID {
+			return teamUser
+		}
+	}
+	return nil
+}
+
+func getAutoPickUserIDByRating(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) (string, error) {
+	_, ownerRecords, _, _, err := nk.LeaderboardRecordsList(ctx, nakamaCommands.MAIN_LEADERBOARD, s.PoolUserIDs, nakamaCommands.MAX_LIST_LIMIT, "", 0)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	scores := make(map[string]int64)
+	for _, record := range ownerRecords {
+		scores[record.OwnerId] = record.Score
+	}
+	// PoolUserIDs are kept in join order, so ties are resolved in favour of the earliest joiner
+	bestUserID := s.PoolUserIDs[0]
+	for _, userID := range s.PoolUserIDs[1:] {
+		if scores[userID] > scores[bestUserID] {
+			bestUserID = userID
+		}
+	}
+	return bestUserID, nil
+}
+
+func getAutoPickUserID(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, strategy string) (string, error) {
+	if len(s.PoolUserIDs) == 0 {
+		return "", nil
+	}
+	switch strategy {
+	case AUTO_PICK_STRATEGY_RATING:
+		return getAutoPickUserIDByRating(ctx, nk, s)
+	case AUTO_PICK_STRATEGY_RANDOM:
+		i, err := drawMatchRandom(ctx, nk, s.MatchID, MATCH_RANDOM_AUTO_PICK, len(s.PoolUserIDs))
+		if err != nil {
+			log.Error(err)
+			return "", err
+		}
+		return s.PoolUserIDs[i], nil
+	case AUTO_PICK_STRATEGY_EARLIEST:
+		return s.PoolUserIDs[0], nil
+	}
+	return "", fmt.Errorf("Unknown auto pick strategy %v", strategy)
+}
+
+// checkDraftTurnTimeout starts the deadline of a new captain turn and auto-picks for the captain once it expires
+func checkDraftTurnTimeout(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState, teamUsersCount int, settings *MatchProfileSettings) error {
+	if settings.PickTimeoutSeconds <= 0 {
+		return nil
+	}
+	turn, err := readMatchDraftTurn(ctx, nk, s.MatchID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if turn == nil {
+		turn = &MatchDraftTurn{MatchID: s.MatchID, Version: "*"}
+	}
+	if turn.CaptainUserID != s.CaptainTurnUserID || turn.TeamUsersCount != teamUsersCount {
+		turn.CaptainUserID = s.CaptainTurnUserID
+		turn.TeamUsersCount = teamUsersCount
+		turn.DateTimeStart = matchClock.Now().UTC()
+		return writeMatchDraftTurn(ctx, nk, turn)
+	}
+	if matchClock.Now().UTC().Before(turn.DateTimeStart.Add(settings.PickTimeout())) {
+		return nil
+	}
+
+	userID, err := getAutoPickUserID(ctx, nk, s, settings.AutoPickStrategy)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if userID == "" {
+		log.Infof("match_id: %v Pick turn of captain %v expired, but the pool is empty", s.MatchID, s.CaptainTurnUserID)
+		return nil
+	}
+	captain := getCaptainTeamUser(s, s.CaptainTurnUserID)
+	if captain == nil {
+		return fmt.Errorf("Captain %v not found in match %v", s.CaptainTurnUserID, s.MatchID)
+	}
+	log.Infof("match_id: %v Pick turn of captain %v expired, auto-picking %v with strategy %v", s.MatchID, s.CaptainTurnUserID, userID, settings.AutoPickStrategy)
+	if _, err := poolPick(ctx, nk, s.MatchID, captain.User.Nakama.ID, userID); err != nil {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
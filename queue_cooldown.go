@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	QUEUE_COOLDOWN_COLLECTION = "queue_cooldown"
+	QUEUE_COOLDOWN_KEY        = "last"
+)
+
+type QueueCooldown struct {
+	UserID      string
+	MatchID     string
+	Reason      string
+	DateTimeEnd time.Time
+	Version     string
+}
+
+func readQueueCooldown(ctx context.Context, nk runtime.NakamaModule, userID string) (*QueueCooldown, error) {
+	var cooldown *QueueCooldown
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: QUEUE_COOLDOWN_COLLECTION,
+		Key:        QUEUE_COOLDOWN_KEY,
+		UserID:     userID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &cooldown); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	cooldown.Version = storageObjects[0].Version
+	return cooldown, nil
+}
+
+func writeQueueCooldown(ctx context.Context, nk runtime.NakamaModule, cooldown *QueueCooldown) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      QUEUE_COOLDOWN_COLLECTION,
+			Key:             QUEUE_COOLDOWN_KEY,
+			Value:           string(Marshal(cooldown)),
+			UserID:          cooldown.UserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for queue cooldown of user %v", cooldown.UserID)
+	}
+	return nil
+}
+
+func createQueueCooldown(ctx context.Context, nk runtime.NakamaModule, userID string, matchID string, reason string, duration time.Duration) error {
+	if duration <= 0 {
+		return nil
+	}
+	return writeQueueCooldown(ctx, nk, &QueueCooldown{
+		UserID:      userID,
+		MatchID:     matchID,
+		Reason:      reason,
+		DateTimeEnd: matchClock.Now().UTC().Add(duration),
+	})
+}
+
+// checkQueueCooldown returns an error while the user is not allowed to queue
+func checkQueueCooldown(ctx context.Context, nk runtime.NakamaModule, userID string) error {
+	cooldown, err := readQueueCooldown(ctx, nk, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if cooldown == nil || matchClock.Now().UTC().After(cooldown.DateTimeEnd) {
+		return nil
+	}
+	return runtime.NewError(fmt.Sprintf("Unable to queue until **%v** (%v, match **%v**)", cooldown.DateTimeEnd.Format(time.RFC1123), cooldown.Reason, cooldown.MatchID), 9)
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strings"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+	"open-match.dev/open-match/pkg/pb"
+)
+
+const (
+	RATING_COLLECTION  = "rating"
+	RATING_LEADERBOARD = "rating"
+
+	RATING_SYSTEM_GLICKO2 = "glicko2"
+	RATING_SYSTEM_ELO     = "elo"
+
+	DEFAULT_RATING            = 1500.0
+	DEFAULT_RATING_DEVIATION  = 350.0
+	DEFAULT_RATING_VOLATILITY = 0.06
+
+	ELO_K_FACTOR = 32.0
+
+	GLICKO2_SCALE       = 173.7178
+	GLICKO2_TAU         = 0.5
+	GLICKO2_CONVERGENCE = 0.000001
+
+	RATING_RESULT_WIN  = "win"
+	RATING_RESULT_LOSS = "loss"
+	RATING_RESULT_DRAW = "draw"
+
+	RATING_RECENT_RESULTS_LIMIT = 10
+	RATING_PROVISIONAL_MATCHES  = 5
+	RATING_STREAK_LENGTH        = 3
+
+	// Search fields injected into the Open Match tickets, client supplied values are overwritten
+	SEARCH_RATING               = "rating"
+	SEARCH_RATING_DEVIATION     = "rating.deviation"
+	SEARCH_RATING_MATCHES_COUNT = "rating.matches"
+	SEARCH_HISTORY_WIN_RATIO    = "history.win_ratio"
+	SEARCH_HISTORY_STREAK       = "history.streak"
+
+	TAG_RATING_PROVISIONAL  = "rating.provisional"
+	TAG_HISTORY_WIN_STREAK  = "history.win_streak"
+	TAG_HISTORY_LOSS_STREAK = "history.loss_streak"
+)
+
+type PlayerRating struct {
+	UserID       string
+	MatchProfile string
+	Rating       float64
+	Deviation    float64
+	Volatility   float64
+	MatchesCount int
+	// RecentResults holds the outcomes of the latest matches, the most recent first
+	RecentResults []string
+	Version       string
+}
+
+// ratingOpponent is the composite rating of an opposing team together with the score against it
+type ratingOpponent struct {
+	Rating    float64
+	Deviation float64
+	Score     float64
+}
+
+func newPlayerRating(userID string, matchProfile string) *PlayerRating {
+	return &PlayerRating{
+		UserID:       userID,
+		MatchProfile: matchProfile,
+		Rating:       DEFAULT_RATING,
+		Deviation:    DEFAULT_RATING_DEVIATION,
+		Volatility:   DEFAULT_RATING_VOLATILITY,
+		Version:      "*",
+	}
+}
+
+func getRatingLeaderboardID(matchProfile string) string {
+	return RATING_LEADERBOARD + "." + matchProfile
+}
+
+func readPlayerRatings(ctx context.Context, nk runtime.NakamaModule, userIDs []string, matchProfile string) (map[string]*PlayerRating, error) {
+	var reads []*runtime.StorageRead
+	for _, userID := range userIDs {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: RATING_COLLECTION,
+			Key:        matchProfile,
+			UserID:     userID,
+		})
+	}
+	ratings := make(map[string]*PlayerRating)
+	if len(reads) == 0 {
+		return ratings, nil
+	}
+	storageObjects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	for _, object := range storageObjects {
+		var rating *PlayerRating
+		if err := json.Unmarshal([]byte(object.Value), &rating); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		rating.Version = object.Version
+		ratings[object.UserId] = rating
+	}
+	for _, userID := range userIDs {
+		if _, ok := ratings[userID]; !ok {
+			ratings[userID] = newPlayerRating(userID, matchProfile)
+		}
+	}
+	return ratings, nil
+}
+
+func writePlayerRating(ctx context.Context, nk runtime.NakamaModule, rating *PlayerRating) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      RATING_COLLECTION,
+			Key:             rating.MatchProfile,
+			Value:           string(Marshal(rating)),
+			UserID:          rating.UserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         rating.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for rating of user %v", rating.UserID)
+	}
+	rating.Version = acks[0].Version
+	return nil
+}
+
+func getTeamCompositeRating(team *nakamaCommands.Team, ratings map[string]*PlayerRating) (float64, float64) {
+	if len(team.TeamUsers) == 0 {
+		return DEFAULT_RATING, DEFAULT_RATING_DEVIATION
+	}
+	rating := 0.0
+	deviation := 0.0
+	for _, teamUser := range team.TeamUsers {
+		rating += ratings[teamUser.User.Nakama.ID].Rating
+		deviation += ratings[teamUser.User.Nakama.ID].Deviation
+	}
+	return rating / float64(len(team.TeamUsers)), deviation / float64(len(team.TeamUsers))
+}
+
+// getRatingOpponents returns the opposing teams of the team with the score it achieved against each of them.
+// With a winner every other team lost to it, the order of the losing teams is unknown so they are not compared.
+func getRatingOpponents(s *nakamaCommands.MatchState, teamIndex int, winnerTeam *nakamaCommands.Team, ratings map[string]*PlayerRating) []*ratingOpponent {
+	var opponents []*ratingOpponent
+	for i, team := range s.Teams {
+		if i == teamIndex {
+			continue
+		}
+		score := 0.5
+		if winnerTeam != nil {
+			switch {
+			case s.Teams[teamIndex].ID == winnerTeam.ID:
+				score = 1
+			case team.ID == winnerTeam.ID:
+				score = 0
+			default:
+				continue
+			}
+		}
+		rating, deviation := getTeamCompositeRating(team, ratings)
+		opponents = append(opponents, &ratingOpponent{Rating: rating, Deviation: deviation, Score: score})
+	}
+	return opponents
+}
+
+func updateEloRating(player *PlayerRating, opponents []*ratingOpponent) *PlayerRating {
+	updated := *player
+	for _, opponent := range opponents {
+		expected := 1 / (1 + math.Pow(10, (opponent.Rating-player.Rating)/400))
+		updated.Rating += ELO_K_FACTOR * (opponent.Score - expected)
+	}
+	return &updated
+}
+
+func glicko2G(phi float64) float64 {
+	return 1 / math.Sqrt(1+3*phi*phi/(math.Pi*math.Pi))
+}
+
+func glicko2E(mu float64, muOpponent float64, phiOpponent float64) float64 {
+	return 1 / (1 + math.Exp(-glicko2G(phiOpponent)*(mu-muOpponent)))
+}
+
+// glicko2Volatility computes the new volatility with the Illinois algorithm from step 5 of the Glicko-2 paper
+func glicko2Volatility(phi float64, sigma float64, v float64, delta float64) float64 {
+	a := math.Log(sigma * sigma)
+	f := func(x float64) float64 {
+		ex := math.Exp(x)
+		return ex*(delta*delta-phi*phi-v-ex)/(2*math.Pow(phi*phi+v+ex, 2)) - (x-a)/(GLICKO2_TAU*GLICKO2_TAU)
+	}
+	A := a
+	var B float64
+	if delta*delta > phi*phi+v {
+		B = math.Log(delta*delta - phi*phi - v)
+	} else {
+		k := 1.0
+		for f(a-k*GLICKO2_TAU) < 0 {
+			k++
+		}
+		B = a - k*GLICKO2_TAU
+	}
+	fA := f(A)
+	fB := f(B)
+	for math.Abs(B-A) > GLICKO2_CONVERGENCE {
+		C := A + (A-B)*fA/(fB-fA)
+		fC := f(C)
+		if fC*fB <= 0 {
+			A = B
+			fA = fB
+		} else {
+			fA = fA / 2
+		}
+		B = C
+		fB = fC
+	}
+	return math.Exp(A / 2)
+}
+
+func updateGlicko2Rating(player *PlayerRating, opponents []*ratingOpponent) *PlayerRating {
+	updated := *player
+	mu := (player.Rating - DEFAULT_RATING) / GLICKO2_SCALE
+	phi := player.Deviation / GLICKO2_SCALE
+	if len(opponents) == 0 {
+		updated.Deviation = math.Min(math.Sqrt(phi*phi+player.Volatility*player.Volatility)*GLICKO2_SCALE, DEFAULT_RATING_DEVIATION)
+		return &updated
+	}
+
+	vInverse := 0.0
+	improvement := 0.0
+	for _, opponent := range opponents {
+		muOpponent := (opponent.Rating - DEFAULT_RATING) / GLICKO2_SCALE
+		phiOpponent := opponent.Deviation / GLICKO2_SCALE
+		g := glicko2G(phiOpponent)
+		e := glicko2E(mu, muOpponent, phiOpponent)
+		vInverse += g * g * e * (1 - e)
+		improvement += g * (opponent.Score - e)
+	}
+	v := 1 / vInverse
+	delta := v * improvement
+
+	sigma := glicko2Volatility(phi, player.Volatility, v, delta)
+	phiStar := math.Sqrt(phi*phi + sigma*sigma)
+	phiNew := 1 / math.Sqrt(1/(phiStar*phiStar)+1/v)
+	muNew := mu + phiNew*phiNew*improvement
+
+	updated.Rating = muNew*GLICKO2_SCALE + DEFAULT_RATING
+	updated.Deviation = phiNew * GLICKO2_SCALE
+	updated.Volatility = sigma
+	return &updated
+}
+
+// updateRatings computes the new ratings of every participant from the final team outcome, a nil winner team is a draw
+func updateRatings(ctx context.Context, nk runtime.NakamaModule, winnerTeam *nakamaCommands.Team, s *nakamaCommands.MatchState) error {
+	if len(s.Teams) < 2 {
+		return nil
+	}
+	var userIDs []string
+	for _, teamUser := range nakamaCommands.GetTeamUsersFromMatch(s) {
+		userIDs = append(userIDs, teamUser.User.Nakama.ID)
+	}
+	ratings, err := readPlayerRatings(ctx, nk, userIDs, s.MatchProfile)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	ratingSystem := getMatchSettings(ctx, nk, s).RatingSystem
+	for i, team := range s.Teams {
+		opponents := getRatingOpponents(s, i, winnerTeam, ratings)
+		result := RATING_RESULT_DRAW
+		if winnerTeam != nil {
+			result = RATING_RESULT_LOSS
+			if team.ID == winnerTeam.ID {
+				result = RATING_RESULT_WIN
+			}
+		}
+		for _, teamUser := range team.TeamUsers {
+			player := ratings[teamUser.User.Nakama.ID]
+			var updated *PlayerRating
+			if ratingSystem == RATING_SYSTEM_ELO {
+				updated = updateEloRating(player, opponents)
+			} else {
+				updated = updateGlicko2Rating(player, opponents)
+			}
+			updated.MatchesCount++
+			updated.RecentResults = append([]string{result}, updated.RecentResults...)
+			if len(updated.RecentResults) > RATING_RECENT_RESULTS_LIMIT {
+				updated.RecentResults = updated.RecentResults[:RATING_RECENT_RESULTS_LIMIT]
+			}
+			if err := writePlayerRating(ctx, nk, updated); err != nil {
+				log.Error(err)
+				return err
+			}
+
+			metadata := map[string]interface{}{
+				"Deviation":  updated.Deviation,
+				"Volatility": updated.Volatility,
+				"MatchID":    s.MatchID,
+			}
+			if _, err := nk.LeaderboardRecordWrite(
+				ctx,
+				getRatingLeaderboardID(s.MatchProfile),
+				teamUser.User.Nakama.ID,
+				teamUser.User.Nakama.CustomID,
+				int64(math.Round(updated.Rating)),
+				0,
+				metadata,
+			); err != nil {
+				log.Errorf("failed to update rating leaderboard: %v", err)
+			}
+			log.Infof("User %v rating %.1f -> %.1f (deviation %.1f) in %v", teamUser.User.Nakama.ID, player.Rating, updated.Rating, updated.Deviation, s.MatchProfile)
+		}
+	}
+	return nil
+}
+
+// getRecentResultsStats returns the win ratio of the recent matches and the length of the current streak,
+// positive for a win streak and negative for a loss streak
+func getRecentResultsStats(rating *PlayerRating) (float64, int) {
+	if len(rating.RecentResults) == 0 {
+		return 0.5, 0
+	}
+	wins := 0.0
+	for _, result := range rating.RecentResults {
+		switch result {
+		case RATING_RESULT_WIN:
+			wins++
+		case RATING_RESULT_DRAW:
+			wins += 0.5
+		}
+	}
+
+	streak := 0
+	for _, result := range rating.RecentResults {
+		if result != rating.RecentResults[0] || result == RATING_RESULT_DRAW {
+			break
+		}
+		if result == RATING_RESULT_WIN {
+			streak++
+		} else {
+			streak--
+		}
+	}
+	return wins / float64(len(rating.RecentResults)), streak
+}
+
+// getTicketMatchProfile returns the match profile of the catalog requested by the ticket tags, empty when none is known
+func getTicketMatchProfile(ctx context.Context, nk runtime.NakamaModule, ticket *pb.Ticket) (string, error) {
+	if ticket.SearchFields == nil {
+		return "", nil
+	}
+	catalog, err := getMatchProfileCatalog(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	for _, tag := range ticket.SearchFields.Tags {
+		if _, ok := catalog[tag]; ok {
+			return tag, nil
+		}
+	}
+	return "", nil
+}
+
+func isRatingSearchField(name string) bool {
+	return strings.HasPrefix(name, SEARCH_RATING) || strings.HasPrefix(name, "history.")
+}
+
+// enrichTicketWithRating replaces the rating and match history search fields of the ticket with the stored values of the user
+// so the director can balance the teams and clients can not forge their own rating
+func enrichTicketWithRating(ctx context.Context, nk runtime.NakamaModule, ticket *pb.Ticket, userID string) error {
+	matchProfile, err := getTicketMatchProfile(ctx, nk, ticket)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	rating := newPlayerRating(userID, matchProfile)
+	if matchProfile != "" {
+		ratings, err := readPlayerRatings(ctx, nk, []string{userID}, matchProfile)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		rating = ratings[userID]
+	} else {
+		log.Errorf("No known match profile in the ticket tags of user %v, default rating is used", userID)
+	}
+
+	if ticket.SearchFields == nil {
+		ticket.SearchFields = &pb.SearchFields{}
+	}
+	if ticket.SearchFields.DoubleArgs == nil {
+		ticket.SearchFields.DoubleArgs = make(map[string]float64)
+	}
+	for name := range ticket.SearchFields.DoubleArgs {
+		if isRatingSearchField(name) {
+			delete(ticket.SearchFields.DoubleArgs, name)
+		}
+	}
+	var tags []string
+	for _, tag := range ticket.SearchFields.Tags {
+		if !isRatingSearchField(tag) {
+			tags = append(tags, tag)
+		}
+	}
+
+	winRatio, streak := getRecentResultsStats(rating)
+	ticket.SearchFields.DoubleArgs[SEARCH_RATING] = rating.Rating
+	ticket.SearchFields.DoubleArgs[SEARCH_RATING_DEVIATION] = rating.Deviation
+	ticket.SearchFields.DoubleArgs[SEARCH_RATING_MATCHES_COUNT] = float64(rating.MatchesCount)
+	ticket.SearchFields.DoubleArgs[SEARCH_HISTORY_WIN_RATIO] = winRatio
+	ticket.SearchFields.DoubleArgs[SEARCH_HISTORY_STREAK] = float64(streak)
+
+	if rating.MatchesCount < RATING_PROVISIONAL_MATCHES {
+		tags = append(tags, TAG_RATING_PROVISIONAL)
+	}
+	switch {
+	case streak >= RATING_STREAK_LENGTH:
+		tags = append(tags, TAG_HISTORY_WIN_STREAK)
+	case streak <= -RATING_STREAK_LENGTH:
+		tags = append(tags, TAG_HISTORY_LOSS_STREAK)
+	}
+	ticket.SearchFields.Tags = tags
+
+	log.Infof("Ticket of user %v enriched with rating %.1f (deviation %.1f) for profile %v", userID, rating.Rating, rating.Deviation, matchProfile)
+	return nil
+}
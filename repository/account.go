@@ -0,0 +1,172 @@
+// Package repository wraps the Nakama database with parameterized queries for the data the runtime API does not expose
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+
+	"github.com/gofrs/uuid"
+	"github.com/golang/protobuf/ptypes/timestamp"
+	"github.com/heroiclabs/nakama-common/api"
+	"github.com/jackc/pgx/pgtype"
+)
+
+var ErrAccountNotFound = errors.New("account not found")
+
+const accountColumns = `
+SELECT u.username, u.display_name, u.avatar_url, u.lang_tag, u.location, u.timezone, u.metadata, u.wallet,
+	u.email, u.facebook_id, u.facebook_instant_game_id, u.google_id, u.gamecenter_id, u.steam_id, u.custom_id, u.id, u.edge_count,
+	u.create_time, u.update_time, u.verify_time, u.disable_time, array(select ud.id from user_device ud where u.id = ud.user_id)
+FROM users u`
+
+// rowScanner is implemented by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+type AccountRepository struct {
+	db *sql.DB
+}
+
+func NewAccountRepository(db *sql.DB) *AccountRepository {
+	return &AccountRepository{db: db}
+}
+
+// scanAccount maps a row selected with accountColumns to an account
+func scanAccount(row rowScanner) (*api.Account, error) {
+	var displayName sql.NullString
+	var username sql.NullString
+	var avatarURL sql.NullString
+	var langTag sql.NullString
+	var location sql.NullString
+	var timezone sql.NullString
+	var metadata sql.NullString
+	var wallet sql.NullString
+	var email sql.NullString
+	var facebook sql.NullString
+	var facebookInstantGame sql.NullString
+	var google sql.NullString
+	var gamecenter sql.NullString
+	var steam sql.NullString
+	var customID sql.NullString
+	var userID uuid.UUID
+	var edgeCount int
+	var createTime pgtype.Timestamptz
+	var updateTime pgtype.Timestamptz
+	var verifyTime pgtype.Timestamptz
+	var disableTime pgtype.Timestamptz
+	var deviceIDs pgtype.VarcharArray
+
+	if err := row.Scan(&username, &displayName, &avatarURL, &langTag, &location, &timezone, &metadata, &wallet, &email, &facebook, &facebookInstantGame, &google, &gamecenter, &steam, &customID, &userID, &edgeCount, &createTime, &updateTime, &verifyTime, &disableTime, &deviceIDs); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, ErrAccountNotFound
+		}
+		return nil, err
+	}
+
+	devices := make([]*api.AccountDevice, 0, len(deviceIDs.Elements))
+	for _, deviceID := range deviceIDs.Elements {
+		devices = append(devices, &api.AccountDevice{Id: deviceID.String})
+	}
+
+	return &api.Account{
+		User: &api.User{
+			Id:                    userID.String(),
+			Username:              username.String,
+			DisplayName:           displayName.String,
+			AvatarUrl:             avatarURL.String,
+			LangTag:               langTag.String,
+			Location:              location.String,
+			Timezone:              timezone.String,
+			Metadata:              metadata.String,
+			FacebookId:            facebook.String,
+			FacebookInstantGameId: facebookInstantGame.String,
+			GoogleId:              google.String,
+			GamecenterId:          gamecenter.String,
+			SteamId:               steam.String,
+			EdgeCount:             int32(edgeCount),
+			CreateTime:            &timestamp.Timestamp{Seconds: createTime.Time.Unix()},
+			UpdateTime:            &timestamp.Timestamp{Seconds: updateTime.Time.Unix()},
+			Online:                false,
+		},
+		Wallet:      wallet.String,
+		Email:       email.String,
+		Devices:     devices,
+		CustomId:    customID.String,
+		VerifyTime:  getTimestamp(verifyTime),
+		DisableTime: getTimestamp(disableTime),
+	}, nil
+}
+
+// getTimestamp returns nil for a missing time and for the epoch, which Nakama uses as "not set"
+func getTimestamp(t pgtype.Timestamptz) *timestamp.Timestamp {
+	if t.Status != pgtype.Present || t.Time.Unix() == 0 {
+		return nil
+	}
+	return &timestamp.Timestamp{Seconds: t.Time.Unix()}
+}
+
+// GetByCustomID returns the account with the custom ID, ErrAccountNotFound when there is none
+func (r *AccountRepository) GetByCustomID(ctx context.Context, customID string) (*api.Account, error) {
+	return scanAccount(r.db.QueryRowContext(ctx, accountColumns+`
+WHERE u.custom_id = $1`, customID))
+}
+
+// GetByEmail returns the account the email is linked to, ErrAccountNotFound when there is none
+func (r *AccountRepository) GetByEmail(ctx context.Context, email string) (*api.Account, error) {
+	return scanAccount(r.db.QueryRowContext(ctx, accountColumns+`
+WHERE u.email = $1`, email))
+}
+
+// GetByCustomIDs returns the accounts found for the custom IDs keyed by custom ID, missing accounts are left out
+func (r *AccountRepository) GetByCustomIDs(ctx context.Context, customIDs []string) (map[string]*api.Account, error) {
+	accounts := make(map[string]*api.Account, len(customIDs))
+	if len(customIDs) == 0 {
+		return accounts, nil
+	}
+
+	ids := &pgtype.TextArray{}
+	if err := ids.Set(customIDs); err != nil {
+		return nil, err
+	}
+	rows, err := r.db.QueryContext(ctx, accountColumns+`
+WHERE u.custom_id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		account, err := scanAccount(rows)
+		if err != nil {
+			return nil, err
+		}
+		accounts[account.CustomId] = account
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return accounts, nil
+}
+
+// Verify marks the account as verified now
+func (r *AccountRepository) Verify(ctx context.Context, userID string) error {
+	return r.exec(ctx, `UPDATE users SET verify_time = now() WHERE id = $1`, userID)
+}
+
+// ResetVerification sets the verify time of the account back to the epoch, Nakama's "not verified"
+func (r *AccountRepository) ResetVerification(ctx context.Context, userID string) error {
+	return r.exec(ctx, `UPDATE users SET verify_time = '1970-01-01 00:00:00 UTC' WHERE id = $1`, userID)
+}
+
+func (r *AccountRepository) exec(ctx context.Context, query string, userID string) error {
+	result, err := r.db.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+	if rowsAffected, err := result.RowsAffected(); err == nil && rowsAffected == 0 {
+		return ErrAccountNotFound
+	}
+	return nil
+}
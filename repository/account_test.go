@@ -0,0 +1,172 @@
+package repository
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	aliceID = "5c8cbbd1-2f0d-4bd7-9b3b-3d8b7a3e0a01"
+	bobID   = "5c8cbbd1-2f0d-4bd7-9b3b-3d8b7a3e0a02"
+)
+
+func newAccountFixture() *fixture {
+	created := time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC)
+	return newFixture(
+		&fixtureUser{
+			ID:         aliceID,
+			Username:   "alice",
+			CustomID:   "111",
+			Email:      "alice@example.com",
+			Metadata:   `{"Discord":"alice#0001"}`,
+			Wallet:     `{"coins":100}`,
+			EdgeCount:  2,
+			CreateTime: created,
+			UpdateTime: created.Add(time.Hour),
+			VerifyTime: created.Add(2 * time.Hour),
+			DeviceIDs:  []string{"device-a", "device-b"},
+		},
+		&fixtureUser{
+			ID:         bobID,
+			Username:   "bob",
+			CustomID:   "222",
+			SteamID:    "76561198000000000",
+			CreateTime: created,
+			UpdateTime: created,
+			VerifyTime: time.Unix(0, 0).UTC(),
+		},
+	)
+}
+
+func TestGetByCustomID(t *testing.T) {
+	f := newAccountFixture()
+	account, err := NewAccountRepository(f.open()).GetByCustomID(context.Background(), "111")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if account.User.Id != aliceID || account.User.Username != "alice" || account.CustomId != "111" {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if account.Email != "alice@example.com" || account.Wallet != `{"coins":100}` || account.User.Metadata != `{"Discord":"alice#0001"}` {
+		t.Errorf("unexpected account %+v", account)
+	}
+	if account.User.EdgeCount != 2 || account.User.LangTag != "en" || account.User.DisplayName != "" {
+		t.Errorf("unexpected user %+v", account.User)
+	}
+	if account.User.CreateTime.Seconds != time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("unexpected create time %v", account.User.CreateTime)
+	}
+	if account.VerifyTime == nil || account.VerifyTime.Seconds != time.Date(2020, 5, 1, 14, 0, 0, 0, time.UTC).Unix() {
+		t.Errorf("unexpected verify time %v", account.VerifyTime)
+	}
+	if account.DisableTime != nil {
+		t.Errorf("the epoch disable time must be unset, got %v", account.DisableTime)
+	}
+	if len(account.Devices) != 2 || account.Devices[0].Id != "device-a" || account.Devices[1].Id != "device-b" {
+		t.Errorf("unexpected devices %v", account.Devices)
+	}
+}
+
+func TestGetByCustomIDUnverified(t *testing.T) {
+	f := newAccountFixture()
+	account, err := NewAccountRepository(f.open()).GetByCustomID(context.Background(), "222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.VerifyTime != nil {
+		t.Errorf("the epoch verify time must be unset, got %v", account.VerifyTime)
+	}
+	if account.Email != "" || account.User.SteamId != "76561198000000000" || len(account.Devices) != 0 {
+		t.Errorf("unexpected account %+v", account)
+	}
+}
+
+func TestGetByCustomIDNotFound(t *testing.T) {
+	f := newAccountFixture()
+	injection := "111' OR '1'='1"
+	if _, err := NewAccountRepository(f.open()).GetByCustomID(context.Background(), injection); err != ErrAccountNotFound {
+		t.Fatalf("expected ErrAccountNotFound, got %v", err)
+	}
+	for _, query := range f.queries {
+		if strings.Contains(query, injection) {
+			t.Errorf("the custom ID must be a parameter, got query %v", query)
+		}
+	}
+}
+
+func TestGetByEmail(t *testing.T) {
+	f := newAccountFixture()
+	repository := NewAccountRepository(f.open())
+	account, err := repository.GetByEmail(context.Background(), "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.User.Id != aliceID {
+		t.Errorf("expected %v, got %v", aliceID, account.User.Id)
+	}
+	if _, err := repository.GetByEmail(context.Background(), "carol@example.com"); err != ErrAccountNotFound {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+}
+
+func TestGetByCustomIDs(t *testing.T) {
+	f := newAccountFixture()
+	accounts, err := NewAccountRepository(f.open()).GetByCustomIDs(context.Background(), []string{"111", "222", "333", `"quoted",{}`})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 2 {
+		t.Fatalf("expected 2 accounts, got %v", len(accounts))
+	}
+	if accounts["111"].User.Id != aliceID || accounts["222"].User.Id != bobID {
+		t.Errorf("unexpected accounts %v", accounts)
+	}
+	if len(f.queries) != 1 {
+		t.Errorf("expected a single batch query, got %v", len(f.queries))
+	}
+}
+
+func TestGetByCustomIDsEmpty(t *testing.T) {
+	f := newAccountFixture()
+	accounts, err := NewAccountRepository(f.open()).GetByCustomIDs(context.Background(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(accounts) != 0 || len(f.queries) != 0 {
+		t.Errorf("expected no accounts and no query, got %v accounts and %v queries", len(accounts), len(f.queries))
+	}
+}
+
+func TestVerifyAndResetVerification(t *testing.T) {
+	f := newAccountFixture()
+	repository := NewAccountRepository(f.open())
+	ctx := context.Background()
+
+	if err := repository.Verify(ctx, bobID); err != nil {
+		t.Fatal(err)
+	}
+	account, err := repository.GetByCustomID(ctx, "222")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.VerifyTime == nil {
+		t.Error("expected the account to be verified")
+	}
+
+	if err := repository.ResetVerification(ctx, bobID); err != nil {
+		t.Fatal(err)
+	}
+	if account, err = repository.GetByCustomID(ctx, "222"); err != nil {
+		t.Fatal(err)
+	}
+	if account.VerifyTime != nil {
+		t.Errorf("expected the verification to be reset, got %v", account.VerifyTime)
+	}
+
+	if err := repository.Verify(ctx, "5c8cbbd1-2f0d-4bd7-9b3b-3d8b7a3e0a03"); err != ErrAccountNotFound {
+		t.Errorf("expected ErrAccountNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package repository
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/pgtype"
+)
+
+// fixtureUser is a row of the users table of the fixture database
+type fixtureUser struct {
+	ID         string
+	Username   string
+	CustomID   string
+	Email      string
+	SteamID    string
+	Metadata   string
+	Wallet     string
+	EdgeCount  int64
+	CreateTime time.Time
+	UpdateTime time.Time
+	VerifyTime time.Time
+	DeviceIDs  []string
+}
+
+// fixture is a database/sql driver which answers the queries of the repository from in-memory users, the parameters
+// go through the same driver value conversion as with Postgres so the text encoding of arrays is exercised
+type fixture struct {
+	mu      sync.Mutex
+	users   []*fixtureUser
+	queries []string
+}
+
+func newFixture(users ...*fixtureUser) *fixture {
+	return &fixture{users: users}
+}
+
+func (f *fixture) open() *sql.DB {
+	return sql.OpenDB(f)
+}
+
+func (f *fixture) Connect(ctx context.Context) (driver.Conn, error) {
+	return &fixtureConn{fixture: f}, nil
+}
+
+func (f *fixture) Driver() driver.Driver {
+	return nil
+}
+
+func (f *fixture) user(match func(*fixtureUser) bool) []*fixtureUser {
+	var users []*fixtureUser
+	for _, user := range f.users {
+		if match(user) {
+			users = append(users, user)
+		}
+	}
+	return users
+}
+
+type fixtureConn struct {
+	fixture *fixture
+}
+
+func (c *fixtureConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("fixture does not prepare statements: %v", query)
+}
+
+func (c *fixtureConn) Close() error {
+	return nil
+}
+
+func (c *fixtureConn) Begin() (driver.Tx, error) {
+	return nil, fmt.Errorf("fixture does not support transactions")
+}
+
+func (c *fixtureConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	f := c.fixture
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected one parameter, got %v", len(args))
+	}
+
+	var users []*fixtureUser
+	switch {
+	case strings.HasSuffix(query, "WHERE u.custom_id = ANY($1)"):
+		var customIDs pgtype.TextArray
+		if err := customIDs.Scan(args[0].Value); err != nil {
+			return nil, err
+		}
+		users = f.user(func(user *fixtureUser) bool {
+			for _, customID := range customIDs.Elements {
+				if customID.String == user.CustomID {
+					return true
+				}
+			}
+			return false
+		})
+	case strings.HasSuffix(query, "WHERE u.custom_id = $1"):
+		users = f.user(func(user *fixtureUser) bool { return user.CustomID == args[0].Value })
+	case strings.HasSuffix(query, "WHERE u.email = $1"):
+		users = f.user(func(user *fixtureUser) bool { return user.Email == args[0].Value })
+	default:
+		return nil, fmt.Errorf("unexpected query: %v", query)
+	}
+	return &fixtureRows{users: users}, nil
+}
+
+func (c *fixtureConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	f := c.fixture
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queries = append(f.queries, query)
+	if len(args) != 1 {
+		return nil, fmt.Errorf("expected one parameter, got %v", len(args))
+	}
+
+	var verifyTime time.Time
+	switch query {
+	case `UPDATE users SET verify_time = now() WHERE id = $1`:
+		verifyTime = time.Now().UTC()
+	case `UPDATE users SET verify_time = '1970-01-01 00:00:00 UTC' WHERE id = $1`:
+		verifyTime = time.Unix(0, 0).UTC()
+	default:
+		return nil, fmt.Errorf("unexpected statement: %v", query)
+	}
+	users := f.user(func(user *fixtureUser) bool { return user.ID == args[0].Value })
+	for _, user := range users {
+		user.VerifyTime = verifyTime
+	}
+	return driver.RowsAffected(len(users)), nil
+}
+
+type fixtureRows struct {
+	users []*fixtureUser
+}
+
+func (r *fixtureRows) Columns() []string {
+	return []string{
+		"username", "display_name", "avatar_url", "lang_tag", "location", "timezone", "metadata", "wallet",
+		"email", "facebook_id", "facebook_instant_game_id", "google_id", "gamecenter_id", "steam_id", "custom_id", "id", "edge_count",
+		"create_time", "update_time", "verify_time", "disable_time", "array",
+	}
+}
+
+func (r *fixtureRows) Close() error {
+	return nil
+}
+
+// nullString returns the Postgres NULL for an empty column
+func nullString(s string) driver.Value {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func (r *fixtureRows) Next(dest []driver.Value) error {
+	if len(r.users) == 0 {
+		return io.EOF
+	}
+	user := r.users[0]
+	r.users = r.users[1:]
+
+	deviceIDs := &pgtype.VarcharArray{}
+	if err := deviceIDs.Set(user.DeviceIDs); err != nil {
+		return err
+	}
+	devices, err := deviceIDs.Value()
+	if err != nil {
+		return err
+	}
+	values := []driver.Value{
+		nullString(user.Username), nil, nil, "en", nil, nil, nullString(user.Metadata), nullString(user.Wallet),
+		nullString(user.Email), nil, nil, nil, nil, nullString(user.SteamID), nullString(user.CustomID), user.ID, user.EdgeCount,
+		user.CreateTime, user.UpdateTime, user.VerifyTime, time.Unix(0, 0).UTC(), devices,
+	}
+	copy(dest, values)
+	return nil
+}
@@ -5,10 +5,6 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"os"
-	"sort"
-	"strconv"
-	"time"
 
 	nakamaCommands "github.com/challenge-league/nakama-go/commands"
 	"github.com/heroiclabs/nakama-common/runtime"
@@ -40,93 +36,57 @@ func isMatchResultExist(result *nakamaCommands.MatchResult, matchState *nakamaCo
 	return false
 }
 
-func isResultConsensusEstablished(s *nakamaCommands.MatchState) (isConsensusEstablished bool, team *nakamaCommands.Team) {
-	resultConsensusRatio, err := strconv.ParseFloat(os.Getenv("RESULT_CONSENSUS_RATIO"), 64)
-	if err != nil {
-		log.Error(err)
-		return false, nil
-	}
-	if float64(len(s.Results))/float64(len(s.Teams)*len(s.Teams[0].TeamUsers)) >= resultConsensusRatio {
-		teamResults := make(map[int]int)
-		for i := 0; i < len(s.Teams); i++ {
-			teamResults[i] = 0
-		}
-		drawCount := 0
-		for _, v := range s.Results {
-			if v.Draw {
-				drawCount++
-			}
-
-			if v.Win {
-				teamResults[v.TeamNumber] = teamResults[v.TeamNumber] + 1
-			} else {
-				teamResults[v.TeamNumber] = teamResults[v.TeamNumber] - 1
-			}
-		}
-
-		if drawCount > 0 {
-			if float64(len(s.Results))/float64(drawCount) >= resultConsensusRatio {
-				return true, nil
-			}
-		}
-
-		var ss []*nakamaCommands.TeamResult
-		for k, v := range teamResults {
-			ss = append(ss, &nakamaCommands.TeamResult{k, v})
-		}
-
-		sort.Slice(ss, func(i, j int) bool {
-			return ss[i].Votes > ss[j].Votes
-		})
-
-		if ss[0].Votes > ss[1].Votes {
-			return true, s.Teams[ss[0].TeamNumber]
-		}
-	}
-	return false, nil
-}
-
 func MatchResultRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var request *nakamaCommands.MatchResultRequest
 	if err := json.Unmarshal([]byte(payload), &request); err != nil {
 		log.Error(err)
 		return "", err
 	}
+	if request.MatchResult == nil {
+		return "", errInvalidArgument("MatchResult is required")
+	}
 
-	account, err := nk.AccountGetId(ctx, request.MatchResult.UserID)
+	userID, err := getActingUserID(ctx, nk, "MatchResult", request.MatchID, request.MatchResult.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
+	request.MatchResult.UserID = userID
 
-	matchState, err := readMatchState(ctx, nk, getDummyMatchState(request.MatchID, nakamaCommands.MATCH_COLLECTION))
+	account, err := nk.AccountGetId(ctx, request.MatchResult.UserID)
 	if err != nil {
 		log.Error(err)
 		return "", err
 	}
 
-	if !matchState.Started {
-		return fmt.Sprintf("Match **%v** is not started, unable to add the result. Please indicate that you are **ready** for the match or **cancel** it.", matchState.MatchID), nil
-	}
-
-	if !nakamaCommands.IsUserIDInMatch(account.User.Id, matchState) {
-		return "", fmt.Errorf("User <@%v> not found in match **%v**", account.User.Id, matchState.MatchID)
-	}
+	resultExists := false
+	matchState, err := updateMatchState(ctx, nk, request.MatchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		if err := checkMatchAction(tx, MATCH_ACTION_RESULT); err != nil {
+			return err
+		}
 
-	if !request.MatchResult.Draw && request.MatchResult.TeamNumber == -1 {
-		request.MatchResult.TeamNumber = nakamaCommands.GetTeamNumberFromUserAndMatch(account.User.Id, matchState)
-	}
+		if !nakamaCommands.IsUserIDInMatch(account.User.Id, matchState) {
+			return fmt.Errorf("User <@%v> not found in match **%v**", account.User.Id, matchState.MatchID)
+		}
 
-	if !isMatchResultExist(request.MatchResult, matchState) {
-		request.MatchResult.DateTime = time.Now().UTC()
-		matchState.Results = updateMatchResults(request.MatchResult, matchState)
+		if !request.MatchResult.Draw && request.MatchResult.TeamNumber == -1 {
+			request.MatchResult.TeamNumber = nakamaCommands.GetTeamNumberFromUserAndMatch(account.User.Id, matchState)
+		}
 
-		_, err = writeMatchState(ctx, nk, matchState)
-		if err != nil {
-			log.Error(err)
-			return "", err
+		resultExists = isMatchResultExist(request.MatchResult, matchState)
+		if resultExists {
+			return errMatchStateUnchanged
 		}
+		request.MatchResult.DateTime = matchClock.Now().UTC()
+		matchState.Results = updateMatchResults(request.MatchResult, matchState)
+		return nil
+	})
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
 
+	if !resultExists {
 		if request.MatchResult.Draw {
 			msg := "<@%v> reported result **Draw** for a Match **%v**"
 			if request.MatchResult.ProofLink != "" {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"os"
 
 	"github.com/heroiclabs/nakama-common/runtime"
 	log "github.com/micro/go-micro/v2/logger"
@@ -41,10 +40,19 @@ func getWinnerTeam(ctx context.Context, nk runtime.NakamaModule, matchState *nak
 }
 
 func distributeRewardsWithMessage(ctx context.Context, nk runtime.NakamaModule, winnerTeam *nakamaCommands.Team, matchState *nakamaCommands.MatchState, msg string) error {
-	if winnerTeam != nil {
-		if err := distributeRewards(ctx, nk, winnerTeam, matchState); err != nil {
+	ledger, err := createPayoutLedger(ctx, nk, matchState, winnerTeam)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if ledger != nil {
+		if err := completePayoutLedger(ctx, nk, matchState, ledger); err != nil {
 			log.Error(err)
 		}
+	} else if err := applyPayoutLedgerRewards(ctx, nk, matchState); err != nil {
+		log.Error(err)
+	}
+	if winnerTeam != nil {
 		msg = fmt.Sprintf(msg+"The **winner** team is \n", matchState.MatchID) + nakamaCommands.PrintTeam(winnerTeam)
 	} else {
 		msg = fmt.Sprintf(msg+"The result of the match is a **Draw**\n", matchState.MatchID)
@@ -52,60 +60,126 @@ func distributeRewardsWithMessage(ctx context.Context, nk runtime.NakamaModule,
 	if err := notifyDiscordUsers(nakamaCommands.GetUsersFromMatch(matchState), msg); err != nil {
 		log.Error(err)
 	}
-	if _, err := notifyDiscordChannel(os.Getenv("DISCORD_ANNOUNCEMENTS_RESULTS_CHANNEL_ID"), nakamaCommands.PrintMatchState(matchState)); err != nil {
+	if _, err := notifyDiscordChannel(getConfig().DiscordAnnouncementsResultsChannelID, nakamaCommands.PrintMatchState(matchState)); err != nil {
 		log.Error(err)
 	}
-	_, err := writeMatchState(ctx, nk, matchState)
-	if err != nil {
+	status := matchState.Status
+	teams := matchState.Teams
+	writeMatchStateInLoop(ctx, nk, matchState, func(s *nakamaCommands.MatchState, tx *matchStateTx) error {
+		s.Status = status
+		s.Teams = teams
+		return nil
+	})
+	if err := advanceBracket(ctx, nk, matchState, winnerTeam); err != nil {
 		log.Error(err)
 	}
 	return nil
 }
 
-func distributeRewards(ctx context.Context, nk runtime.NakamaModule, winnerTeam *nakamaCommands.Team, matchState *nakamaCommands.MatchState) error {
+// distributeRewards credits the users according to the reward rule of the match and records the payouts in the ledger,
+// a nil winner team is a draw
+func distributeRewards(ctx context.Context, nk runtime.NakamaModule, winnerTeam *nakamaCommands.Team, matchState *nakamaCommands.MatchState, ledger *PayoutLedger) error {
+	rule, err := readRewardRule(ctx, nk, matchState)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("match_id: %v reward rule %+v", matchState.MatchID, rule)
+
+	payouts, err := payoutMatchEscrow(ctx, nk, matchState, winnerTeam)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	ledger.RewardRule = rule.Name
 	var walletUpdates []*runtime.WalletUpdate
-	for _, v := range winnerTeam.TeamUsers {
-		//changeset := map[string]int64{"coins": int64(100)}
-		changeset := map[string]interface{}{"coins": float64(100)}
-		metadata := map[string]interface{}{"MatchID": matchState.MatchID}
-		walletUpdates = append(walletUpdates, &runtime.WalletUpdate{
-			UserID:    v.User.Nakama.ID,
-			Changeset: changeset,
-			Metadata:  metadata,
-		})
-	}
-	//_, err := nk.WalletsUpdate(ctx, walletUpdates, true)
-	err := nk.WalletsUpdate(ctx, walletUpdates, true)
+	for _, team := range matchState.Teams {
+		outcome, reward := getRewardOutcome(rule, team, winnerTeam)
+		for _, teamUser := range team.TeamUsers {
+			teamUser.Reward = reward + payouts[teamUser.User.Nakama.ID]
+			ledger.Payouts = append(ledger.Payouts, &Payout{
+				UserID:   teamUser.User.Nakama.ID,
+				Currency: rule.Currency,
+				Outcome:  outcome,
+				Reward:   reward,
+				Prize:    payouts[teamUser.User.Nakama.ID],
+			})
+			if reward == 0 {
+				continue
+			}
+			changeset := map[string]interface{}{rule.Currency: reward}
+			metadata := map[string]interface{}{
+				"MatchID":    matchState.MatchID,
+				"RewardRule": rule.Name,
+				"Outcome":    outcome,
+				"Amount":     reward,
+			}
+			walletUpdates = append(walletUpdates, &runtime.WalletUpdate{
+				UserID:    teamUser.User.Nakama.ID,
+				Changeset: changeset,
+				Metadata:  metadata,
+			})
+		}
+	}
+	walletUpdates, err = filterAppliedRewards(ctx, nk, matchState.MatchID, walletUpdates)
 	if err != nil {
-		log.Errorf("failed to update winner wallets: %v", err)
+		log.Error(err)
+		return err
+	}
+	if len(walletUpdates) > 0 {
+		if err := nk.WalletsUpdate(ctx, walletUpdates, true); err != nil {
+			log.Errorf("failed to update wallets: %v", err)
+			return err
+		}
+	}
+	ledger.Status = PAYOUT_STATUS_PAID
+	if err := writePayoutLedger(ctx, nk, ledger); err != nil {
+		log.Error(err)
 		return err
 	}
 
+	season, err := getActiveSeason(ctx, nk)
+	if err != nil {
+		log.Error(err)
+	}
+
 	for _, team := range matchState.Teams {
+		outcome, _ := getRewardOutcome(rule, team, winnerTeam)
 		for _, teamUser := range team.TeamUsers {
 			metadata := make(map[string]interface{})
 			metadata["winner"] = "false"
-			score := int64(0)
-			subscore := int64(0)
-			if team.ID == winnerTeam.ID {
+			if outcome == REWARD_OUTCOME_WIN {
 				metadata["winner"] = "true"
-				score = int64(100)
-				subscore = int64(0)
-				teamUser.Reward = float64(100)
 			}
+			metadata["outcome"] = outcome
+			metadata["rewardRule"] = rule.Name
 			if _, err := nk.LeaderboardRecordWrite(
 				ctx,
 				nakamaCommands.MAIN_LEADERBOARD,
 				teamUser.User.Nakama.ID,
 				teamUser.User.Nakama.CustomID,
-				score,
-				subscore,
+				getLeaderboardScore(outcome),
+				int64(0),
 				metadata,
 			); err != nil {
-				log.Errorf("failed to update winner wallets: %v", err)
+				log.Errorf("failed to update leaderboard record: %v", err)
 				return err
 
 			}
+			if season != nil {
+				if _, err := nk.LeaderboardRecordWrite(
+					ctx,
+					getSeasonLeaderboardID(season.ID),
+					teamUser.User.Nakama.ID,
+					teamUser.User.Nakama.CustomID,
+					getLeaderboardScore(outcome),
+					int64(0),
+					metadata,
+				); err != nil {
+					log.Errorf("failed to update season leaderboard record: %v", err)
+				}
+			}
 		}
 	}
 
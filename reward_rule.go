@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	REWARD_RULE_COLLECTION  = "reward_rule"
+	REWARD_RULE_DEFAULT_KEY = "default"
+
+	REWARD_CURRENCY_COINS = "coins"
+
+	REWARD_OUTCOME_WIN  = "win"
+	REWARD_OUTCOME_LOSS = "loss"
+	REWARD_OUTCOME_DRAW = "draw"
+
+	// LEADERBOARD_WIN_SCORE is the leaderboard score of a win, it does not depend on the reward rule
+	LEADERBOARD_WIN_SCORE = 100
+)
+
+// RewardRule describes the economy of a match, it is stored in the REWARD_RULE_COLLECTION of the system user
+// with the key named by the RewardRule of the match profile, "<profile>.<match type>", "<profile>", "<match type>"
+// or REWARD_RULE_DEFAULT_KEY, the first found is applied
+type RewardRule struct {
+	Name     string
+	Currency string
+	// WinnerPayout is credited to every user of the winner team
+	WinnerPayout float64
+	// LoserPayout is credited to every user of the other teams
+	LoserPayout float64
+	// DrawShare is the part of the winner payout credited to every user on a draw
+	DrawShare float64
+	// ParticipationReward is credited to every user in addition to the outcome payout
+	ParticipationReward float64
+	// EntryFee is debited from every user into the match escrow when the match is created
+	// and paid out as a prize pool to the winner team
+	EntryFee float64
+	// HouseRake is the part of the prize pool kept by the house, from 0 to 1
+	HouseRake float64
+}
+
+func getDefaultRewardRule() *RewardRule {
+	return &RewardRule{
+		Name:         REWARD_RULE_DEFAULT_KEY,
+		Currency:     REWARD_CURRENCY_COINS,
+		WinnerPayout: 100,
+	}
+}
+
+func getRewardRuleKeys(s *nakamaCommands.MatchState, profile *MatchProfile) []string {
+	var keys []string
+	if profile.RewardRule != "" {
+		keys = append(keys, profile.RewardRule)
+	}
+	if s.MatchProfile != "" && s.MatchType != "" {
+		keys = append(keys, s.MatchProfile+"."+s.MatchType)
+	}
+	if s.MatchProfile != "" {
+		keys = append(keys, s.MatchProfile)
+	}
+	if s.MatchType != "" {
+		keys = append(keys, s.MatchType)
+	}
+	return append(keys, REWARD_RULE_DEFAULT_KEY)
+}
+
+// validateRewardRule rejects a rule stored with the key which would create money or turn the escrow negative
+func validateRewardRule(key string, rule *RewardRule) error {
+	if rule == nil {
+		return errInvalidArgument("Reward rule %v is required", key)
+	}
+	if err := validateRequired("Currency", rule.Currency); err != nil {
+		return err
+	}
+	for _, amount := range []struct {
+		name  string
+		value float64
+	}{
+		{"WinnerPayout", rule.WinnerPayout},
+		{"LoserPayout", rule.LoserPayout},
+		{"DrawShare", rule.DrawShare},
+		{"ParticipationReward", rule.ParticipationReward},
+		{"EntryFee", rule.EntryFee},
+	} {
+		if amount.value < 0 {
+			return errInvalidArgument("Reward rule %v %v must not be negative", key, amount.name)
+		}
+	}
+	if rule.HouseRake < 0 || rule.HouseRake > 1 {
+		return errInvalidArgument("Reward rule %v HouseRake must be from 0 to 1", key)
+	}
+	return nil
+}
+
+// readRewardRule returns the most specific reward rule stored for the match, the built-in default when none is stored
+func readRewardRule(ctx context.Context, nk runtime.NakamaModule, s *nakamaCommands.MatchState) (*RewardRule, error) {
+	profile, err := getMatchProfile(ctx, nk, s)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	keys := getRewardRuleKeys(s, profile)
+	var reads []*runtime.StorageRead
+	for _, key := range keys {
+		reads = append(reads, &runtime.StorageRead{
+			Collection: REWARD_RULE_COLLECTION,
+			Key:        key,
+			UserID:     nakamaContext.NakamaSystemUserID,
+		})
+	}
+	storageObjects, err := nk.StorageRead(ctx, reads)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	values := make(map[string]string)
+	for _, object := range storageObjects {
+		values[object.Key] = object.Value
+	}
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			continue
+		}
+		var rule *RewardRule
+		if err := json.Unmarshal([]byte(value), &rule); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if rule.Name == "" {
+			rule.Name = key
+		}
+		if rule.Currency == "" {
+			rule.Currency = REWARD_CURRENCY_COINS
+		}
+		if err := validateRewardRule(key, rule); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		return rule, nil
+	}
+	return getDefaultRewardRule(), nil
+}
+
+// getRewardOutcome returns the outcome of the team and the amount the rule credits to each of its users
+func getRewardOutcome(rule *RewardRule, team *nakamaCommands.Team, winnerTeam *nakamaCommands.Team) (string, float64) {
+	switch {
+	case winnerTeam == nil:
+		return REWARD_OUTCOME_DRAW, rule.WinnerPayout*rule.DrawShare + rule.ParticipationReward
+	case team.ID == winnerTeam.ID:
+		return REWARD_OUTCOME_WIN, rule.WinnerPayout + rule.ParticipationReward
+	}
+	return REWARD_OUTCOME_LOSS, rule.LoserPayout + rule.ParticipationReward
+}
+
+// getLeaderboardScore returns the leaderboard score of an outcome, the coins credited by the reward rule are not counted
+func getLeaderboardScore(outcome string) int64 {
+	if outcome == REWARD_OUTCOME_WIN {
+		return LEADERBOARD_WIN_SCORE
+	}
+	return 0
+}
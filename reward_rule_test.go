@@ -0,0 +1,35 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/heroiclabs/nakama-common/runtime"
+)
+
+func writeTestRewardRule(nk *FakeNakamaModule, rule *RewardRule) error {
+	_, err := StorageWriteRPC(context.Background(), nil, nil, nk, string(Marshal([]*runtime.StorageWrite{{
+		Collection: REWARD_RULE_COLLECTION,
+		Key:        REWARD_RULE_DEFAULT_KEY,
+		Value:      string(Marshal(rule)),
+	}})))
+	return err
+}
+
+func TestStorageWriteValidatesTheRewardRule(t *testing.T) {
+	nk := NewFakeNakamaModule()
+	for name, rule := range map[string]*RewardRule{
+		"rake above 1":       {Currency: REWARD_CURRENCY_COINS, EntryFee: 10, HouseRake: 1.5},
+		"negative rake":      {Currency: REWARD_CURRENCY_COINS, EntryFee: 10, HouseRake: -0.1},
+		"negative entry fee": {Currency: REWARD_CURRENCY_COINS, EntryFee: -10},
+		"negative payout":    {Currency: REWARD_CURRENCY_COINS, LoserPayout: -5},
+		"no currency":        {WinnerPayout: 100},
+	} {
+		if err := writeTestRewardRule(nk, rule); err == nil {
+			t.Errorf("expected the reward rule with %v to be rejected", name)
+		}
+	}
+	if err := writeTestRewardRule(nk, &RewardRule{Currency: REWARD_CURRENCY_COINS, WinnerPayout: 100, EntryFee: 10, HouseRake: 0.1}); err != nil {
+		t.Errorf("expected a valid reward rule to be written, got %v", err)
+	}
+}
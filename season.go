@@ -0,0 +1,613 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	SEASON_COLLECTION           = "season"
+	SEASON_STANDINGS_COLLECTION = "season_standings"
+	SEASON_PLACEMENT_COLLECTION = "season_placement"
+	USER_BADGE_COLLECTION       = "badge"
+	SEASON_LEADERBOARD          = "season"
+
+	SEASON_STATUS_OPEN   = "open"
+	SEASON_STATUS_ENDING = "ending"
+	SEASON_STATUS_ENDED  = "ended"
+
+	// SEASON_END_CHECK_INTERVAL is how often the expired seasons are ended in the background
+	SEASON_END_CHECK_INTERVAL = time.Minute
+)
+
+// SeasonReward is granted to the users with a final rank from MinRank to MaxRank inclusive
+type SeasonReward struct {
+	MinRank int64
+	MaxRank int64
+	Coins   float64
+	Badge   string
+}
+
+type Season struct {
+	ID            string
+	Name          string
+	DateTimeStart time.Time
+	DateTimeEnd   time.Time
+	Status        string
+	Rewards       []*SeasonReward
+	Version       string
+}
+
+type SeasonStanding struct {
+	Rank     int64
+	UserID   string
+	Username string
+	Score    int64
+}
+
+type SeasonStandings struct {
+	SeasonID  string
+	Standings []*SeasonStanding
+	DateTime  time.Time
+}
+
+// SeasonPlacement is the final standing of a user in a season together with the granted rewards
+type SeasonPlacement struct {
+	SeasonID   string
+	SeasonName string
+	Rank       int64
+	Score      int64
+	Coins      float64
+	Badge      string
+	DateTime   time.Time
+}
+
+type UserBadge struct {
+	Badge    string
+	SeasonID string
+	DateTime time.Time
+}
+
+type SeasonCreateRequest struct {
+	ID            string
+	Name          string
+	DateTimeStart time.Time
+	DateTimeEnd   time.Time
+	Rewards       []*SeasonReward
+}
+
+type SeasonEndRequest struct {
+	ID string
+}
+
+type SeasonPlacementsGetRequest struct {
+	UserID string
+}
+
+func getSeasonLeaderboardID(seasonID string) string {
+	return SEASON_LEADERBOARD + "." + seasonID
+}
+
+func isSeasonActive(season *Season, now time.Time) bool {
+	return season.Status == SEASON_STATUS_OPEN && !now.Before(season.DateTimeStart) && now.Before(season.DateTimeEnd)
+}
+
+func readSeason(ctx context.Context, nk runtime.NakamaModule, seasonID string) (*Season, error) {
+	var season *Season
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: SEASON_COLLECTION,
+		Key:        seasonID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &season); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	season.Version = storageObjects[0].Version
+	return season, nil
+}
+
+func writeSeason(ctx context.Context, nk runtime.NakamaModule, season *Season) error {
+	acks, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      SEASON_COLLECTION,
+			Key:             season.ID,
+			Value:           string(Marshal(season)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         season.Version,
+		},
+	})
+
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+
+	if len(acks) != 1 {
+		log.Errorf("Invocation failed. Return result not expected: %v", len(acks))
+		return fmt.Errorf("Unexpected storage write result for season %v", season.ID)
+	}
+	season.Version = acks[0].Version
+	return nil
+}
+
+// listSeasons returns all the seasons ordered by their start date
+func listSeasons(ctx context.Context, nk runtime.NakamaModule) ([]*Season, error) {
+	var seasons []*Season
+	cursor := ""
+	for {
+		storageObjects, nextCursor, err := nk.StorageList(ctx, nakamaContext.NakamaSystemUserID, SEASON_COLLECTION, nakamaCommands.MAX_LIST_LIMIT, cursor)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		for _, object := range storageObjects {
+			var season *Season
+			if err := json.Unmarshal([]byte(object.Value), &season); err != nil {
+				log.Error(err)
+				return nil, err
+			}
+			season.Version = object.Version
+			seasons = append(seasons, season)
+		}
+		if nextCursor == "" {
+			break
+		}
+		cursor = nextCursor
+	}
+	sort.Slice(seasons, func(i, j int) bool {
+		return seasons[i].DateTimeStart.Before(seasons[j].DateTimeStart)
+	})
+	return seasons, nil
+}
+
+// getActiveSeason ends the expired seasons and returns the season running now, nil between seasons
+func getActiveSeason(ctx context.Context, nk runtime.NakamaModule) (*Season, error) {
+	if err := endExpiredSeasons(ctx, nk); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	seasons, err := listSeasons(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	now := matchClock.Now().UTC()
+	for _, season := range seasons {
+		if isSeasonActive(season, now) {
+			return season, nil
+		}
+	}
+	return nil, nil
+}
+
+func createSeasonLeaderboards(ctx context.Context, nk runtime.NakamaModule) error {
+	seasons, err := listSeasons(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, season := range seasons {
+		if season.Status == SEASON_STATUS_ENDED {
+			continue
+		}
+		if err := nk.LeaderboardCreate(ctx, getSeasonLeaderboardID(season.ID), true, "desc", "incr", "", map[string]interface{}{"SeasonID": season.ID}); err != nil {
+			log.Error(err)
+		}
+	}
+	return nil
+}
+
+func listSeasonStandings(ctx context.Context, nk runtime.NakamaModule, seasonID string) ([]*SeasonStanding, error) {
+	var standings []*SeasonStanding
+	cursor := ""
+	for {
+		records, _, nextCursor, _, err := nk.LeaderboardRecordsList(ctx, getSeasonLeaderboardID(seasonID), nil, nakamaCommands.MAX_LIST_LIMIT, cursor, 0)
+		if err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		for _, record := range records {
+			standings = append(standings, &SeasonStanding{
+				Rank:     record.Rank,
+				UserID:   record.OwnerId,
+				Username: record.Username.GetValue(),
+				Score:    record.Score,
+			})
+		}
+		if nextCursor == "" || len(records) == 0 {
+			break
+		}
+		cursor = nextCursor
+	}
+	return standings, nil
+}
+
+// snapshotSeasonStandings stores the final standings once, later calls return the stored snapshot
+func snapshotSeasonStandings(ctx context.Context, nk runtime.NakamaModule, season *Season) (*SeasonStandings, error) {
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: SEASON_STANDINGS_COLLECTION,
+		Key:        season.ID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) != 0 {
+		var snapshot *SeasonStandings
+		if err := json.Unmarshal([]byte(storageObjects[0].Value), &snapshot); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		return snapshot, nil
+	}
+
+	standings, err := listSeasonStandings(ctx, nk, season.ID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	snapshot := &SeasonStandings{
+		SeasonID:  season.ID,
+		Standings: standings,
+		DateTime:  matchClock.Now().UTC(),
+	}
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      SEASON_STANDINGS_COLLECTION,
+			Key:             season.ID,
+			Value:           string(Marshal(snapshot)),
+			UserID:          nakamaContext.NakamaSystemUserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         "*",
+		},
+	}); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+func getSeasonReward(season *Season, rank int64) *SeasonReward {
+	for _, reward := range season.Rewards {
+		if rank >= reward.MinRank && rank <= reward.MaxRank {
+			return reward
+		}
+	}
+	return nil
+}
+
+func readSeasonPlacement(ctx context.Context, nk runtime.NakamaModule, seasonID string, userID string) (*SeasonPlacement, error) {
+	var placement *SeasonPlacement
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: SEASON_PLACEMENT_COLLECTION,
+		Key:        seasonID,
+		UserID:     userID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &placement); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	return placement, nil
+}
+
+func hasSeasonWalletEntry(items []runtime.WalletLedgerItem, seasonID string) bool {
+	for _, item := range items {
+		if item.GetMetadata()["SeasonID"] == seasonID {
+			return true
+		}
+	}
+	return false
+}
+
+// grantSeasonPlacement grants the season rewards to the user and then stores the placement,
+// a stored placement or a season entry in the wallet ledger skips the rewards already granted when the grant is resumed
+func grantSeasonPlacement(ctx context.Context, nk runtime.NakamaModule, season *Season, standing *SeasonStanding) error {
+	granted, err := readSeasonPlacement(ctx, nk, season.ID, standing.UserID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if granted != nil {
+		log.Infof("Placement of user %v in season %v already granted", standing.UserID, season.ID)
+		return nil
+	}
+
+	placement := &SeasonPlacement{
+		SeasonID:   season.ID,
+		SeasonName: season.Name,
+		Rank:       standing.Rank,
+		Score:      standing.Score,
+		DateTime:   matchClock.Now().UTC(),
+	}
+	reward := getSeasonReward(season, standing.Rank)
+	if reward != nil {
+		placement.Coins = reward.Coins
+		placement.Badge = reward.Badge
+	}
+
+	if reward != nil && reward.Coins != 0 {
+		items, err := listWalletLedger(ctx, nk, standing.UserID)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
+		if !hasSeasonWalletEntry(items, season.ID) {
+			if err := nk.WalletsUpdate(ctx, []*runtime.WalletUpdate{&runtime.WalletUpdate{
+				UserID:    standing.UserID,
+				Changeset: map[string]interface{}{REWARD_CURRENCY_COINS: reward.Coins},
+				Metadata: map[string]interface{}{
+					"SeasonID": season.ID,
+					"Rank":     standing.Rank,
+					"Amount":   reward.Coins,
+				},
+			}}, true); err != nil {
+				log.Errorf("failed to grant season reward: %v", err)
+				return err
+			}
+		}
+	}
+	if reward != nil && reward.Badge != "" {
+		if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+			&runtime.StorageWrite{
+				Collection:      USER_BADGE_COLLECTION,
+				Key:             reward.Badge,
+				Value:           string(Marshal(&UserBadge{Badge: reward.Badge, SeasonID: season.ID, DateTime: placement.DateTime})),
+				UserID:          standing.UserID,
+				PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+				PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			},
+		}); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	if _, err := nk.StorageWrite(ctx, []*runtime.StorageWrite{
+		&runtime.StorageWrite{
+			Collection:      SEASON_PLACEMENT_COLLECTION,
+			Key:             season.ID,
+			Value:           string(Marshal(placement)),
+			UserID:          standing.UserID,
+			PermissionWrite: runtime.STORAGE_PERMISSION_NO_WRITE,
+			PermissionRead:  runtime.STORAGE_PERMISSION_PUBLIC_READ,
+			Version:         "*",
+		},
+	}); err != nil && !isStorageVersionConflict(err) {
+		log.Error(err)
+		return err
+	}
+	return nil
+}
+
+// endSeason claims the season, snapshots the final standings, grants the season rewards and closes the season.
+// A season left ending by an interrupted call is resumed.
+func endSeason(ctx context.Context, nk runtime.NakamaModule, season *Season) error {
+	switch season.Status {
+	case SEASON_STATUS_ENDED:
+		return nil
+	case SEASON_STATUS_OPEN:
+		season.Status = SEASON_STATUS_ENDING
+		if err := writeSeason(ctx, nk, season); err != nil {
+			if isStorageVersionConflict(err) {
+				log.Infof("Season %v is already being ended", season.ID)
+				return nil
+			}
+			log.Error(err)
+			return err
+		}
+	}
+	snapshot, err := snapshotSeasonStandings(ctx, nk, season)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	for _, standing := range snapshot.Standings {
+		if err := grantSeasonPlacement(ctx, nk, season, standing); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+
+	season.Status = SEASON_STATUS_ENDED
+	if err := writeSeason(ctx, nk, season); err != nil {
+		log.Error(err)
+		return err
+	}
+	log.Infof("Season %v ended with %v ranked users", season.ID, len(snapshot.Standings))
+
+	if _, err := notifyDiscordChannel(getConfig().DiscordAnnouncementsSeasonsChannelID, printSeasonStandings(season, snapshot)); err != nil {
+		log.Error(err)
+	}
+	return nil
+}
+
+func endExpiredSeasons(ctx context.Context, nk runtime.NakamaModule) error {
+	seasons, err := listSeasons(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	now := matchClock.Now().UTC()
+	for _, season := range seasons {
+		if season.Status == SEASON_STATUS_ENDED || now.Before(season.DateTimeEnd) {
+			continue
+		}
+		if err := endSeason(ctx, nk, season); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	return nil
+}
+
+// runSeasonEndSchedule ends the expired seasons every SEASON_END_CHECK_INTERVAL until the context is done
+func runSeasonEndSchedule(ctx context.Context, nk runtime.NakamaModule) {
+	ticker := time.NewTicker(SEASON_END_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := endExpiredSeasons(ctx, nk); err != nil {
+				log.Error(err)
+			}
+		}
+	}
+}
+
+func printSeasonStandings(season *Season, snapshot *SeasonStandings) string {
+	msg := fmt.Sprintf("> Season **%v** is over, final standings:\n", season.Name)
+	for _, standing := range snapshot.Standings {
+		if getSeasonReward(season, standing.Rank) == nil {
+			break
+		}
+		msg += fmt.Sprintf("%v. **%v** %v\n", standing.Rank, standing.Username, standing.Score)
+	}
+	return msg
+}
+
+func SeasonCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *SeasonCreateRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil || request.ID == "" || !request.DateTimeEnd.After(request.DateTimeStart) {
+		return "", runtime.NewError("Season ID and an end date after the start date are required", 3)
+	}
+
+	seasons, err := listSeasons(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	for _, season := range seasons {
+		if season.Status != SEASON_STATUS_ENDED && request.DateTimeStart.Before(season.DateTimeEnd) && season.DateTimeStart.Before(request.DateTimeEnd) {
+			return "", runtime.NewError(fmt.Sprintf("Season overlaps with season **%v**", season.ID), 6)
+		}
+	}
+
+	season := &Season{
+		ID:            request.ID,
+		Name:          request.Name,
+		DateTimeStart: request.DateTimeStart.UTC(),
+		DateTimeEnd:   request.DateTimeEnd.UTC(),
+		Status:        SEASON_STATUS_OPEN,
+		Rewards:       request.Rewards,
+		Version:       "*",
+	}
+	if season.Name == "" {
+		season.Name = season.ID
+	}
+	if err := writeSeason(ctx, nk, season); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if err := nk.LeaderboardCreate(ctx, getSeasonLeaderboardID(season.ID), true, "desc", "incr", "", map[string]interface{}{"SeasonID": season.ID}); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return MarshalIndent(season), nil
+}
+
+func SeasonEndRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *SeasonEndRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("ID is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return "", err
+	}
+	season, err := readSeason(ctx, nk, request.ID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if season == nil {
+		return "", runtime.NewError(fmt.Sprintf("No season found with ID: %v", request.ID), 5)
+	}
+	if err := endSeason(ctx, nk, season); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return MarshalIndent(season), nil
+}
+
+func SeasonListRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	if err := endExpiredSeasons(ctx, nk); err != nil {
+		log.Error(err)
+	}
+	seasons, err := listSeasons(ctx, nk)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	return MarshalIndent(seasons), nil
+}
+
+func SeasonPlacementsGetRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
+	var request *SeasonPlacementsGetRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		request = &SeasonPlacementsGetRequest{}
+	}
+	// the placements of the session user are returned when no user is requested
+	if request.UserID == "" {
+		request.UserID = getCallerUserID(ctx)
+	}
+	if err := validateUserID("UserID", request.UserID); err != nil {
+		return "", err
+	}
+
+	var placements []*SeasonPlacement
+	storageObjects, _, err := nk.StorageList(ctx, request.UserID, SEASON_PLACEMENT_COLLECTION, nakamaCommands.MAX_LIST_LIMIT, "")
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	for _, object := range storageObjects {
+		var placement *SeasonPlacement
+		if err := json.Unmarshal([]byte(object.Value), &placement); err != nil {
+			log.Error(err)
+			return "", err
+		}
+		placements = append(placements, placement)
+	}
+	sort.Slice(placements, func(i, j int) bool {
+		return placements[i].DateTime.After(placements[j].DateTime)
+	})
+	return MarshalIndent(placements), nil
+}
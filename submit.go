@@ -5,7 +5,6 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
-	"time"
 
 	nakamaCommands "github.com/challenge-league/nakama-go/commands"
 	"github.com/heroiclabs/nakama-common/runtime"
@@ -63,8 +62,20 @@ func writeSubmits(ctx context.Context, nk runtime.NakamaModule, submits *nakamaC
 
 func SubmitCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	var submitCreateRequest *nakamaCommands.SubmitCreateRequest
-	json.Unmarshal([]byte(payload), &submitCreateRequest)
-	submitCreateRequest.Submit.Datetime = time.Now().UTC()
+	if err := decodeRequest(payload, &submitCreateRequest); err != nil {
+		return "", err
+	}
+	if submitCreateRequest == nil || submitCreateRequest.Submit == nil {
+		return "", errInvalidArgument("Submit is required")
+	}
+
+	userID, err := getActingUserID(ctx, nk, "SubmitCreate", submitCreateRequest.MatchID, submitCreateRequest.UserID)
+	if err != nil {
+		log.Error(err)
+		return "", err
+	}
+	submitCreateRequest.UserID = userID
+	submitCreateRequest.Submit.Datetime = matchClock.Now().UTC()
 	log.Infof(MarshalIndent(submitCreateRequest))
 
 	submits, err := readSubmits(ctx, nk, submitCreateRequest.MatchID, submitCreateRequest.UserID)
@@ -10,6 +10,7 @@ import (
 	nakamaCommands "github.com/challenge-league/nakama-go/commands"
 	"github.com/heroiclabs/nakama-common/runtime"
 	log "github.com/micro/go-micro/v2/logger"
+	"open-match.dev/open-match/pkg/pb"
 )
 
 func readLastUserIDTicketState(ctx context.Context, nk runtime.NakamaModule, userID string) (*nakamaCommands.TicketState, error) {
@@ -145,7 +146,15 @@ func readTicketState(ctx context.Context, nk runtime.NakamaModule, ticketID stri
 func TicketStateCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	log.Info(payload)
 	var ticketStateCreateRequest *nakamaCommands.TicketStateCreateRequest
-	json.Unmarshal([]byte(payload), &ticketStateCreateRequest)
+	if err := decodeRequest(payload, &ticketStateCreateRequest); err != nil {
+		return "", err
+	}
+	if ticketStateCreateRequest == nil || ticketStateCreateRequest.TicketState == nil || ticketStateCreateRequest.TicketState.Ticket == nil {
+		return "", errInvalidArgument("TicketState with a Ticket is required")
+	}
+	if err := validateUserID("UserID", ticketStateCreateRequest.UserID); err != nil {
+		return "", err
+	}
 
 	if err := writeTicketState(ctx, nk, ticketStateCreateRequest.TicketState, ticketStateCreateRequest.UserID); err != nil {
 		log.Infof("unable to create ticket state: %q", err.Error())
@@ -180,3 +189,38 @@ func writeTicketState(ctx context.Context, nk runtime.NakamaModule, ticketState
 
 	return nil
 }
+
+// requeueTicketState puts the user back into the Open Match queue with the search fields of the previous ticket
+func requeueTicketState(ctx context.Context, nk runtime.NakamaModule, ticketState *nakamaCommands.TicketState, userID string) (*pb.Ticket, error) {
+	ticket, err := OpenMatchFrontendTicketCreate(&pb.CreateTicketRequest{
+		Ticket: &pb.Ticket{
+			SearchFields: ticketState.Ticket.SearchFields,
+			Extensions:   ticketState.Ticket.Extensions,
+		},
+	})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if err := writeTicketState(ctx, nk, &nakamaCommands.TicketState{
+		Ticket:    ticket,
+		UserReady: ticketState.UserReady,
+		Version:   "*",
+	}, userID); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if err := createOrUpdateLastUserData(ctx, nk, &nakamaCommands.UserData{
+		TicketID: ticket.Id,
+	}, userID); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	if err := OpenMatchFrontendTicketDelete(ticketState.Ticket.Id); err != nil {
+		log.Error(err)
+	}
+	return ticket, nil
+}
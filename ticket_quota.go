@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	nakamaCommands "github.com/challenge-league/nakama-go/commands"
+	nakamaContext "github.com/challenge-league/nakama-go/context"
+	"github.com/heroiclabs/nakama-common/runtime"
+	log "github.com/micro/go-micro/v2/logger"
+)
+
+const (
+	// Reject the new ticket while the user already holds the allowed number of tickets
+	TICKET_QUOTA_POLICY_REJECT = "reject"
+	// Delete the oldest tickets of the user to make room for the new ticket
+	TICKET_QUOTA_POLICY_REPLACE = "replace"
+)
+
+type TicketQuotaSettings struct {
+	MaxTickets int
+	Policy     string
+}
+
+func getTicketQuotaSettings() *TicketQuotaSettings {
+	config := getConfig()
+	return &TicketQuotaSettings{
+		MaxTickets: config.TicketQuotaMaxTickets,
+		Policy:     config.TicketQuotaPolicy,
+	}
+}
+
+// readActiveMatchState returns the in-flight match recorded in the last user data, nil when the user is not in a match
+func readActiveMatchState(ctx context.Context, nk runtime.NakamaModule, userID string) (*nakamaCommands.MatchState, error) {
+	userData, err := readLastUserData(ctx, nk, userID)
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if userData == nil || userData.MatchID == "" {
+		return nil, nil
+	}
+
+	storageObjects, err := nk.StorageRead(ctx, []*runtime.StorageRead{&runtime.StorageRead{
+		Collection: nakamaCommands.MATCH_COLLECTION,
+		Key:        userData.MatchID,
+		UserID:     nakamaContext.NakamaSystemUserID,
+	}})
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if len(storageObjects) == 0 {
+		return nil, nil
+	}
+	var matchState *nakamaCommands.MatchState
+	if err := json.Unmarshal([]byte(storageObjects[0].Value), &matchState); err != nil {
+		log.Error(err)
+		return nil, err
+	}
+	if !matchState.Active {
+		return nil, nil
+	}
+	return matchState, nil
+}
+
+// readQueuedTicketStates returns the tickets of the user which are not assigned to a match yet, the oldest first
+func readQueuedTicketStates(ctx context.Context, nk runtime.NakamaModule, userID string) ([]*nakamaCommands.TicketState, error) {
+	objects, _, err := nk.StorageList(ctx, userID, nakamaCommands.TICKET_COLLECTION, nakamaCommands.MAX_LIST_LIMIT, "")
+	if err != nil {
+		log.Error(err)
+		return nil, err
+	}
+
+	sort.Slice(objects[:], func(i, j int) bool {
+		return objects[i].CreateTime.Seconds < objects[j].CreateTime.Seconds
+	})
+
+	var ticketStates []*nakamaCommands.TicketState
+	for _, object := range objects {
+		var ticketState *nakamaCommands.TicketState
+		if err := json.Unmarshal([]byte(object.Value), &ticketState); err != nil {
+			log.Error(err)
+			return nil, err
+		}
+		if ticketState.MatchID != "" || ticketState.Ticket == nil {
+			continue
+		}
+		ticketState.Version = object.Version
+		ticketStates = append(ticketStates, ticketState)
+	}
+	return ticketStates, nil
+}
+
+// deleteQueuedTicketState removes the ticket from Open Match and the storage and clears it from the last user data
+func deleteQueuedTicketState(ctx context.Context, nk runtime.NakamaModule, ticketState *nakamaCommands.TicketState, userID string) error {
+	if err := OpenMatchFrontendTicketDelete(ticketState.Ticket.Id); err != nil {
+		log.Error(err)
+	}
+
+	if err := deleteTicketState(ctx, nk, ticketState.Ticket.Id, userID); err != nil {
+		log.Error(err)
+		return err
+	}
+
+	userData, err := readLastUserData(ctx, nk, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if userData != nil && userData.TicketID == ticketState.Ticket.Id {
+		userData.TicketID = ""
+		if err := writeLastUserData(ctx, nk, userData, userID); err != nil {
+			log.Error(err)
+			return err
+		}
+	}
+	log.Infof("Ticket %v of user %v replaced", ticketState.Ticket.Id, userID)
+	return nil
+}
+
+// checkTicketQuota refuses queueing while the user is in an active match and enforces the per user ticket quota
+func checkTicketQuota(ctx context.Context, nk runtime.NakamaModule, userID string) error {
+	matchState, err := readActiveMatchState(ctx, nk, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if matchState != nil {
+		return runtime.NewError(fmt.Sprintf("Unable to queue while in the active match **%v**", matchState.MatchID), 9)
+	}
+
+	settings := getTicketQuotaSettings()
+	ticketStates, err := readQueuedTicketStates(ctx, nk, userID)
+	if err != nil {
+		log.Error(err)
+		return err
+	}
+	if len(ticketStates) < settings.MaxTickets {
+		return nil
+	}
+
+	switch settings.Policy {
+	case TICKET_QUOTA_POLICY_REPLACE:
+		for _, ticketState := range ticketStates[:len(ticketStates)-settings.MaxTickets+1] {
+			if err := deleteQueuedTicketState(ctx, nk, ticketState, userID); err != nil {
+				log.Error(err)
+				return err
+			}
+		}
+		return nil
+	case TICKET_QUOTA_POLICY_REJECT:
+	default:
+		log.Errorf("Unknown ticket quota policy %v, using %v", settings.Policy, TICKET_QUOTA_POLICY_REJECT)
+	}
+	return runtime.NewError(fmt.Sprintf("Unable to queue, already in the queue with %v ticket(s)", len(ticketStates)), 8)
+}
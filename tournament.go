@@ -3,7 +3,6 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"strings"
 	"time"
 
@@ -29,7 +28,7 @@ func createNakamaTournament(ctx context.Context, logger runtime.Logger, db *sql.
 		maxNumScore = matchState.MaxNumScore
 	}
 
-	startTime := time.Now().UTC()
+	startTime := matchClock.Now().UTC()
 	endTime := startTime.Add(time.Second * time.Duration(infiniteDuration))
 
 	payload := Marshal(&nakamaCommands.TournamentCreateRequest{
@@ -58,10 +57,11 @@ func createNakamaTournament(ctx context.Context, logger runtime.Logger, db *sql.
 	}
 	log.Infof("%+v", MarshalIndent(result))
 
-	matchState.DateTimeStart = startTime
-	matchState.DateTimeEnd = startTime.Add(matchState.Duration)
-
-	matchState, err = writeMatchState(ctx, nk, matchState)
+	matchState, err = updateMatchState(ctx, nk, matchState.MatchID, func(matchState *nakamaCommands.MatchState, tx *matchStateTx) error {
+		matchState.DateTimeStart = startTime
+		matchState.DateTimeEnd = startTime.Add(matchState.Duration)
+		return nil
+	})
 	if err != nil {
 		log.Error(err)
 		return nil, err
@@ -85,25 +85,34 @@ func createNakamaTournament(ctx context.Context, logger runtime.Logger, db *sql.
 
 func TournamentCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	log.Info(payload)
-	var params map[string]interface{}
-	json.Unmarshal([]byte(payload), &params)
+	var request *nakamaCommands.TournamentCreateRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if err := validateTournamentCreateRequest(request); err != nil {
+		log.Error(err)
+		return "", err
+	}
+	if request.Metadata == nil {
+		request.Metadata = map[string]interface{}{}
+	}
 
 	if err := nk.TournamentCreate(
 		ctx,
-		params["ID"].(string),
-		params["SortOrder"].(string),
-		params["Operator"].(string),
-		params["ResetSchedule"].(string),
-		params["Metadata"].(map[string]interface{}),
-		params["Title"].(string),
-		params["Description"].(string),
-		int(params["Category"].(float64)),
-		int(params["StartTime"].(float64)),
-		int(params["EndTime"].(float64)),
-		int(params["Duration"].(float64)),
-		int(params["MaxSize"].(float64)),
-		int(params["MaxNumScore"].(float64)),
-		params["JoinRequired"].(bool),
+		request.ID,
+		request.SortOrder,
+		request.Operator,
+		request.ResetSchedule,
+		request.Metadata,
+		request.Title,
+		request.Description,
+		request.Category,
+		request.StartTime,
+		request.EndTime,
+		request.Duration,
+		request.MaxSize,
+		request.MaxNumScore,
+		request.JoinRequired,
 	); err != nil {
 		log.Infof("unable to create tournament: %q", err.Error())
 		return "", err
@@ -3,7 +3,7 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"fmt"
 	"log"
 
 	common_api "github.com/heroiclabs/nakama-common/api"
@@ -15,10 +15,28 @@ func StorageWriteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk
 	//var params map[string]interface{}
 	//json.Unmarshal([]byte(payload), &params)
 	var storageWrite []*runtime.StorageWrite
-	if err := json.Unmarshal([]byte(payload), &storageWrite); err != nil {
-		log.Printf("unable to create tournament: %q", err.Error())
+	if err := decodeRequest(payload, &storageWrite); err != nil {
+		log.Printf("unable to write storage: %q", err.Error())
 		return "", err
 	}
+	if len(storageWrite) != 1 || storageWrite[0] == nil {
+		return "", errInvalidArgument("Exactly one storage object is required")
+	}
+	if err := validateRequired("Collection", storageWrite[0].Collection); err != nil {
+		return "", err
+	}
+	if err := validateRequired("Key", storageWrite[0].Key); err != nil {
+		return "", err
+	}
+	if storageWrite[0].Collection == REWARD_RULE_COLLECTION {
+		var rule *RewardRule
+		if err := decodeRequest(storageWrite[0].Value, &rule); err != nil {
+			return "", err
+		}
+		if err := validateRewardRule(storageWrite[0].Key, rule); err != nil {
+			return "", err
+		}
+	}
 	log.Printf("%+v", string(MarshalIndent(storageWrite)))
 
 	result, err := nk.StorageWrite(ctx, storageWrite)
@@ -29,52 +47,76 @@ func StorageWriteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk
 	}
 
 	if len(result) != 1 {
-		log.Printf("Invocation failed. Return result not expected: ", len(result))
-		return "", err
+		log.Printf("Invocation failed. Return result not expected: %v", len(result))
+		return "", fmt.Errorf("Unexpected storage write result: %v", len(result))
 	}
 
 	return MarshalIndent(result), nil
 }
 
 func TournamentDeleteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *TournamentDeleteRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Tournament is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return "", err
+	}
+	if err := checkTournamentExists(ctx, nk, request.ID); err != nil {
 		return "", err
 	}
 
-	if err := nk.TournamentDelete(ctx, params["ID"].(string)); err != nil {
+	if err := nk.TournamentDelete(ctx, request.ID); err != nil {
+		log.Print(err)
 		return "", err
 	}
 	return "", nil
 }
 
 func LeaderboardCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *LeaderboardCreateRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if err := validateLeaderboardCreateRequest(request); err != nil {
 		return "", err
 	}
+	if request.Metadata == nil {
+		request.Metadata = map[string]interface{}{}
+	}
 
 	if err := nk.LeaderboardCreate(
 		ctx,
-		params["ID"].(string),
-		params["Authoritative"].(bool),
-		params["SortOrder"].(string),
-		params["Operator"].(string),
-		params["ResetSchedule"].(string),
-		params["Metadata"].(map[string]interface{}),
+		request.ID,
+		request.Authoritative,
+		request.SortOrder,
+		request.Operator,
+		request.ResetSchedule,
+		request.Metadata,
 	); err != nil {
+		log.Print(err)
 		return "", err
 	}
 	return "", nil
 }
 
 func LeaderboardDeleteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *LeaderboardDeleteRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Leaderboard is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
 		return "", err
 	}
 
-	if err := nk.LeaderboardDelete(ctx, params["ID"].(string)); err != nil {
+	if err := nk.LeaderboardDelete(ctx, request.ID); err != nil {
+		log.Print(err)
 		return "", err
 	}
 	return "", nil
@@ -82,23 +124,33 @@ func LeaderboardDeleteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB
 }
 
 func LeaderboardRecordWriteRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *LeaderboardRecordWriteRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if err := validateLeaderboardRecordWriteRequest(request); err != nil {
+		return "", err
+	}
+	if err := checkCallerOwns(ctx, request.OwnerID); err != nil {
 		return "", err
 	}
+	if err := checkUserExists(ctx, nk, request.OwnerID); err != nil {
+		return "", err
+	}
+	if request.Metadata == nil {
+		request.Metadata = map[string]interface{}{}
+	}
 
-	//score, _ := strconv.ParseInt(params["Score"].(string), 10, 64)
-	//subscore, _ := strconv.ParseInt(params["Subscore"].(string), 10, 64)
-	//int64(params["Subscore"].(float64)),
 	if result, err := nk.LeaderboardRecordWrite(
 		ctx,
-		params["ID"].(string),
-		params["OwnerID"].(string),
-		params["Username"].(string),
-		int64(params["Score"].(float64)),
-		int64(params["Subscore"].(float64)),
-		map[string]interface{}{},
+		request.ID,
+		request.OwnerID,
+		request.Username,
+		request.Score,
+		request.Subscore,
+		request.Metadata,
 	); err != nil {
+		log.Print(err)
 		return "", err
 	} else {
 		return MarshalIndent(result), err
@@ -106,15 +158,27 @@ func LeaderboardRecordWriteRPC(ctx context.Context, logger runtime.Logger, db *s
 }
 
 func LeaderboardRecordDelete(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *LeaderboardRecordDeleteRequest
+	if err := decodeRequest(payload, &request); err != nil {
+		return "", err
+	}
+	if request == nil {
+		return "", errInvalidArgument("Leaderboard record is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return "", err
+	}
+	if err := validateUserID("OwnerID", request.OwnerID); err != nil {
+		return "", err
+	}
+	if err := checkCallerOwns(ctx, request.OwnerID); err != nil {
 		return "", err
 	}
 
 	if err := nk.LeaderboardRecordDelete(
 		ctx,
-		params["ID"].(string),
-		params["OwnerID"].(string),
+		request.ID,
+		request.OwnerID,
 	); err != nil {
 		return "", err
 	} else {
@@ -123,18 +187,27 @@ func LeaderboardRecordDelete(ctx context.Context, logger runtime.Logger, db *sql
 }
 
 func LeaderboardRecordList(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (*common_api.LeaderboardRecordList, error) {
-	var params map[string]interface{}
-	if err := json.Unmarshal([]byte(payload), &params); err != nil {
+	var request *LeaderboardRecordListRequest
+	if err := decodeRequest(payload, &request); err != nil {
 		return nil, err
 	}
+	if request == nil {
+		return nil, errInvalidArgument("Leaderboard is required")
+	}
+	if err := validateRequired("ID", request.ID); err != nil {
+		return nil, err
+	}
+	if request.Limit < 0 {
+		return nil, errInvalidArgument("Limit must not be negative")
+	}
 
 	if records, ownerRecords, nextCursorStr, prevCursorStr, err := nk.LeaderboardRecordsList(
 		ctx,
-		params["ID"].(string),
-		params["OwnerIDs"].([]string),
-		params["Limit"].(int),
-		params["Cursor"].(string),
-		params["Expiry"].(int64),
+		request.ID,
+		request.OwnerIDs,
+		request.Limit,
+		request.Cursor,
+		request.Expiry,
 	); err != nil {
 		return nil, err
 	} else {
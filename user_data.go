@@ -79,7 +79,15 @@ func readUserData(ctx context.Context, nk runtime.NakamaModule, key string, user
 func LastUserDataCreateRPC(ctx context.Context, logger runtime.Logger, db *sql.DB, nk runtime.NakamaModule, payload string) (string, error) {
 	log.Info(payload)
 	var userDataCreateRequest *nakamaCommands.LastUserDataCreateRequest
-	json.Unmarshal([]byte(payload), &userDataCreateRequest)
+	if err := decodeRequest(payload, &userDataCreateRequest); err != nil {
+		return "", err
+	}
+	if userDataCreateRequest == nil || userDataCreateRequest.UserData == nil {
+		return "", errInvalidArgument("UserData is required")
+	}
+	if err := validateUserID("UserID", userDataCreateRequest.UserID); err != nil {
+		return "", err
+	}
 
 	if err := writeLastUserData(ctx, nk, userDataCreateRequest.UserData, userDataCreateRequest.UserID); err != nil {
 		log.Infof("unable to create user data: %q", err.Error())